@@ -1,14 +1,52 @@
 package utils
 
 import (
+	"context"
+	"io"
 	"os/exec"
+	"syscall"
+	"time"
 
 	logging "github.com/ipfs/go-log"
 )
 
 // SH is a convenience wrapper over sh.
 func SH(c string) (string, error) {
+	return SHContext(context.Background(), c)
+}
+
+// SHContext is like SH, the command is killed if the context is done before it completes.
+func SHContext(ctx context.Context, c string) (string, error) {
 	logging.Logger("sh").Debugf("Executing sh command: %s", c)
-	o, err := exec.Command("/bin/sh", "-c", c).CombinedOutput()
+	o, err := shCommand(ctx, c).CombinedOutput()
+	if ctx.Err() != nil {
+		return string(o), ctx.Err()
+	}
 	return string(o), err
 }
+
+// SHStream runs c with sh, writing its output to stdout and stderr as it is produced.
+func SHStream(ctx context.Context, c string, stdout, stderr io.Writer) error {
+	logging.Logger("sh").Debugf("Executing sh command: %s", c)
+	cmd := shCommand(ctx, c)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// shCommand returns sh running c. Once ctx is done the whole process group is killed, as children of sh
+// would otherwise keep the output open, and the command from returning.
+func shCommand(ctx context.Context, c string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", c)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// in case a child left the group, and still holds the output
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
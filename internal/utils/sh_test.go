@@ -0,0 +1,41 @@
+package utils_test
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/internal/utils"
+)
+
+var _ = Describe("sh", func() {
+	It("returns the combined output", func() {
+		out, err := utils.SH("echo out; echo err >&2")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal("out\nerr\n"))
+	})
+
+	It("returns once cancelled, even if children hold the output", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := utils.SHContext(ctx, "sleep 30 & sleep 30")
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+
+	It("stops streaming once cancelled", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+
+		out := &bytes.Buffer{}
+		start := time.Now()
+		err := utils.SHStream(ctx, "echo started; sleep 30 & sleep 30", out, out)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		Expect(out.String()).To(Equal("started\n"))
+	})
+})
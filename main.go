@@ -64,11 +64,21 @@ $ peg --iso path_to_iso_file <file.yaml>
 				Usage:  "overrides drive in peg specfiles",
 				EnvVar: "PEG_DRIVE",
 			},
+			cli.StringFlag{
+				Name:   "base-image",
+				Usage:  "overrides base image in peg specfiles",
+				EnvVar: "PEG_BASE_IMAGE",
+			},
 			cli.StringFlag{
 				Name:   "state",
 				Usage:  "overrides state dir in peg specfiles",
 				EnvVar: "PEG_STATE",
 			},
+			cli.StringFlag{
+				Name:   "ssh-key",
+				Usage:  "private key file used for SSH authentication",
+				EnvVar: "PEG_SSH_KEY",
+			},
 			cli.StringFlag{
 				Name:   "loglevel",
 				Value:  "debug",
@@ -102,7 +112,7 @@ $ peg --iso path_to_iso_file <file.yaml>
 			cli.StringFlag{
 				Name:   "slow-spec-threshold",
 				Value:  "",
-				Usage:  "Slow spec threshold",
+				Usage:  "Report the progress of specs running for longer than this",
 				EnvVar: "PEG_SLOWSPECTHRESHOLD",
 			},
 			cli.IntFlag{
@@ -128,7 +138,7 @@ $ peg --iso path_to_iso_file <file.yaml>
 			},
 			cli.BoolFlag{
 				Name:   "emit-spec-progress",
-				Usage:  "emit progress of specs",
+				Usage:  "Deprecated, does nothing: use --slow-spec-threshold",
 				EnvVar: "PEG_EMITSPECPROGRESS",
 			},
 			cli.BoolFlag{
@@ -153,7 +163,7 @@ $ peg --iso path_to_iso_file <file.yaml>
 			},
 			cli.BoolFlag{
 				Name:   "always-emit-writer",
-				Usage:  "Always write",
+				Usage:  "Deprecated, same as --verbose",
 				EnvVar: "PEG_ALWAYS_WRITE",
 			},
 			cli.BoolFlag{
@@ -185,11 +195,13 @@ $ peg --iso path_to_iso_file <file.yaml>
 			machineOpts := []types.MachineOption{
 				types.WithCPU(c.String("cpu")),
 				types.WithDrive(c.String("drive")),
+				types.WithBaseImage(c.String("base-image")),
 				types.WithMemory(c.String("memory")),
 				types.WithStateDir(c.String("state")),
 				types.WithImage(c.String("image")),
 				types.WithISO(c.String("iso")),
 				types.WithISOChecksum(c.String("iso-checksum")),
+				types.WithSSHPrivateKeyFile(c.String("ssh-key")),
 			}
 
 			if c.Bool("vbox") {
@@ -7,15 +7,14 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"sync"
+	"strings"
 	"time"
 
-	"github.com/pkg/errors"
 	"github.com/spectrocloud/peg/pkg/controller"
 	"github.com/spectrocloud/peg/pkg/machine/types"
-	"go.uber.org/zap/buffer"
 
-	. "github.com/onsi/gomega" //nolint:revive
+	. "github.com/onsi/ginkgo/v2" //nolint:revive
+	. "github.com/onsi/gomega"    //nolint:revive
 )
 
 type VM struct {
@@ -39,6 +38,20 @@ func (vm VM) Sudo(s string) (string, error) {
 	return machineSudo(vm.machine, s)
 }
 
+func (vm VM) SudoContext(ctx context.Context, s string) (string, error) {
+	return machineSudoContext(ctx, vm.machine, s)
+}
+
+// Stream runs cmd on the VM, writing its output to Output as it is produced.
+func (vm VM) Stream(ctx context.Context, cmd string, opts ...types.RunOption) (*types.CommandResult, error) {
+	return controller.Stream(ctx, vm.machine, cmd, Output, opts...)
+}
+
+// Interactive starts cmd in a pseudo terminal on the VM, to be driven with Expect and Send.
+func (vm VM) Interactive(cmd string) (*controller.PTYSession, error) {
+	return controller.NewPTYSession(vm.machine, cmd)
+}
+
 func (vm VM) Scp(s, d, permissions string) error {
 	return machineScp(vm.machine, s, d, permissions)
 }
@@ -51,6 +64,46 @@ func (vm VM) EventuallyConnects(t ...int) {
 	machineEventuallyConnects(vm.machine, t...)
 }
 
+func (vm VM) ConsoleEventuallyContains(s string, t ...int) {
+	machineConsoleEventuallyContains(vm.machine, s, t...)
+}
+
+func (vm VM) SendKeys(keys ...string) error {
+	return vm.machine.SendKeys(keys...)
+}
+
+func (vm VM) TypeText(text string) error {
+	return vm.machine.TypeText(text)
+}
+
+// SetLinkUp plugs or unplugs the network cables of the VM, only the ones of the given networks if any.
+func (vm VM) SetLinkUp(up bool, networks ...string) error {
+	return vm.machine.SetLinkUp(up, networks...)
+}
+
+// SetNetworkConditions adds packet loss and latency to the VM network. The zero value restores it.
+func (vm VM) SetNetworkConditions(c types.NetworkConditions) error {
+	return vm.machine.SetNetworkConditions(c)
+}
+
+// HostPort returns the host port the given guest port of the VM is forwarded to.
+func (vm VM) HostPort(guestPort int) (int, error) {
+	return vm.machine.HostPort(guestPort)
+}
+
+// Address returns the IPv4 address of the VM on the named private network.
+func (vm VM) Address(network string) (string, error) {
+	addresses, err := vm.machine.Addresses(context.Background())
+	if err != nil {
+		return "", err
+	}
+	a, ok := addresses[network]
+	if !ok {
+		return "", fmt.Errorf("no address on network %s", network)
+	}
+	return a, nil
+}
+
 func (vm VM) Reboot(t ...int) {
 	machineReboot(vm.machine, t...)
 }
@@ -104,86 +157,122 @@ func (vm VM) Destroy(additionalCleanup func(vm VM)) error {
 	return nil
 }
 
+// Machine is the machine the global helpers run on. It is nil in multi-machine specs, use Machines instead.
 var Machine types.Machine
 
+// machine returns Machine, failing the spec if there is none.
+func machine() types.Machine {
+	Expect(Machine).ToNot(BeNil(), "no default machine: multi-machine specs must pick one with matcher.Machines.VM(name)")
+	return Machine
+}
+
+// Output receives the output of Sudo and Stream line by line while commands run.
+var Output io.Writer = GinkgoWriter
+
 func HasFile(s string) {
-	machineHasFile(Machine, s)
+	machineHasFile(machine(), s)
 }
 
 func Reboot(t ...int) {
-	machineReboot(Machine, t...)
+	machineReboot(machine(), t...)
 }
 
 func DetachCD() error {
-	return machineDetachCD(Machine)
+	return machineDetachCD(machine())
 }
 
 func HasDir(s string) {
-	machineHasDir(Machine, s)
+	machineHasDir(machine(), s)
 }
 
 func EventuallyConnects(t ...int) {
-	machineEventuallyConnects(Machine, t...)
+	machineEventuallyConnects(machine(), t...)
+}
+
+// ConsoleOutput returns the console output captured so far.
+func ConsoleOutput() (string, error) {
+	return machineConsoleOutput(machine())
+}
+
+// ConsoleEventuallyContains waits for s to show up in the machine console, for boot checks when SSH is not up yet.
+func ConsoleEventuallyContains(s string, t ...int) {
+	machineConsoleEventuallyContains(machine(), s, t...)
+}
+
+// SendKeys presses key combinations on the machine keyboard, in QEMU sendkey syntax (e.g. "ctrl-alt-delete").
+func SendKeys(keys ...string) error {
+	return machine().SendKeys(keys...)
+}
+
+// TypeText types text on the machine keyboard, e.g. to fill boot menus or passphrase prompts.
+func TypeText(text string) error {
+	return machine().TypeText(text)
 }
 
 func Sudo(c string) (string, error) {
-	return machineSudo(Machine, c)
+	return machineSudo(machine(), c)
+}
+
+// SudoContext is like Sudo, the command is killed if ctx is done before it exits.
+func SudoContext(ctx context.Context, c string) (string, error) {
+	return machineSudoContext(ctx, machine(), c)
+}
+
+// Stream runs cmd on the machine, writing its output to Output as it is produced.
+func Stream(ctx context.Context, cmd string, opts ...types.RunOption) (*types.CommandResult, error) {
+	return controller.Stream(ctx, machine(), cmd, Output, opts...)
+}
+
+// Interactive starts cmd in a pseudo terminal on the machine, to be driven with Expect and Send.
+func Interactive(cmd string) (*controller.PTYSession, error) {
+	return controller.NewPTYSession(machine(), cmd)
 }
 
 func Screenshot() (string, error) {
-	return machineScreenshot(Machine)
+	return machineScreenshot(machine())
 }
 
 func Scp(s, d, permissions string) error {
-	return machineScp(Machine, s, d, permissions)
+	return machineScp(machine(), s, d, permissions)
 }
 
 // GatherAllLogs will try to gather as much info from the system as possible, including services, dmesg and os related info.
 func GatherAllLogs(services []string, logFiles []string) {
-	machineGatherAllLogs(Machine, services, logFiles)
+	machineGatherAllLogs(machine(), services, logFiles)
 }
 
 // GatherLog will try to scp the given log from the machine to a local file.
 func GatherLog(logPath string) {
-	machineGatherLog(Machine, logPath)
+	machineGatherLog(machine(), logPath)
 }
 
+// machineGatherLog copies logPath from the machine to the logs directory. Files the user of the machine can't
+// read are read as root instead.
 func machineGatherLog(m types.Machine, logPath string) {
-	out, err := machineSudo(m, "chmod 777 "+logPath)
-	if err != nil {
-		fmt.Printf("Couldn't change permissions on %s\nError: %sOutput:%s\n", logPath, err.Error(), out)
-		return
-	}
-
 	fmt.Printf("Trying to get file: %s\n", logPath)
 
-	scpClient := controller.NewSCPClient(m)
-	defer scpClient.Close()
-
-	err = scpClient.Connect()
-	if err != nil {
-		fmt.Println("Couldn't establish a connection to the remote server ", err)
-		return
-	}
-
 	baseName := filepath.Base(logPath)
 	_ = os.Mkdir("logs", 0755)
-
-	f, _ := os.Create(fmt.Sprintf("logs/%s", baseName))
-	// Close the file after it has been copied
-	// Close client connection after the file has been copied
-	defer scpClient.Close()
-	defer f.Close()
+	dst := filepath.Join("logs", baseName)
 
 	ctx, can := context.WithTimeout(context.Background(), 2*time.Minute)
 	defer can()
-	err = scpClient.CopyFromRemote(ctx, f, logPath)
-	if err != nil {
-		fmt.Printf("Error while copying file: %s\n", err.Error())
-		return
+	if err := m.ReceiveFileContext(ctx, logPath, dst); err != nil {
+		res, sudoErr := m.Run(ctx, "sudo /bin/sh", types.WithStdin(strings.NewReader("cat "+types.ShellQuote(logPath))))
+		if sudoErr == nil && !res.Success() {
+			sudoErr = &types.ExitError{CommandResult: res}
+		}
+		if sudoErr != nil {
+			fmt.Printf("Error while copying file: %s\n", err.Error())
+			return
+		}
+		if err := os.WriteFile(dst, []byte(res.Stdout), 0666); err != nil {
+			fmt.Printf("Error while copying file: %s\n", err.Error())
+			return
+		}
 	}
 	// Change perms so its world readable
-	_ = os.Chmod(fmt.Sprintf("logs/%s", baseName), 0666)
+	_ = os.Chmod(dst, 0666)
 	fmt.Printf("File %s copied!\n", baseName)
 }
 
@@ -194,55 +283,22 @@ func machineHasFile(m types.Machine, s string) {
 }
 
 func machineSudo(m types.Machine, c string) (string, error) {
-	var wg sync.WaitGroup
+	return machineSudoContext(context.Background(), m, c)
+}
 
-	client, session, err := controller.NewClient(m)
-	if err != nil {
+// machineSudoContext feeds c to a root shell. Stdout is followed by stderr in the returned output, a command
+// exiting non-zero returns a *types.ExitError.
+func machineSudoContext(ctx context.Context, m types.Machine, c string) (string, error) {
+	res, err := controller.Stream(ctx, m, `sudo /bin/sh`, Output, types.WithStdin(bytes.NewBufferString(c)))
+	if res == nil {
 		return "", err
 	}
-	defer func() {
-		wg.Wait()
-		client.Close()
-		session.Close()
-	}()
-
-	stdOutPipe, err := session.StdoutPipe()
-	if err != nil {
-		return "", errors.Wrap(err, "setting up stdout pipe")
-	}
-	stdErrPipe, err := session.StderrPipe()
-	if err != nil {
-		return "", errors.Wrap(err, "setting up stderr pipe")
-	}
-	stdInPipe, err := session.StdinPipe()
-	if err != nil {
-		return "", errors.Wrap(err, "setting up stdin pipe")
-	}
-
-	var outBuf buffer.Buffer // TODO: needs a mutex
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		_, err := io.Copy(stdInPipe, bytes.NewBufferString(c))
-		if err != nil {
-			panic(err)
-		}
-
-		stdInPipe.Close()
-	}()
-
-	err = session.Run(`sudo /bin/sh`)
 
-	_, copyErr := io.Copy(&outBuf, stdOutPipe)
-	if copyErr != nil {
-		panic(err)
+	out := res.Stdout + res.Stderr
+	if err == nil && !res.Success() {
+		err = &types.ExitError{CommandResult: res}
 	}
-	_, copyErr = io.Copy(&outBuf, stdErrPipe)
-	if copyErr != nil {
-		panic(err)
-	}
-
-	return outBuf.String(), err
+	return out, err
 }
 
 func machineScp(m types.Machine, s, d, permissions string) error {
@@ -264,13 +320,44 @@ func machineEventuallyConnects(m types.Machine, t ...int) {
 	}, time.Duration(time.Duration(dur)*time.Second), time.Duration(5*time.Second)).Should(Equal("ping\n"))
 }
 
+func machineConsoleOutput(m types.Machine) (string, error) {
+	r, err := m.Console()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	return string(b), err
+}
+
+func machineConsoleEventuallyContains(m types.Machine, s string, t ...int) {
+	dur := 360
+	if len(t) > 0 {
+		dur = t[0]
+	}
+	Eventually(func() string {
+		out, _ := machineConsoleOutput(m)
+		return out
+	}, time.Duration(dur)*time.Second, time.Second).Should(ContainSubstring(s))
+}
+
 func machineReboot(m types.Machine, t ...int) {
-	machineSudo(m, "reboot") //nolint:errcheck
-	time.Sleep(1 * time.Minute)
 	timeout := 750
 	if len(t) != 0 {
 		timeout = t[0]
 	}
+	// Containers booting an init would just exit, they are restarted instead
+	if m.Config().Container.Init != "" {
+		Expect(m.Restart(false)).To(Succeed())
+		machineEventuallyConnects(m, timeout)
+		return
+	}
+
+	machineSudo(m, "reboot") //nolint:errcheck
+	// The shared connection won't survive the reboot
+	controller.CloseConnection(m) //nolint:errcheck
+	time.Sleep(1 * time.Minute)
 	machineEventuallyConnects(m, timeout)
 }
 
@@ -0,0 +1,53 @@
+package matcher_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/matcher"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+var _ = Describe("Helpers", func() {
+	var vm matcher.VM
+
+	BeforeEach(func() {
+		m := newMachine()
+		vm = matcher.NewVM(m, m.Config().StateDir)
+	})
+
+	It("runs commands as root, returning their output", func() {
+		out, err := vm.Sudo("echo out; echo err >&2")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal("out\nerr\n"))
+	})
+
+	It("returns the exit status of failing commands", func() {
+		out, err := vm.Sudo("echo failing; exit 3")
+		Expect(err).To(MatchError("command exited with status 3"))
+		var exitErr *types.ExitError
+		Expect(errors.As(err, &exitErr)).To(BeTrue())
+		Expect(exitErr.ExitStatus()).To(Equal(3))
+		Expect(out).To(Equal("failing\n"))
+	})
+	It("gathers logs from the machine to the logs directory", func() {
+		log := filepath.Join(GinkgoT().TempDir(), "service.log")
+		Expect(os.WriteFile(log, []byte("started\n"), 0600)).To(Succeed())
+		wd, err := os.Getwd()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.Chdir(GinkgoT().TempDir())).To(Succeed())
+		DeferCleanup(os.Chdir, wd)
+
+		vm.GatherLog(log)
+		Expect(os.ReadFile(filepath.Join("logs", "service.log"))).To(Equal([]byte("started\n")))
+	})
+	It("fails the global helpers in multi-machine specs, which have no default machine", func() {
+		Expect(matcher.Machine).To(BeNil())
+		Expect(InterceptGomegaFailure(func() {
+			_, _ = matcher.Sudo("true")
+		})).To(MatchError(ContainSubstring("multi-machine specs must pick one with matcher.Machines.VM(name)")))
+	})
+})
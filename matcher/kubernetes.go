@@ -0,0 +1,282 @@
+package matcher
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// K3sKubeconfig is where k3s writes the kubeconfig of its cluster.
+const K3sKubeconfig = "/etc/rancher/k3s/k3s.yaml"
+
+// Cluster is a kubernetes cluster running in a machine, reached through the forwarded port of its API server.
+type Cluster struct {
+	// Kubeconfig is the path on the host of the kubeconfig pointing to the forwarded port.
+	Kubeconfig string
+
+	client  kubernetes.Interface
+	dynamic dynamic.Interface
+	mapper  meta.RESTMapper
+}
+
+// NewCluster returns the cluster of a kubeconfig file on the host.
+func NewCluster(kubeconfig string) (*Cluster, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading kubeconfig: %w", err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	dyn, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return newCluster(kubeconfig, client, dyn), nil
+}
+
+func newCluster(kubeconfig string, client kubernetes.Interface, dyn dynamic.Interface) *Cluster {
+	cached := memory.NewMemCacheClient(client.Discovery())
+	mapper := restmapper.NewShortcutExpander(restmapper.NewDeferredDiscoveryRESTMapper(cached), cached, nil)
+	return &Cluster{Kubeconfig: kubeconfig, client: client, dynamic: dyn, mapper: mapper}
+}
+
+// Cluster fetches the kubeconfig at path in the VM (e.g. K3sKubeconfig) and returns its cluster,
+// reached through the host port apiPort is forwarded to.
+func (vm VM) Cluster(path string, apiPort int) (*Cluster, error) {
+	return machineCluster(vm.machine, path, apiPort)
+}
+
+// EventuallyCluster waits for the cluster of the kubeconfig at path in the VM to answer. See Cluster.
+func (vm VM) EventuallyCluster(path string, apiPort int, t ...int) *Cluster {
+	return machineEventuallyCluster(vm.machine, path, apiPort, t...)
+}
+
+// KubernetesCluster fetches the kubeconfig at path in the machine and returns its cluster. See VM.Cluster.
+func KubernetesCluster(path string, apiPort int) (*Cluster, error) {
+	return machineCluster(machine(), path, apiPort)
+}
+
+// EventuallyKubernetesCluster waits for the cluster of the kubeconfig at path in the machine to answer.
+func EventuallyKubernetesCluster(path string, apiPort int, t ...int) *Cluster {
+	return machineEventuallyCluster(machine(), path, apiPort, t...)
+}
+
+func machineCluster(m types.Machine, path string, apiPort int) (*Cluster, error) {
+	kubeconfig, err := fetchKubeconfig(m, path, apiPort)
+	if err != nil {
+		return nil, err
+	}
+	return NewCluster(kubeconfig)
+}
+
+func machineEventuallyCluster(m types.Machine, path string, apiPort int, t ...int) *Cluster {
+	var c *Cluster
+	Eventually(func() error {
+		var err error
+		if c, err = machineCluster(m, path, apiPort); err != nil {
+			return err
+		}
+		_, err = c.client.Discovery().ServerVersion()
+		return err
+	}, timeout(t), 5*time.Second).Should(Succeed())
+	return c
+}
+
+// fetchKubeconfig copies the kubeconfig at path in the machine to its state directory, pointing it to the host
+// port the API server port is forwarded to. Kubeconfigs are usually readable by root only and hold credentials,
+// the file is read with sudo rather than copied anywhere in the machine.
+func fetchKubeconfig(m types.Machine, path string, apiPort int) (string, error) {
+	hostPort, err := m.HostPort(apiPort)
+	if err != nil {
+		return "", fmt.Errorf("the API server port must be forwarded: %w", err)
+	}
+
+	res, err := m.Run(context.Background(), "sudo /bin/sh", types.WithStdin(strings.NewReader("cat "+types.ShellQuote(path))))
+	if err != nil {
+		return "", fmt.Errorf("failed reading kubeconfig %s: %w", path, err)
+	}
+	if !res.Success() {
+		return "", fmt.Errorf("failed reading kubeconfig %s: %s", path, res)
+	}
+
+	config, err := clientcmd.Load([]byte(res.Stdout))
+	if err != nil {
+		return "", fmt.Errorf("failed loading kubeconfig: %w", err)
+	}
+	for name, cluster := range config.Clusters {
+		u, err := url.Parse(cluster.Server)
+		if err != nil {
+			return "", fmt.Errorf("invalid server of cluster %s: %w", name, err)
+		}
+		if u.Port() != strconv.Itoa(apiPort) {
+			continue
+		}
+		// The certificate is still checked against the name the server is known with in the guest
+		if cluster.TLSServerName == "" {
+			cluster.TLSServerName = u.Hostname()
+		}
+		u.Host = net.JoinHostPort("127.0.0.1", strconv.Itoa(hostPort))
+		cluster.Server = u.String()
+	}
+	dst := filepath.Join(m.Config().StateDir, "kubeconfig")
+	if err := clientcmd.WriteToFile(*config, dst); err != nil {
+		return "", fmt.Errorf("failed writing kubeconfig: %w", err)
+	}
+	return dst, os.Chmod(dst, 0600)
+}
+
+// NodesReady returns an error unless the cluster has nodes, all of them ready.
+func (c *Cluster) NodesReady(ctx context.Context) error {
+	nodes, err := c.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	if len(nodes.Items) == 0 {
+		return fmt.Errorf("the cluster has no nodes")
+	}
+
+	notReady := []string{}
+	for _, n := range nodes.Items {
+		ready := false
+		for _, cond := range n.Status.Conditions {
+			if cond.Type == corev1.NodeReady && cond.Status == corev1.ConditionTrue {
+				ready = true
+			}
+		}
+		if !ready {
+			notReady = append(notReady, n.Name)
+		}
+	}
+	if len(notReady) != 0 {
+		return fmt.Errorf("nodes not ready: %s", strings.Join(notReady, ", "))
+	}
+	return nil
+}
+
+// PodsInPhase returns an error unless pods match the label selector in namespace, all of them in phase.
+func (c *Cluster) PodsInPhase(ctx context.Context, namespace, selector string, phase corev1.PodPhase) error {
+	pods, err := c.client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return err
+	}
+	if len(pods.Items) == 0 {
+		return fmt.Errorf("no pods matching '%s' in namespace %s", selector, namespace)
+	}
+
+	others := []string{}
+	for _, p := range pods.Items {
+		if p.Status.Phase != phase {
+			others = append(others, fmt.Sprintf("%s (%s)", p.Name, p.Status.Phase))
+		}
+	}
+	if len(others) != 0 {
+		return fmt.Errorf("pods not %s: %s", phase, strings.Join(others, ", "))
+	}
+	return nil
+}
+
+// ResourceExists returns an error unless the named resource exists. The resource type is given like to kubectl,
+// e.g. "deployment", "deploy" or "certificates.cert-manager.io". The namespace is ignored for cluster-wide resources.
+func (c *Cluster) ResourceExists(ctx context.Context, resource, namespace, name string) error {
+	err := c.get(ctx, resource, namespace, name)
+	if apierrors.IsNotFound(err) {
+		return fmt.Errorf("%s %s not found", resource, name)
+	}
+	return err
+}
+
+// ResourceAbsent returns an error if the named resource exists. See ResourceExists.
+func (c *Cluster) ResourceAbsent(ctx context.Context, resource, namespace, name string) error {
+	err := c.get(ctx, resource, namespace, name)
+	if err == nil {
+		return fmt.Errorf("%s %s exists", resource, name)
+	}
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (c *Cluster) get(ctx context.Context, resource, namespace, name string) error {
+	gvr, namespaced, err := c.resource(resource)
+	if err != nil {
+		return err
+	}
+
+	var r dynamic.ResourceInterface = c.dynamic.Resource(gvr)
+	if namespaced {
+		r = c.dynamic.Resource(gvr).Namespace(namespace)
+	}
+	_, err = r.Get(ctx, name, metav1.GetOptions{})
+	return err
+}
+
+// resource maps a resource type given like to kubectl to its group, version and resource, and tells if it is namespaced.
+func (c *Cluster) resource(resource string) (schema.GroupVersionResource, bool, error) {
+	// unknown types are discovered again, they may have been added since
+	gvr, err := c.mapper.ResourceFor(schema.ParseGroupResource(resource).WithVersion(""))
+	if err != nil {
+		return gvr, false, fmt.Errorf("unknown resource type %s: %w", resource, err)
+	}
+	gvk, err := c.mapper.KindFor(gvr)
+	if err != nil {
+		return gvr, false, err
+	}
+	mapping, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return gvr, false, err
+	}
+	return gvr, mapping.Scope.Name() == meta.RESTScopeNameNamespace, nil
+}
+
+// NodesEventuallyReady waits for every node of the cluster to be ready.
+func (c *Cluster) NodesEventuallyReady(t ...int) {
+	Eventually(func() error {
+		return c.NodesReady(context.Background())
+	}, timeout(t), 5*time.Second).Should(Succeed())
+}
+
+// PodsEventuallyInPhase waits for the pods matching selector in namespace to be in phase, e.g. corev1.PodRunning.
+func (c *Cluster) PodsEventuallyInPhase(namespace, selector string, phase corev1.PodPhase, t ...int) {
+	Eventually(func() error {
+		return c.PodsInPhase(context.Background(), namespace, selector, phase)
+	}, timeout(t), 5*time.Second).Should(Succeed())
+}
+
+// ResourceEventuallyExists waits for the named resource to exist. See ResourceExists.
+func (c *Cluster) ResourceEventuallyExists(resource, namespace, name string, t ...int) {
+	Eventually(func() error {
+		return c.ResourceExists(context.Background(), resource, namespace, name)
+	}, timeout(t), 5*time.Second).Should(Succeed())
+}
+
+// timeout is the timeout in seconds given to an Eventually helper, 360 by default.
+func timeout(t []int) time.Duration {
+	dur := 360
+	if len(t) > 0 {
+		dur = t[0]
+	}
+	return time.Duration(dur) * time.Second
+}
@@ -0,0 +1,119 @@
+package matcher_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/matcher"
+	"github.com/spectrocloud/peg/pkg/machine/conformance/fakes"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func pod(name string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "web"}},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+}
+
+var _ = Describe("Kubernetes clusters", func() {
+	var kube *fakes.KubeAPIServer
+	var vm matcher.VM
+	var kubeconfig string
+	ctx := context.Background()
+
+	BeforeEach(func() {
+		kube, kubeconfig = serveCluster(6443)
+		m := newClusterMachine(kube, 6443)
+		vm = matcher.NewVM(m, m.Config().StateDir)
+	})
+
+	It("fetches the kubeconfig pointing to the forwarded API server port", func() {
+		c, err := vm.Cluster(kubeconfig, 6443)
+		Expect(err).ToNot(HaveOccurred())
+
+		info, err := os.Stat(c.Kubeconfig)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		config, err := os.ReadFile(c.Kubeconfig)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(config)).To(ContainSubstring("server: " + kube.URL()))
+		Expect(string(config)).To(ContainSubstring("tls-server-name: 127.0.0.1"))
+	})
+
+	It("fetches kubeconfigs at paths holding shell metacharacters", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "my cluster;$(touch pwned)", "k3s.yaml")
+		Expect(os.MkdirAll(filepath.Dir(path), 0700)).To(Succeed())
+		data, err := os.ReadFile(kubeconfig)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(path, data, 0600)).To(Succeed())
+
+		_, err = vm.Cluster(path, 6443)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("fails when the API server port is not forwarded", func() {
+		_, err := vm.Cluster(kubeconfig, 8443)
+		Expect(err).To(MatchError(ContainSubstring("the API server port must be forwarded")))
+	})
+
+	It("fails when the kubeconfig can't be read", func() {
+		_, err := vm.Cluster("/missing/k3s.yaml", 6443)
+		Expect(err).To(MatchError(ContainSubstring("failed reading kubeconfig /missing/k3s.yaml")))
+	})
+
+	Context("once fetched", func() {
+		var c *matcher.Cluster
+
+		BeforeEach(func() {
+			c = vm.EventuallyCluster(kubeconfig, 6443, 10)
+		})
+
+		It("checks the nodes are ready", func() {
+			Expect(c.NodesReady(ctx)).To(MatchError("the cluster has no nodes"))
+			kube.AddNode("server", true)
+			Expect(c.NodesReady(ctx)).To(Succeed())
+			kube.AddNode("agent", false)
+			Expect(c.NodesReady(ctx)).To(MatchError("nodes not ready: agent"))
+		})
+
+		It("checks the phase of the pods matching a selector", func() {
+			Expect(c.PodsInPhase(ctx, "default", "app=web", corev1.PodRunning)).To(MatchError("no pods matching 'app=web' in namespace default"))
+			kube.AddPod(pod("web-1", corev1.PodRunning))
+			Expect(c.PodsInPhase(ctx, "default", "app=web", corev1.PodRunning)).To(Succeed())
+			Expect(c.PodsInPhase(ctx, "other", "app=web", corev1.PodRunning)).ToNot(Succeed())
+			Expect(c.PodsInPhase(ctx, "default", "app=db", corev1.PodRunning)).ToNot(Succeed())
+
+			kube.AddPod(pod("web-2", corev1.PodPending))
+			Expect(c.PodsInPhase(ctx, "default", "app=web", corev1.PodRunning)).To(MatchError("pods not Running: web-2 (Pending)"))
+		})
+
+		It("checks resources exist, given like to kubectl", func() {
+			Expect(kube.AddResource("deployments", "kube-system", "coredns")).To(Succeed())
+			Expect(kube.AddResource("configmaps", "default", "settings")).To(Succeed())
+			kube.AddNode("server", true)
+
+			for _, kind := range []string{"deployment", "deployments", "deploy", "deployments.apps"} {
+				Expect(c.ResourceExists(ctx, kind, "kube-system", "coredns")).To(Succeed(), kind)
+			}
+			Expect(c.ResourceExists(ctx, "cm", "default", "settings")).To(Succeed())
+			// the namespace of cluster-wide resources is ignored
+			Expect(c.ResourceExists(ctx, "node", "default", "server")).To(Succeed())
+
+			Expect(c.ResourceExists(ctx, "deployment", "default", "coredns")).To(MatchError("deployment coredns not found"))
+			Expect(c.ResourceAbsent(ctx, "deployment", "default", "coredns")).To(Succeed())
+			Expect(c.ResourceAbsent(ctx, "deployment", "kube-system", "coredns")).To(MatchError("deployment coredns exists"))
+		})
+
+		It("fails on unknown resource types", func() {
+			err := c.ResourceExists(ctx, "certificates.cert-manager.io", "default", "tls")
+			Expect(err).To(MatchError(ContainSubstring("unknown resource type certificates.cert-manager.io")))
+			Expect(strings.Contains(err.Error(), "not found")).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,92 @@
+package matcher
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/ginkgo/v2" //nolint:revive
+)
+
+// AllMachines targets every machine of the registry.
+const AllMachines = "all"
+
+// MachineRegistry holds the named machines of a multi-machine topology, in boot order.
+type MachineRegistry struct {
+	sync.RWMutex
+
+	names    []string
+	machines map[string]types.Machine
+}
+
+// Machines is the registry of the machines under test.
+var Machines = &MachineRegistry{}
+
+// Add registers m under name. Machines are listed in the order they are added.
+func (r *MachineRegistry) Add(name string, m types.Machine) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.machines == nil {
+		r.machines = map[string]types.Machine{}
+	}
+	if _, ok := r.machines[name]; !ok {
+		r.names = append(r.names, name)
+	}
+	r.machines[name] = m
+}
+
+// Get returns the machine registered as name.
+func (r *MachineRegistry) Get(name string) (types.Machine, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	m, ok := r.machines[name]
+	if !ok {
+		return nil, fmt.Errorf("no machine named '%s', known machines: %v", name, r.names)
+	}
+	return m, nil
+}
+
+// VM returns the machine registered as name wrapped in a VM, for the helpers. It fails the test if there is none.
+func (r *MachineRegistry) VM(name string) VM {
+	m, err := r.Get(name)
+	if err != nil {
+		Fail(err.Error())
+	}
+	return NewVM(m, m.Config().StateDir)
+}
+
+// Names returns the names of the registered machines, in boot order.
+func (r *MachineRegistry) Names() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	return append([]string{}, r.names...)
+}
+
+// Select returns the names of the machines matching target, a machine name or AllMachines, in boot order.
+func (r *MachineRegistry) Select(target string) ([]string, error) {
+	if target == AllMachines {
+		return r.Names(), nil
+	}
+	if _, err := r.Get(target); err != nil {
+		return nil, err
+	}
+	return []string{target}, nil
+}
+
+// Each calls f for every registered machine, in boot order.
+func (r *MachineRegistry) Each(f func(name string, m types.Machine) error) error {
+	for _, n := range r.Names() {
+		m, err := r.Get(n)
+		if err != nil {
+			return err
+		}
+		if err := f(n, m); err != nil {
+			return fmt.Errorf("machine '%s': %w", n, err)
+		}
+	}
+	return nil
+}
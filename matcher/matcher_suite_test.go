@@ -0,0 +1,101 @@
+package matcher_test
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/pkg/machine"
+	"github.com/spectrocloud/peg/pkg/machine/conformance/fakes"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// fake are the fake guests the specs run commands on.
+var fake *fakes.Fakes
+
+// dockerHost is the endpoint of the fake docker API server the machines run in.
+var dockerHost string
+
+var _ = BeforeSuite(func() {
+	var err error
+	fake, err = fakes.Install(GinkgoT().TempDir())
+	Expect(err).ToNot(HaveOccurred())
+
+	dockerAPI, err := fake.ServeDocker("docker")
+	Expect(err).ToNot(HaveOccurred())
+	DeferCleanup(dockerAPI.Close)
+	dockerHost = dockerAPI.Host()
+})
+
+// serveCluster serves a fake kubernetes API server, and writes a kubeconfig of a cluster listening on apiPort
+// in the fake guests, as k3s does.
+func serveCluster(apiPort int) (*fakes.KubeAPIServer, string) {
+	kube, err := fake.ServeKubernetes()
+	Expect(err).ToNot(HaveOccurred())
+	DeferCleanup(kube.Close)
+
+	kubeconfig := filepath.Join(GinkgoT().TempDir(), "k3s.yaml")
+	Expect(os.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: default
+  cluster:
+    server: http://127.0.0.1:`+strconv.Itoa(apiPort)+`
+users:
+- name: default
+  user:
+    token: peg
+contexts:
+- name: default
+  context:
+    cluster: default
+    user: default
+current-context: default
+`), 0600)).To(Succeed())
+	return kube, kubeconfig
+}
+
+// newMachine returns a running docker machine with opts applied.
+func newMachine(opts ...types.MachineOption) types.Machine {
+	opts = append([]types.MachineOption{
+		types.DockerEngine,
+		types.WithContainerHost(dockerHost),
+		types.WithImage("alpine"),
+		types.WithStateDir(GinkgoT().TempDir()),
+	}, opts...)
+	m, err := machine.New(opts...)
+	Expect(err).ToNot(HaveOccurred())
+	_, err = m.Create(context.Background())
+	Expect(err).ToNot(HaveOccurred())
+	DeferCleanup(m.Clean)
+	return m
+}
+
+// newClusterMachine returns a running machine with apiPort forwarded to the fake API server.
+func newClusterMachine(kube *fakes.KubeAPIServer, apiPort int) types.Machine {
+	u, err := url.Parse(kube.URL())
+	Expect(err).ToNot(HaveOccurred())
+	hostPort, err := strconv.Atoi(u.Port())
+	Expect(err).ToNot(HaveOccurred())
+
+	return newMachine(func(mc *types.MachineConfig) error {
+		mc.Ports = append(mc.Ports, types.Port{Guest: apiPort, Host: hostPort})
+		return nil
+	})
+}
+
+func TestMain(m *testing.M) {
+	// The test binary is the fake executables as well
+	fakes.Run()
+	os.Exit(m.Run())
+}
+
+func TestMatcher(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Matcher Suite")
+}
@@ -1,7 +1,12 @@
 package peg
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	logging "github.com/ipfs/go-log"
 
@@ -11,7 +16,9 @@ import (
 
 type Config struct {
 	Machine *types.MachineConfig `yaml:"machine,omitempty"`
-	Clean   bool
+	// Machines are the named machines of a multi-machine topology. When set, Machine is ignored.
+	Machines map[string]*MachineSpec `yaml:"machines,omitempty"`
+	Clean    bool
 
 	Tests []Test `yaml:"specs,omitempty"`
 }
@@ -19,17 +26,46 @@ type Config struct {
 type Test struct {
 	Label    string `yaml:"label,omitempty"`
 	Describe string `yaml:"describe,omitempty"`
+	// RestoreSnapshot brings the machine back to the named snapshot before each spec.
+	// The snapshot is taken before the first spec if it doesn't exist yet.
+	RestoreSnapshot string `yaml:"restoreSnapshot,omitempty"`
 
 	Assertion map[string][]AssertionBlock `yaml:"assertions,omitempty"`
 }
 
+// MachineSpec is a machine of a multi-machine topology.
+type MachineSpec struct {
+	types.MachineConfig `yaml:",inline"`
+	// DependsOn are the machines to boot, and wait for, before this one.
+	DependsOn []string `yaml:"dependsOn,omitempty"`
+}
+
+// UnmarshalYAML fills the machine over the default configuration, like the single machine of a spec.
+func (s *MachineSpec) UnmarshalYAML(n *yaml.Node) error {
+	type plain MachineSpec
+	p := plain{MachineConfig: *types.DefaultMachineConfig()}
+	if err := n.Decode(&p); err != nil {
+		return err
+	}
+	*s = MachineSpec(p)
+	return nil
+}
+
 type AssertionBlock struct {
-	Describe string      `yaml:"describe,omitempty"`
-	Command  string      `yaml:"command,omitempty"`
-	Expect   ExpectBlock `yaml:"expect,omitempty"`
-	PreOps   []OpBlock   `yaml:"preOps,omitempty"`
-	PostOps  []OpBlock   `yaml:"postOps,omitempty"`
-	OnHost   bool        `yaml:"onHost,omitempty"`
+	Describe string `yaml:"describe,omitempty"`
+	// Machine is the name of the machine to run the assertion on, or "all". It can be omitted with a single machine.
+	Machine string      `yaml:"machine,omitempty"`
+	Command string      `yaml:"command,omitempty"`
+	Expect  ExpectBlock `yaml:"expect,omitempty"`
+	PreOps  []OpBlock   `yaml:"preOps,omitempty"`
+	PostOps []OpBlock   `yaml:"postOps,omitempty"`
+	OnHost  bool        `yaml:"onHost,omitempty"`
+	// Timeout bounds the whole assertion, including pre and post operations (e.g. "5m").
+	Timeout string `yaml:"timeout,omitempty"`
+	// Stream writes the command output to the ginkgo writer while it runs.
+	Stream bool `yaml:"stream,omitempty"`
+	// LogFile is a file on the host where the command output is written while it runs. Implies Stream.
+	LogFile string `yaml:"logFile,omitempty"`
 }
 
 type ExpectBlock struct {
@@ -39,12 +75,83 @@ type ExpectBlock struct {
 	And              []ExpectBlock `yaml:"and,omitempty"`
 	ToFail           bool          `yaml:"toFail,omitempty"`
 	Not              bool          `yaml:"not,omitempty"`
+	// Kubernetes asserts on the cluster running in the machine. The command can then be omitted.
+	Kubernetes *KubernetesExpect `yaml:"kubernetes,omitempty"`
+}
+
+// KubernetesExpect asserts on the kubernetes cluster running in the machine, polling until every assertion holds.
+// The cluster is reached with the kubeconfig of the machine, through the forwarded port of the API server.
+type KubernetesExpect struct {
+	// Kubeconfig is the path of the kubeconfig in the machine. Defaults to the k3s one.
+	Kubeconfig string `yaml:"kubeconfig,omitempty"`
+	// APIPort is the port of the API server in the machine, which must be in the forwarded ports. Defaults to 6443.
+	APIPort int `yaml:"apiPort,omitempty"`
+	// Timeout bounds the polling (e.g. "10m"). Defaults to 6m.
+	Timeout string `yaml:"timeout,omitempty"`
+
+	NodesReady bool             `yaml:"nodesReady,omitempty"`
+	Pods       []PodsExpect     `yaml:"pods,omitempty"`
+	Resources  []ResourceExpect `yaml:"resources,omitempty"`
+}
+
+// PodsExpect expects the pods matching a label selector to exist, all of them in the same phase.
+type PodsExpect struct {
+	// Namespace defaults to "default".
+	Namespace string `yaml:"namespace,omitempty"`
+	Selector  string `yaml:"selector,omitempty"`
+	// Phase defaults to "Running".
+	Phase string `yaml:"phase,omitempty"`
+}
+
+// ResourceExpect expects a resource to exist, or not.
+type ResourceExpect struct {
+	// Kind is the type of the resource, as given to kubectl (e.g. "deployment", "deploy" or "certificates.cert-manager.io").
+	Kind string `yaml:"kind,omitempty"`
+	Name string `yaml:"name,omitempty"`
+	// Namespace defaults to "default", and is ignored for cluster-wide resources.
+	Namespace string `yaml:"namespace,omitempty"`
+	Absent    bool   `yaml:"absent,omitempty"`
 }
 
 type OpBlock struct {
 	EventuallyConnect int               `yaml:"eventuallyConnects,omitempty"`
 	SendFile          map[string]string `yaml:"sendFile,omitempty"`
 	ReceiveFile       map[string]string `yaml:"receiveFile,omitempty"`
+	Interactive       *InteractiveBlock `yaml:"interactive,omitempty"`
+	ConsoleContains   *ConsoleBlock     `yaml:"eventuallyConsoleContains,omitempty"`
+	// SendKeys presses key combinations in QEMU sendkey syntax (e.g. "ctrl-alt-delete").
+	SendKeys []string `yaml:"sendKeys,omitempty"`
+	TypeText string   `yaml:"typeText,omitempty"`
+	// Snapshot saves the machine state with the given name.
+	Snapshot        string `yaml:"snapshot,omitempty"`
+	RestoreSnapshot string `yaml:"restoreSnapshot,omitempty"`
+	// Link plugs ("up") or unplugs ("down") the network cables of the machine, only
+	// the ones of LinkNetworks if set.
+	Link              string                   `yaml:"link,omitempty"`
+	LinkNetworks      []string                 `yaml:"linkNetworks,omitempty"`
+	NetworkConditions *types.NetworkConditions `yaml:"networkConditions,omitempty"`
+}
+
+// ConsoleBlock waits for Text to show up in the machine console.
+type ConsoleBlock struct {
+	Text string `yaml:"text,omitempty"`
+	// Timeout in seconds. Defaults to 360.
+	Timeout int `yaml:"timeout,omitempty"`
+}
+
+// InteractiveBlock runs a command in a pseudo terminal and drives it with expect/send steps.
+type InteractiveBlock struct {
+	Command string `yaml:"command,omitempty"`
+	// Timeout is the default timeout of the expect steps. Defaults to 1m.
+	Timeout string            `yaml:"timeout,omitempty"`
+	Steps   []InteractiveStep `yaml:"steps,omitempty"`
+}
+
+// InteractiveStep either waits for the output to match the Expect regular expression, or types Send.
+type InteractiveStep struct {
+	Expect  string `yaml:"expect,omitempty"`
+	Send    string `yaml:"send,omitempty"`
+	Timeout string `yaml:"timeout,omitempty"`
 }
 
 func (exp ExpectBlock) hasOrConditions() bool {
@@ -95,6 +202,19 @@ func (exp ExpectBlock) Show(logger logging.StandardLogger) {
 			showAnd()
 		}
 	}
+
+	if k := exp.Kubernetes; k != nil {
+		logger.Infof("~> Kubernetes(kubeconfig: %s, apiPort: %d, timeout: %s)", k.Kubeconfig, k.APIPort, k.Timeout)
+		if k.NodesReady {
+			logger.Info("~~> NodesReady")
+		}
+		for _, p := range k.Pods {
+			logger.Infof("~~> Pods(%s, %s) %s", p.Namespace, p.Selector, p.Phase)
+		}
+		for _, r := range k.Resources {
+			logger.Infof("~~> Resource(%s %s/%s, absent: %t)", r.Kind, r.Namespace, r.Name, r.Absent)
+		}
+	}
 }
 
 func (op OpBlock) Show(logger logging.StandardLogger) {
@@ -107,10 +227,42 @@ func (op OpBlock) Show(logger logging.StandardLogger) {
 	if len(op.ReceiveFile) > 0 {
 		logger.Infof("_ ReceiveFile(src: %s, dst: %s)", op.ReceiveFile["src"], op.ReceiveFile["dst"])
 	}
+	if op.ConsoleContains != nil {
+		logger.Infof("_ EventuallyConsoleContains(%s, %d)", op.ConsoleContains.Text, op.ConsoleContains.Timeout)
+	}
+	if len(op.SendKeys) > 0 {
+		logger.Infof("_ SendKeys(%s)", strings.Join(op.SendKeys, ", "))
+	}
+	if op.TypeText != "" {
+		logger.Infof("_ TypeText(%q)", op.TypeText)
+	}
+	if op.Snapshot != "" {
+		logger.Infof("_ Snapshot(%s)", op.Snapshot)
+	}
+	if op.RestoreSnapshot != "" {
+		logger.Infof("_ RestoreSnapshot(%s)", op.RestoreSnapshot)
+	}
+	if op.Link != "" {
+		logger.Infof("_ Link(%s, %s)", op.Link, strings.Join(op.LinkNetworks, ", "))
+	}
+	if op.NetworkConditions != nil {
+		logger.Infof("_ NetworkConditions(%+v)", *op.NetworkConditions)
+	}
+	if op.Interactive != nil {
+		logger.Infof("_ Interactive(%s)", op.Interactive.Command)
+		for _, s := range op.Interactive.Steps {
+			if s.Expect != "" {
+				logger.Infof("__ Expect(%s)", s.Expect)
+			}
+			if s.Send != "" {
+				logger.Infof("__ Send(%q)", s.Send)
+			}
+		}
+	}
 }
 
 func (a AssertionBlock) Show(logger logging.StandardLogger) {
-	logger.Infof("==> Assertion '%s' [ onhost: %t ]", a.Describe, a.OnHost)
+	logger.Infof("==> Assertion '%s' [ machine: %s, onhost: %t, timeout: %s, stream: %t ]", a.Describe, a.Machine, a.OnHost, a.Timeout, a.Stream || a.LogFile != "")
 	logger.Infof("== Pre operations")
 	for _, op := range a.PreOps {
 		op.Show(logger)
@@ -167,3 +319,63 @@ func FromData(data []byte) types.MachineOption {
 		return nil
 	}
 }
+
+// BootOrder returns the names of the machines sorted so that every machine comes after its dependencies.
+func (c *Config) BootOrder() ([]string, error) {
+	names := []string{}
+	for n := range c.Machines {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	order := []string{}
+	state := map[string]int{} // 1: visiting, 2: done
+	var visit func(n string, path []string) error
+	visit = func(n string, path []string) error {
+		spec, ok := c.Machines[n]
+		if !ok {
+			return fmt.Errorf("machine '%s' depends on unknown machine '%s'", path[len(path)-1], n)
+		}
+		switch state[n] {
+		case 1:
+			return fmt.Errorf("dependency cycle between machines: %s", strings.Join(append(path, n), " -> "))
+		case 2:
+			return nil
+		}
+		state[n] = 1
+		for _, d := range spec.DependsOn {
+			if err := visit(d, append(path, n)); err != nil {
+				return err
+			}
+		}
+		state[n] = 2
+		order = append(order, n)
+		return nil
+	}
+
+	for _, n := range names {
+		if err := visit(n, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// FromMachineSpec populates a machineconfig from a machine of a multi-machine topology.
+func FromMachineSpec(s *MachineSpec) types.MachineOption {
+	return func(mc *types.MachineConfig) error {
+		*(mc) = s.MachineConfig
+		return nil
+	}
+}
+
+// machineStateDir moves the state directory of a named machine below the shared one, if any.
+func machineStateDir(name string) types.MachineOption {
+	return func(mc *types.MachineConfig) error {
+		if mc.StateDir == "" {
+			return nil
+		}
+		mc.StateDir = filepath.Join(mc.StateDir, name)
+		return os.MkdirAll(mc.StateDir, os.ModePerm)
+	}
+}
@@ -0,0 +1,73 @@
+package peg_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/peg"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	"gopkg.in/yaml.v3"
+)
+
+func parseConfig(data string) *peg.Config {
+	c := &peg.Config{}
+	Expect(yaml.Unmarshal([]byte(data), c)).To(Succeed())
+	return c
+}
+
+var _ = Describe("Config", func() {
+	It("reads the number of CPUs and the CPU model from different keys", func() {
+		mc := &types.MachineConfig{}
+		Expect(peg.FromData([]byte("machine:\n  cpu: \"4\"\n  cpuType: host\n"))(mc)).To(Succeed())
+		Expect(mc.CPU).To(Equal("4"))
+		Expect(mc.CPUType).To(Equal("host"))
+	})
+
+	Context("boot order", func() {
+		It("boots every machine after its dependencies", func() {
+			c := parseConfig(`
+machines:
+  agent:
+    dependsOn: ["server", "storage"]
+  server:
+    dependsOn: ["storage"]
+  storage: {}
+  standalone: {}
+`)
+			order, err := c.BootOrder()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(order).To(Equal([]string{"storage", "server", "agent", "standalone"}))
+		})
+
+		It("fills the machines over the default configuration", func() {
+			c := parseConfig("machines:\n  server:\n    dependsOn: [\"db\"]\n  db: {}\n")
+			Expect(c.Machines["server"].Memory).To(Equal(types.DefaultMachineConfig().Memory))
+			Expect(c.Machines["server"].DependsOn).To(Equal([]string{"db"}))
+		})
+
+		It("fails on dependency cycles", func() {
+			c := parseConfig(`
+machines:
+  a:
+    dependsOn: ["b"]
+  b:
+    dependsOn: ["c"]
+  c:
+    dependsOn: ["a"]
+`)
+			_, err := c.BootOrder()
+			Expect(err).To(MatchError("dependency cycle between machines: a -> b -> c -> a"))
+		})
+
+		It("fails on machines depending on themselves", func() {
+			c := parseConfig("machines:\n  a:\n    dependsOn: [\"a\"]\n")
+			_, err := c.BootOrder()
+			Expect(err).To(MatchError("dependency cycle between machines: a -> a"))
+		})
+
+		It("fails on unknown dependencies", func() {
+			c := parseConfig("machines:\n  a:\n    dependsOn: [\"missing\"]\n")
+			_, err := c.BootOrder()
+			Expect(err).To(MatchError("machine 'a' depends on unknown machine 'missing'"))
+		})
+	})
+})
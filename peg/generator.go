@@ -1,48 +1,205 @@
 package peg
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"regexp"
 	"sync"
+	"time"
 
 	logging "github.com/ipfs/go-log"
 	. "github.com/onsi/ginkgo/v2" //nolint:revive
 	. "github.com/onsi/gomega"    //nolint:revive
 	"github.com/spectrocloud/peg/internal/utils"
+	"github.com/spectrocloud/peg/pkg/controller"
+	"github.com/spectrocloud/peg/pkg/machine/types"
 
 	"github.com/spectrocloud/peg/matcher"
 )
 
-func runOp(op OpBlock) {
+func runOp(ctx context.Context, m types.Machine, op OpBlock) {
+	vm := matcher.NewVM(m, m.Config().StateDir)
 	if op.EventuallyConnect != 0 {
 		log.Infof("Running EventuallyConnect(%d)", op.EventuallyConnect)
-		matcher.EventuallyConnects(op.EventuallyConnect)
+		vm.EventuallyConnects(op.EventuallyConnect)
 	}
 	if len(op.SendFile) > 0 {
 		log.Infof("Running SendFile(%+v)", op.SendFile)
-		err := matcher.Machine.SendFile(op.SendFile["src"], op.SendFile["dst"], op.SendFile["permission"])
+		err := m.SendFileContext(ctx, op.SendFile["src"], op.SendFile["dst"], op.SendFile["permission"])
 		Expect(err).ToNot(HaveOccurred())
 	}
 	if len(op.ReceiveFile) > 0 {
 		log.Infof("Running ReceiveFile(%+v)", op.ReceiveFile)
-		err := matcher.Machine.ReceiveFile(op.ReceiveFile["src"], op.ReceiveFile["dst"])
+		err := m.ReceiveFileContext(ctx, op.ReceiveFile["src"], op.ReceiveFile["dst"])
 		Expect(err).ToNot(HaveOccurred())
 	}
+	if op.ConsoleContains != nil {
+		log.Infof("Running EventuallyConsoleContains(%+v)", *op.ConsoleContains)
+		if op.ConsoleContains.Timeout != 0 {
+			vm.ConsoleEventuallyContains(op.ConsoleContains.Text, op.ConsoleContains.Timeout)
+		} else {
+			vm.ConsoleEventuallyContains(op.ConsoleContains.Text)
+		}
+	}
+	if len(op.SendKeys) > 0 {
+		log.Infof("Running SendKeys(%+v)", op.SendKeys)
+		Expect(vm.SendKeys(op.SendKeys...)).To(Succeed())
+	}
+	if op.TypeText != "" {
+		log.Infof("Running TypeText(%q)", op.TypeText)
+		Expect(vm.TypeText(op.TypeText)).To(Succeed())
+	}
+	if op.Snapshot != "" {
+		log.Infof("Running Snapshot(%s)", op.Snapshot)
+		Expect(m.Snapshot(op.Snapshot)).To(Succeed())
+	}
+	if op.RestoreSnapshot != "" {
+		log.Infof("Running RestoreSnapshot(%s)", op.RestoreSnapshot)
+		Expect(m.Restore(op.RestoreSnapshot)).To(Succeed())
+	}
+	if op.Link != "" {
+		log.Infof("Running Link(%s, %v)", op.Link, op.LinkNetworks)
+		if op.Link != "up" && op.Link != "down" {
+			Fail(fmt.Sprintf("invalid link state '%s', expected up or down", op.Link))
+		}
+		Expect(m.SetLinkUp(op.Link == "up", op.LinkNetworks...)).To(Succeed())
+	}
+	if op.NetworkConditions != nil {
+		log.Infof("Running NetworkConditions(%+v)", *op.NetworkConditions)
+		Expect(m.SetNetworkConditions(*op.NetworkConditions)).To(Succeed())
+	}
+	if op.Interactive != nil {
+		log.Infof("Running Interactive(%s)", op.Interactive.Command)
+		runInteractive(vm, *op.Interactive)
+	}
+}
+
+func runInteractive(vm matcher.VM, i InteractiveBlock) {
+	timeout := time.Minute
+	if i.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(i.Timeout)
+		Expect(err).ToNot(HaveOccurred(), "invalid timeout")
+	}
+
+	session, err := vm.Interactive(i.Command)
+	Expect(err).ToNot(HaveOccurred())
+	defer session.Close()
+
+	for _, s := range i.Steps {
+		if s.Expect != "" {
+			re, err := regexp.Compile(s.Expect)
+			Expect(err).ToNot(HaveOccurred(), "invalid expect expression")
+
+			t := timeout
+			if s.Timeout != "" {
+				t, err = time.ParseDuration(s.Timeout)
+				Expect(err).ToNot(HaveOccurred(), "invalid timeout")
+			}
+			_, err = session.Expect(re, t)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		if s.Send != "" {
+			Expect(session.Send(s.Send)).To(Succeed())
+		}
+	}
+}
+
+func runCommand(ctx context.Context, m types.Machine, a AssertionBlock) (string, error) {
+	if !a.Stream && a.LogFile == "" {
+		if a.OnHost {
+			return utils.SHContext(ctx, a.Command)
+		}
+		return m.CommandContext(ctx, a.Command)
+	}
+
+	// Collect the interleaved output for the expectations, and tee it as it comes
+	out := &bytes.Buffer{}
+	writers := []io.Writer{out, GinkgoWriter}
+	if a.LogFile != "" {
+		f, err := os.Create(a.LogFile)
+		if err != nil {
+			return "", fmt.Errorf("failed creating log file: %w", err)
+		}
+		defer f.Close()
+		writers = append(writers, f)
+	}
+	w := io.MultiWriter(writers...)
+
+	if a.OnHost {
+		lock := &sync.Mutex{}
+		stdout := controller.NewLineWriter(w, lock, "")
+		stderr := controller.NewLineWriter(w, lock, "")
+		err := utils.SHStream(ctx, a.Command, stdout, stderr)
+		_ = stdout.Flush()
+		_ = stderr.Flush()
+		return out.String(), err
+	}
+
+	res, err := controller.Stream(ctx, m, a.Command, w)
+	if err == nil && !res.Success() {
+		err = &types.ExitError{CommandResult: res}
+	}
+	return out.String(), err
+}
+
+// targets returns the names of the machines the assertion runs on.
+// The machine can be omitted only when there is a single one.
+func targets(a AssertionBlock) ([]string, error) {
+	if a.Machine != "" {
+		return matcher.Machines.Select(a.Machine)
+	}
+	names := matcher.Machines.Names()
+	if len(names) != 1 {
+		return nil, fmt.Errorf("assertion '%s' must set the machine to run on, one of %v or '%s'", a.Describe, names, matcher.AllMachines)
+	}
+	return names, nil
 }
 
 func runAssertion(a AssertionBlock) {
+	names, err := targets(a)
+	Expect(err).ToNot(HaveOccurred())
+
+	for _, n := range names {
+		m, err := matcher.Machines.Get(n)
+		Expect(err).ToNot(HaveOccurred())
+		if len(names) > 1 {
+			By(fmt.Sprintf("running on machine %s", n))
+		}
+		runAssertionOn(m, a)
+	}
+}
+
+func runAssertionOn(m types.Machine, a AssertionBlock) {
+	ctx := context.Background()
+	if a.Timeout != "" {
+		timeout, err := time.ParseDuration(a.Timeout)
+		Expect(err).ToNot(HaveOccurred(), "invalid timeout")
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	// Run pre Ops
 	for _, o := range a.PreOps {
-		runOp(o)
+		runOp(ctx, m, o)
 	}
 
+	// Cluster assertions don't need a command
 	var out string
 	var err error
+	if a.Command != "" || a.Expect.Kubernetes == nil {
+		out, err = runCommand(ctx, m, a)
+	}
 
-	if a.OnHost {
-		out, err = utils.SH(a.Command)
-	} else {
-		out, err = matcher.Machine.Command(a.Command)
+	// A timeout never satisfies an assertion, not even one expected to fail
+	if errors.Is(err, context.DeadlineExceeded) {
+		Fail(fmt.Sprintf("assertion timed out after %s: %s", a.Timeout, out))
 	}
 
 	if a.Expect.ToFail {
@@ -106,13 +263,57 @@ func runAssertion(a AssertionBlock) {
 		}
 	}
 
+	if a.Expect.Kubernetes != nil {
+		runKubernetesExpect(ctx, m, *a.Expect.Kubernetes)
+	}
+
 	for _, o := range a.PostOps {
-		runOp(o)
+		runOp(ctx, m, o)
+	}
+}
+
+// restoreBaseline restores the named snapshot, taking it first if it doesn't exist yet.
+func restoreBaseline(m types.Machine, name string) {
+	snapshots, err := m.ListSnapshots()
+	Expect(err).ToNot(HaveOccurred())
+
+	for _, s := range snapshots {
+		if s == name {
+			log.Infof("Restoring baseline snapshot %s", name)
+			Expect(m.Restore(name)).To(Succeed())
+			return
+		}
 	}
+
+	log.Infof("Taking baseline snapshot %s", name)
+	Expect(m.Snapshot(name)).To(Succeed())
 }
 
 var logOutline = logging.Logger("test-preview")
 
+// waitMachine waits for the named machine to accept commands and assigns its static network addresses.
+func waitMachine(name string, ready map[string]bool) {
+	if ready[name] {
+		return
+	}
+	vm := matcher.Machines.VM(name)
+	vm.EventuallyConnects()
+
+	m, err := matcher.Machines.Get(name)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(controller.ConfigureNetworks(context.Background(), m)).To(Succeed(), "configuring networks of machine %s", name)
+	ready[name] = true
+}
+
+func configuresNetworks(m types.Machine) bool {
+	for _, n := range m.Config().Networks {
+		if n.Address != "" || n.DHCP != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // Generates test suites from a peg file.
 func Generate(c *Config) error {
 	logOutline.Info("Testsuite outline")
@@ -120,27 +321,72 @@ func Generate(c *Config) error {
 	BeforeSuite(func() {
 		logOutline.Info("Machine creation")
 
-		_, err := matcher.Machine.Create(context.Background())
-		Expect(err).ToNot(HaveOccurred())
+		// Machines are registered in boot order, dependencies first
+		ready := map[string]bool{}
+		for _, n := range matcher.Machines.Names() {
+			if spec, ok := c.Machines[n]; ok {
+				for _, d := range spec.DependsOn {
+					logOutline.Infof("Waiting for machine %s, needed by %s", d, n)
+					waitMachine(d, ready)
+				}
+			}
+
+			m, err := matcher.Machines.Get(n)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = m.Create(context.Background())
+			Expect(err).ToNot(HaveOccurred(), "creating machine %s", n)
+		}
+
+		// Addresses can be assigned or leased only once the guests are up
+		for _, n := range matcher.Machines.Names() {
+			m, err := matcher.Machines.Get(n)
+			Expect(err).ToNot(HaveOccurred())
+			if configuresNetworks(m) {
+				waitMachine(n, ready)
+			}
+		}
 	})
 
 	AfterSuite(
 		func() {
-			err := matcher.Machine.Stop()
-			Expect(err).ToNot(HaveOccurred())
-			if c.Clean {
-				err = matcher.Machine.Clean()
-				Expect(err).ToNot(HaveOccurred())
+			// Tear everything down before failing on the first error
+			errs := []error{}
+			for _, n := range matcher.Machines.Names() {
+				m, err := matcher.Machines.Get(n)
+				if err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				if err := m.Stop(); err != nil {
+					errs = append(errs, fmt.Errorf("stopping machine %s: %w", n, err))
+				}
+				if c.Clean {
+					if err := m.Clean(); err != nil {
+						errs = append(errs, fmt.Errorf("cleaning machine %s: %w", n, err))
+					}
+				}
 			}
+			Expect(errors.Join(errs...)).ToNot(HaveOccurred())
 		},
 	)
 
 	logOutline.Infof("(!!) Tests found: %d", len(c.Tests))
 
 	for _, t := range c.Tests {
-		logOutline.Infof("-> Test spec '%s' ( label: %s )", t.Describe, t.Label)
+		logOutline.Infof("-> Test spec '%s' ( label: %s, snapshot: %s )", t.Describe, t.Label, t.RestoreSnapshot)
 
 		Describe(t.Describe, Label(t.Label), func() {
+			if t.RestoreSnapshot != "" {
+				baseline := t.RestoreSnapshot
+				BeforeEach(func() {
+					for _, n := range matcher.Machines.Names() {
+						m, err := matcher.Machines.Get(n)
+						Expect(err).ToNot(HaveOccurred())
+						restoreBaseline(m, baseline)
+					}
+				})
+			}
+
 			for context, assertions := range t.Assertion {
 				logOutline.Infof("--> Context: %s", context)
 				Context(context, func() {
@@ -0,0 +1,79 @@
+package peg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/gomega" //nolint:revive
+	"github.com/spectrocloud/peg/matcher"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// runKubernetesExpect polls the cluster running in the machine until every assertion holds.
+func runKubernetesExpect(ctx context.Context, m types.Machine, k KubernetesExpect) {
+	timeout := 6 * time.Minute
+	if k.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(k.Timeout)
+		Expect(err).ToNot(HaveOccurred(), "invalid timeout")
+	}
+	path := k.Kubeconfig
+	if path == "" {
+		path = matcher.K3sKubeconfig
+	}
+	port := k.APIPort
+	if port == 0 {
+		port = 6443
+	}
+
+	// The kubeconfig shows up once the cluster is started
+	vm := matcher.NewVM(m, m.Config().StateDir)
+	var cluster *matcher.Cluster
+	Eventually(ctx, func() error {
+		if cluster == nil {
+			c, err := vm.Cluster(path, port)
+			if err != nil {
+				return err
+			}
+			cluster = c
+		}
+		return checkCluster(ctx, cluster, k)
+	}, timeout, 5*time.Second).Should(Succeed())
+}
+
+// checkCluster returns the failed assertions about the cluster.
+func checkCluster(ctx context.Context, c *matcher.Cluster, k KubernetesExpect) error {
+	errs := []error{}
+	if k.NodesReady {
+		errs = append(errs, c.NodesReady(ctx))
+	}
+	for _, p := range k.Pods {
+		phase := corev1.PodRunning
+		if p.Phase != "" {
+			phase = corev1.PodPhase(p.Phase)
+		}
+		errs = append(errs, c.PodsInPhase(ctx, namespaceOrDefault(p.Namespace), p.Selector, phase))
+	}
+	for _, r := range k.Resources {
+		if r.Kind == "" || r.Name == "" {
+			errs = append(errs, fmt.Errorf("resources need a kind and a name"))
+			continue
+		}
+		if r.Absent {
+			errs = append(errs, c.ResourceAbsent(ctx, r.Kind, namespaceOrDefault(r.Namespace), r.Name))
+		} else {
+			errs = append(errs, c.ResourceExists(ctx, r.Kind, namespaceOrDefault(r.Namespace), r.Name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func namespaceOrDefault(ns string) string {
+	if ns == "" {
+		return "default"
+	}
+	return ns
+}
@@ -0,0 +1,124 @@
+package peg
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/pkg/machine"
+	"github.com/spectrocloud/peg/pkg/machine/conformance/fakes"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Kubernetes expectations", func() {
+	var kube *fakes.KubeAPIServer
+	var m types.Machine
+	var kubeconfig string
+
+	BeforeEach(func() {
+		fake, err := fakes.Install(GinkgoT().TempDir())
+		Expect(err).ToNot(HaveOccurred())
+		dockerAPI, err := fake.ServeDocker("docker")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(dockerAPI.Close)
+		kube, err = fake.ServeKubernetes()
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(kube.Close)
+
+		// the kubeconfig k3s would write in the machine, the machine forwarding its API server port to the fake one
+		kubeconfig = filepath.Join(GinkgoT().TempDir(), "k3s.yaml")
+		Expect(os.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: default
+  cluster:
+    server: http://127.0.0.1:6443
+users:
+- name: default
+  user:
+    token: peg
+contexts:
+- name: default
+  context:
+    cluster: default
+    user: default
+current-context: default
+`), 0600)).To(Succeed())
+		u, err := url.Parse(kube.URL())
+		Expect(err).ToNot(HaveOccurred())
+		apiPort, err := strconv.Atoi(u.Port())
+		Expect(err).ToNot(HaveOccurred())
+
+		m, err = machine.New(
+			types.DockerEngine,
+			types.WithContainerHost(dockerAPI.Host()),
+			types.WithImage("alpine"),
+			types.WithStateDir(GinkgoT().TempDir()),
+			func(mc *types.MachineConfig) error {
+				mc.Ports = append(mc.Ports, types.Port{Guest: 6443, Host: apiPort})
+				return nil
+			},
+		)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = m.Create(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(m.Clean)
+
+		kube.AddNode("server", true)
+		kube.AddPod(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Labels: map[string]string{"app": "web"}},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		})
+		Expect(kube.AddResource("deployments", "kube-system", "coredns")).To(Succeed())
+	})
+
+	// assertion parses an assertion with the given kubernetes expectations, polled for a second.
+	assertion := func(kubernetes string) AssertionBlock {
+		a := AssertionBlock{}
+		Expect(yaml.Unmarshal([]byte(fmt.Sprintf(`
+describe: cluster
+expect:
+  kubernetes:
+    kubeconfig: %s
+    timeout: 1s
+%s`, kubeconfig, kubernetes)), &a)).To(Succeed())
+		return a
+	}
+
+	It("holds once the cluster is as expected, without a command", func() {
+		runAssertionOn(m, assertion(`
+    nodesReady: true
+    pods:
+    - selector: app=web
+    resources:
+    - kind: deploy
+      namespace: kube-system
+      name: coredns
+    - kind: configmap
+      name: settings
+      absent: true
+`))
+	})
+
+	DescribeTable("fails until the cluster is as expected",
+		func(kubernetes, failure string) {
+			kube.AddNode("agent", false)
+			Expect(InterceptGomegaFailure(func() {
+				runAssertionOn(m, assertion(kubernetes))
+			})).To(MatchError(ContainSubstring(failure)))
+		},
+		Entry("nodes not ready", "    nodesReady: true\n", "nodes not ready: agent"),
+		Entry("pods in another phase", "    pods:\n    - selector: app=web\n      phase: Succeeded\n", "pods not Succeeded: web (Running)"),
+		Entry("missing resource", "    resources:\n    - kind: deployment\n      name: coredns\n", "deployment coredns not found"),
+		Entry("resource expected absent", "    resources:\n    - kind: deploy\n      namespace: kube-system\n      name: coredns\n      absent: true\n", "deploy coredns exists"),
+		Entry("resource without a name", "    resources:\n    - kind: deploy\n", "resources need a kind and a name"),
+	)
+})
@@ -6,6 +6,9 @@ import (
 	"github.com/spectrocloud/peg/pkg/machine/types"
 )
 
+// Options are the ginkgo options of the run. Since peg runs ginkgo 2.21, EmitSpecProgress does nothing,
+// AlwaysEmitGinkgoWriter is the same as Verbose, and SlowSpecThreshold is how long specs run before
+// their progress is reported (ginkgo PollProgressAfter), instead of being reported as slow.
 type Options struct {
 	Workers                                                                                  int
 	FailFast                                                                                 bool
@@ -40,6 +43,7 @@ var NoColor Option = func(o *Options) error {
 	return nil
 }
 
+// Deprecated: AlwaysEmitGinkgoWriter is the same as Verbose since peg runs ginkgo 2.21.
 var AlwaysEmitGinkgoWriter Option = func(o *Options) error {
 	o.AlwaysEmitGinkgoWriter = true
 	return nil
@@ -50,6 +54,7 @@ var FailFast Option = func(o *Options) error {
 	return nil
 }
 
+// Deprecated: EmitSpecProgress does nothing since peg runs ginkgo 2.21, see WithSlowSpecThreshold.
 var EmitSpecProgress Option = func(o *Options) error {
 	o.EmitSpecProgress = true
 	return nil
@@ -113,6 +118,8 @@ func WithTimeout(s string) Option {
 	}
 }
 
+// WithSlowSpecThreshold reports the progress of specs running for longer than s (ginkgo PollProgressAfter).
+// Since peg runs ginkgo 2.21, specs are not reported as slow once done anymore.
 func WithSlowSpecThreshold(s string) Option {
 	return func(o *Options) error {
 		dur, err := time.ParseDuration(s)
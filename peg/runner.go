@@ -17,6 +17,43 @@ import (
 
 var log = logging.Logger("runner")
 
+// DefaultMachine is the name the machine of a single machine spec is registered with.
+const DefaultMachine = "default"
+
+// newMachine creates a machine and registers it in the matcher registry.
+func newMachine(name string, opts ...types.MachineOption) (types.Machine, error) {
+	m, err := machine.New(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	signals.AddCleanupFn(func() {
+		_ = m.Stop()
+		_ = m.Clean()
+	})
+
+	matcher.Machines.Add(name, m)
+	return m, nil
+}
+
+// newMachines creates the machines of a multi-machine spec in boot order.
+// Options given from the CLI apply to all of them.
+func newMachines(c *Config, opts []types.MachineOption) error {
+	order, err := c.BootOrder()
+	if err != nil {
+		return err
+	}
+
+	for _, n := range order {
+		machineOpts := append([]types.MachineOption{FromMachineSpec(c.Machines[n])}, opts...)
+		machineOpts = append(machineOpts, machineStateDir(n))
+		if _, err := newMachine(n, machineOpts...); err != nil {
+			return fmt.Errorf("failed creating machine '%s': %w", n, err)
+		}
+	}
+	return nil
+}
+
 // Run runs peg files.
 func Run(f string, opts ...Option) error {
 
@@ -67,17 +104,17 @@ func Run(f string, opts ...Option) error {
 		return err
 	}
 
-	m, err := machine.New(append([]types.MachineOption{FromData(dat)}, o.MachineOptions...)...)
-	if err != nil {
-		return err
+	if len(c.Machines) > 0 {
+		if err := newMachines(c, o.MachineOptions); err != nil {
+			return err
+		}
+	} else {
+		m, err := newMachine(DefaultMachine, append([]types.MachineOption{FromData(dat)}, o.MachineOptions...)...)
+		if err != nil {
+			return err
+		}
+		matcher.Machine = m
 	}
-
-	signals.AddCleanupFn(func() {
-		_ = m.Stop()
-		_ = m.Clean()
-	})
-
-	matcher.Machine = m
 	//signal.Reset()
 
 	err = Generate(c)
@@ -98,11 +135,13 @@ func Run(f string, opts ...Option) error {
 
 	reporter.Verbose = o.Verbose
 	reporter.VeryVerbose = o.VeryVerbose
-	reporter.AlwaysEmitGinkgoWriter = o.AlwaysEmitGinkgoWriter
+	// ginkgo dropped these, verbose output includes the GinkgoWriter of passing specs
+	// and slow specs report their progress instead
+	reporter.Verbose = reporter.Verbose || (o.AlwaysEmitGinkgoWriter && !o.VeryVerbose)
 	reporter.JUnitReport = o.JUnitReport
 	reporter.JSONReport = o.JSONReport
 	reporter.NoColor = o.NoColor
-	reporter.SlowSpecThreshold = o.SlowSpecThreshold
+	suite.PollProgressAfter = o.SlowSpecThreshold
 	reporter.Succinct = o.Succint
 
 	RegisterFailHandler(Fail)
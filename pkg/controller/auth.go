@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// authMethods returns the ssh auth methods configured for the machine, in the order they should be tried.
+// The key and the agent are both the publickey method, which clients try only once: their signers are offered
+// together, in order, where the first of them is in the order. They are loaded lazily during the handshake,
+// and skipped if they fail to, so the next methods are still tried.
+func authMethods(s types.SSH) []ssh.AuthMethod {
+	order := s.AuthOrder
+	if len(order) == 0 {
+		if s.PrivateKey != "" || s.PrivateKeyFile != "" {
+			order = append(order, types.SSHAuthKey)
+		}
+		if s.AgentSocket != "" {
+			order = append(order, types.SSHAuthAgent)
+		}
+		if s.Pass != "" || len(order) == 0 {
+			order = append(order, types.SSHAuthPassword)
+		}
+	}
+
+	methods := []ssh.AuthMethod{}
+	publicKeys := false
+	for _, o := range order {
+		switch o {
+		case types.SSHAuthPassword:
+			methods = append(methods, ssh.Password(s.Pass))
+		case types.SSHAuthKey, types.SSHAuthAgent:
+			if publicKeys {
+				continue
+			}
+			publicKeys = true
+			methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				return publicKeySigners(s, order), nil
+			}))
+		}
+	}
+
+	return methods
+}
+
+// publicKeySigners returns the signers of the key and agent methods, in order. Those failing to load are skipped.
+func publicKeySigners(s types.SSH, order []types.SSHAuthMethod) []ssh.Signer {
+	signers := []ssh.Signer{}
+	for _, o := range order {
+		switch o {
+		case types.SSHAuthKey:
+			signer, err := keySigner(s)
+			if err != nil {
+				log.Warnf("Skipping ssh key: %s", err.Error())
+				continue
+			}
+			signers = append(signers, signer)
+		case types.SSHAuthAgent:
+			socket := s.AgentSocket
+			if socket == "" {
+				socket = os.Getenv("SSH_AUTH_SOCK")
+			}
+			agentSigners, err := agentSigners(socket)
+			if err != nil {
+				log.Warnf("Skipping ssh-agent: %s", err.Error())
+				continue
+			}
+			signers = append(signers, agentSigners...)
+		}
+	}
+	return signers
+}
+
+func keySigner(s types.SSH) (ssh.Signer, error) {
+	pem := []byte(s.PrivateKey)
+	if len(pem) == 0 {
+		if s.PrivateKeyFile == "" {
+			return nil, fmt.Errorf("no private key configured")
+		}
+		var err error
+		pem, err = os.ReadFile(s.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading private key: %w", err)
+		}
+	}
+
+	var signer ssh.Signer
+	var err error
+	if s.Passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(s.Passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pem)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing private key: %w", err)
+	}
+	return signer, nil
+}
+
+// agentSigners lists the keys held by the agent. Every signature dials the agent again,
+// so no connection outlives the handshake.
+func agentSigners(socket string) ([]ssh.Signer, error) {
+	if socket == "" {
+		return nil, fmt.Errorf("no ssh-agent socket configured and SSH_AUTH_SOCK is not set")
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed connecting to ssh-agent: %w", err)
+	}
+	defer conn.Close()
+
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, fmt.Errorf("failed listing ssh-agent keys: %w", err)
+	}
+
+	signers := []ssh.Signer{}
+	for _, k := range keys {
+		signers = append(signers, &agentSigner{socket: socket, key: k})
+	}
+	return signers, nil
+}
+
+type agentSigner struct {
+	socket string
+	key    *agent.Key
+}
+
+func (a *agentSigner) PublicKey() ssh.PublicKey {
+	return a.key
+}
+
+func (a *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return a.SignWithAlgorithm(rand, data, "")
+}
+
+func (a *agentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	conn, err := net.Dial("unix", a.socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed connecting to ssh-agent: %w", err)
+	}
+	defer conn.Close()
+
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range signers {
+		if !bytes.Equal(s.PublicKey().Marshal(), a.key.Marshal()) {
+			continue
+		}
+		if as, ok := s.(ssh.AlgorithmSigner); ok {
+			return as.SignWithAlgorithm(rand, data, algorithm)
+		}
+		return s.Sign(rand, data)
+	}
+
+	return nil, fmt.Errorf("key %s is no longer held by ssh-agent", a.key.Comment)
+}
@@ -0,0 +1,128 @@
+package controller_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/pkg/controller"
+	"github.com/spectrocloud/peg/pkg/machine/conformance/fakes"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// newKey returns a new private key, PEM encoded, and its public key.
+func newKey() (string, ssh.PublicKey) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	block, err := ssh.MarshalPrivateKey(key, "")
+	Expect(err).ToNot(HaveOccurred())
+	signer, err := ssh.NewSignerFromKey(key)
+	Expect(err).ToNot(HaveOccurred())
+	return string(pem.EncodeToMemory(block)), signer.PublicKey()
+}
+
+// serveAgent serves an ssh-agent holding a new key, and returns its socket and public key.
+func serveAgent() (string, ssh.PublicKey) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	keyring := agent.NewKeyring()
+	Expect(keyring.Add(agent.AddedKey{PrivateKey: key})).To(Succeed())
+	signer, err := ssh.NewSignerFromKey(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	socket := filepath.Join(GinkgoT().TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	Expect(err).ToNot(HaveOccurred())
+	DeferCleanup(l.Close)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	return socket, signer.PublicKey()
+}
+
+func fingerprints(keys []ssh.PublicKey) []string {
+	f := []string{}
+	for _, k := range keys {
+		f = append(f, ssh.FingerprintSHA256(k))
+	}
+	return f
+}
+
+var _ = Describe("SSH authentication", func() {
+	var sshd *fakes.SSHServer
+
+	BeforeEach(func() {
+		sshd = serveSSH()
+	})
+
+	It("tries the agent once the key is rejected", func() {
+		key, keyPub := newKey()
+		socket, agentPub := serveAgent()
+		sshd.AuthorizeKey(agentPub)
+
+		m := newSSHMachine(sshd, types.SSH{PrivateKey: key, AgentSocket: socket})
+		out, err := controller.SSHCommand(m, "echo in")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal("in\n"))
+		Expect(fingerprints(sshd.OfferedKeys())).To(Equal(fingerprints([]ssh.PublicKey{keyPub, agentPub})))
+	})
+
+	It("offers the keys in the configured order", func() {
+		key, keyPub := newKey()
+		socket, agentPub := serveAgent()
+		sshd.AuthorizeKey(keyPub)
+		sshd.AuthorizeKey(agentPub)
+
+		m := newSSHMachine(sshd, types.SSH{
+			PrivateKey:  key,
+			AgentSocket: socket,
+			AuthOrder:   []types.SSHAuthMethod{types.SSHAuthAgent, types.SSHAuthKey},
+		})
+		_, err := controller.SSHCommand(m, "true")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fingerprints(sshd.OfferedKeys())).To(Equal(fingerprints([]ssh.PublicKey{agentPub})))
+	})
+
+	DescribeTable("falls back to the password when the key can't be loaded",
+		func(s func() types.SSH) {
+			m := newSSHMachine(sshd, s())
+			out, err := controller.SSHCommand(m, "echo in")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out).To(Equal("in\n"))
+		},
+		Entry("missing key file", func() types.SSH {
+			return types.SSH{Pass: "peg", PrivateKeyFile: filepath.Join(GinkgoT().TempDir(), "missing")}
+		}),
+		Entry("unparseable key", func() types.SSH {
+			return types.SSH{Pass: "peg", PrivateKey: "not a key"}
+		}),
+		Entry("wrong passphrase", func() types.SSH {
+			_, key, err := ed25519.GenerateKey(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("secret"))
+			Expect(err).ToNot(HaveOccurred())
+			file := filepath.Join(GinkgoT().TempDir(), "id_ed25519")
+			Expect(os.WriteFile(file, pem.EncodeToMemory(block), 0600)).To(Succeed())
+			return types.SSH{Pass: "peg", PrivateKeyFile: file, Passphrase: "wrong"}
+		}),
+		Entry("missing agent", func() types.SSH {
+			return types.SSH{Pass: "peg", AgentSocket: filepath.Join(GinkgoT().TempDir(), "missing.sock")}
+		}),
+	)
+})
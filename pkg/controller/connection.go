@@ -39,19 +39,31 @@ func SSHDialTimeout(network, addr string, config *ssh.ClientConfig, timeout time
 	timeoutConn := &Conn{conn, timeout, timeout}
 	c, chans, reqs, err := ssh.NewClientConn(timeoutConn, addr, config)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 	client := ssh.NewClient(c, chans, reqs)
 
 	// this sends keepalive packets every 2 seconds
 	// there's no useful response from these, so we can just abort if there's an error
+	// or once the connection is gone.
+	done := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(done)
+	}()
 	go func() {
 		t := time.NewTicker(2 * time.Second)
 		defer t.Stop()
-		for range t.C {
-			_, _, err := client.Conn.SendRequest("keepalive@golang.org", true, nil)
-			if err != nil {
+		for {
+			select {
+			case <-done:
 				return
+			case <-t.C:
+				_, _, err := client.Conn.SendRequest("keepalive@golang.org", true, nil)
+				if err != nil {
+					return
+				}
 			}
 		}
 	}()
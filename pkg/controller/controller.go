@@ -1,16 +1,21 @@
 package controller
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/bramvdbogaerde/go-scp"
+	logging "github.com/ipfs/go-log"
 	"github.com/spectrocloud/peg/pkg/machine/types"
 	"golang.org/x/crypto/ssh"
 )
 
+var log = logging.Logger("controller")
+
 // NewSCPClient returns a SCP client associated to the machine.
 func NewSCPClient(m types.Machine) scp.Client {
 	sshConfig, dialAddr := sshConfig(m)
@@ -19,6 +24,7 @@ func NewSCPClient(m types.Machine) scp.Client {
 }
 
 // NewClient returns a new ssh client associated to a machine.
+// If the guest host key doesn't match the trusted one, the returned error matches ErrHostKeyChanged.
 func NewClient(m types.Machine) (*ssh.Client, *ssh.Session, error) {
 	sshConfig, dialAddr := sshConfig(m)
 
@@ -39,19 +45,37 @@ func NewClient(m types.Machine) (*ssh.Client, *ssh.Session, error) {
 func sshConfig(m types.Machine) (*ssh.ClientConfig, string) {
 	sshConfig := &ssh.ClientConfig{
 		User:    m.Config().SSH.User,
-		Auth:    []ssh.AuthMethod{ssh.Password(m.Config().SSH.Pass)},
+		Auth:    authMethods(*m.Config().SSH),
 		Timeout: 30 * time.Second, // max time to establish connection
 	}
 
-	sshConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	sshConfig.HostKeyCallback = hostKeyCallback(m)
+
+	return sshConfig, dialAddr(m)
+}
 
-	return sshConfig, fmt.Sprintf("127.0.0.1:%s", m.Config().SSH.Port)
+func dialAddr(m types.Machine) string {
+	return fmt.Sprintf("127.0.0.1:%s", m.Config().SSH.Port)
+}
+
+// newPooledSCPClient returns a SCP client running over the shared connection of the machine.
+// Closing it leaves the shared connection open.
+func newPooledSCPClient(m types.Machine) (scp.Client, error) {
+	client, err := Connection(m)
+	if err != nil {
+		return scp.Client{}, err
+	}
+	return scp.NewClientBySSH(client)
 }
 
 func ReceiveFile(m types.Machine, src, dst string) error {
-	scpClient := NewSCPClient(m)
+	return ReceiveFileContext(context.Background(), m, src, dst)
+}
 
-	if err := scpClient.Connect(); err != nil {
+// ReceiveFileContext copies src from the machine to dst. The transfer is aborted if ctx is done.
+func ReceiveFileContext(ctx context.Context, m types.Machine, src, dst string) error {
+	scpClient, err := newPooledSCPClient(m)
+	if err != nil {
 		return err
 	}
 	defer scpClient.Close()
@@ -62,7 +86,7 @@ func ReceiveFile(m types.Machine, src, dst string) error {
 	}
 	defer f.Close()
 
-	err = scpClient.CopyFromRemote(context.Background(), f, src)
+	err = scpClient.CopyFromRemote(ctx, f, src)
 	if err != nil {
 		return err
 	}
@@ -70,35 +94,61 @@ func ReceiveFile(m types.Machine, src, dst string) error {
 }
 
 func SendFile(m types.Machine, src, dst, permission string) error {
-	scpClient := NewSCPClient(m)
-	defer scpClient.Close()
+	return SendFileContext(context.Background(), m, src, dst, permission)
+}
 
-	if err := scpClient.Connect(); err != nil {
+// SendFileContext copies src to dst on the machine. The transfer is aborted if ctx is done.
+func SendFileContext(ctx context.Context, m types.Machine, src, dst, permission string) error {
+	scpClient, err := newPooledSCPClient(m)
+	if err != nil {
 		return err
 	}
+	defer scpClient.Close()
 
 	f, err := os.Open(src)
 	if err != nil {
 		return err
 	}
-
-	defer scpClient.Close()
 	defer f.Close()
 
-	return scpClient.CopyFile(context.Background(), f, dst, permission)
+	return scpClient.CopyFile(ctx, f, dst, permission)
 }
 
 func SSHCommand(m types.Machine, cmd string) (string, error) {
-	client, session, err := NewClient(m)
+	return SSHCommandContext(context.Background(), m, cmd)
+}
+
+// SSHCommandContext runs cmd and returns its combined output.
+// If ctx is done before the command exits, the session is closed and ctx.Err() is returned.
+func SSHCommandContext(ctx context.Context, m types.Machine, cmd string) (string, error) {
+	session, err := NewSession(m)
 	if err != nil {
 		return "", err
 	}
+	defer session.Close()
 
-	defer client.Close()
-	out, err := session.CombinedOutput(cmd)
-	if err != nil {
-		return string(out), err
-	}
+	out := &syncBuffer{}
+	session.Stdout = out
+	session.Stderr = out
+
+	err = runSession(ctx, session, cmd)
+	return out.String(), err
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent writes.
+type syncBuffer struct {
+	sync.Mutex
+	b bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.b.Write(p)
+}
 
-	return string(out), err
+func (s *syncBuffer) String() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.b.String()
 }
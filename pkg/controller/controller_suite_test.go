@@ -1,11 +1,69 @@
 package controller_test
 
 import (
+	"context"
+	"net"
+	"os"
+	"testing"
+
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
-	"testing"
+	"github.com/spectrocloud/peg/pkg/controller"
+	"github.com/spectrocloud/peg/pkg/machine/conformance/fakes"
+	"github.com/spectrocloud/peg/pkg/machine/types"
 )
 
+// fake are the fake guests the specs connect to.
+var fake *fakes.Fakes
+
+var _ = BeforeSuite(func() {
+	var err error
+	fake, err = fakes.Install(GinkgoT().TempDir())
+	Expect(err).ToNot(HaveOccurred())
+})
+
+// sshMachine is a machine reached over SSH only, at the fake guest sshd serves.
+type sshMachine struct {
+	types.Machine
+	config types.MachineConfig
+}
+
+func (m *sshMachine) Config() types.MachineConfig {
+	return m.config
+}
+
+func (m *sshMachine) Run(ctx context.Context, cmd string, opts ...types.RunOption) (*types.CommandResult, error) {
+	return controller.SSHRun(ctx, m, cmd, opts...)
+}
+
+// serveSSH serves a fake guest accepting the peg user with password peg.
+func serveSSH() *fakes.SSHServer {
+	sshd, err := fake.ServeSSH("127.0.0.1:0", "peg", "peg")
+	Expect(err).ToNot(HaveOccurred())
+	DeferCleanup(sshd.Close)
+	return sshd
+}
+
+// newSSHMachine returns a machine connecting to sshd, with its own connection and state directory.
+func newSSHMachine(sshd *fakes.SSHServer, s types.SSH) *sshMachine {
+	_, port, err := net.SplitHostPort(sshd.Addr().String())
+	Expect(err).ToNot(HaveOccurred())
+	if s.User == "" {
+		s.User = "peg"
+	}
+	s.Port = port
+
+	m := &sshMachine{config: types.MachineConfig{ID: CurrentSpecReport().FullText(), StateDir: GinkgoT().TempDir(), SSH: &s}}
+	DeferCleanup(controller.CloseConnection, m)
+	return m
+}
+
+func TestMain(m *testing.M) {
+	// The test binary is the fake executables as well
+	fakes.Run()
+	os.Exit(m.Run())
+}
+
 func TestController(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Controller Suite")
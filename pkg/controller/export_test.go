@@ -0,0 +1,8 @@
+package controller
+
+// PoolSize returns the number of machines in the connection pool.
+func PoolSize() int {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+	return len(pool)
+}
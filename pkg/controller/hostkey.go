@@ -0,0 +1,127 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ErrHostKeyChanged matches (with errors.Is) any HostKeyChangedError.
+var ErrHostKeyChanged = errors.New("host key changed")
+
+// HostKeyChangedError is returned by NewClient when the guest presents a host key
+// that differs from the trusted one.
+type HostKeyChangedError struct {
+	Host string
+	// Want are the fingerprints of the trusted keys.
+	Want []string
+	// Got is the fingerprint of the key presented by the guest.
+	Got string
+}
+
+func (e *HostKeyChangedError) Error() string {
+	return fmt.Sprintf("host key for %s changed: got %s, want %s", e.Host, e.Got, strings.Join(e.Want, ", "))
+}
+
+func (e *HostKeyChangedError) Is(target error) bool {
+	return target == ErrHostKeyChanged
+}
+
+var knownHostsLock sync.Mutex
+
+// KnownHostsFile returns the path of the known_hosts file used by the tofu policy.
+func KnownHostsFile(m types.Machine) string {
+	return filepath.Join(m.Config().StateDir, "known_hosts")
+}
+
+// ForgetHostKeys removes the trusted host keys of the machine, so the next connection trusts
+// whatever key the guest presents.
+func ForgetHostKeys(m types.Machine) error {
+	knownHostsLock.Lock()
+	defer knownHostsLock.Unlock()
+
+	err := os.Remove(KnownHostsFile(m))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func hostKeyCallback(m types.Machine) ssh.HostKeyCallback {
+	s := m.Config().SSH
+	switch s.HostKeyPolicy {
+	case "", types.HostKeyIgnore:
+		return ssh.InsecureIgnoreHostKey()
+	case types.HostKeyTOFU:
+		return tofuCallback(KnownHostsFile(m))
+	case types.HostKeyPin:
+		return pinCallback(s.HostKeyFingerprint)
+	}
+
+	return func(_ string, _ net.Addr, _ ssh.PublicKey) error {
+		return fmt.Errorf("invalid host key policy: %s", s.HostKeyPolicy)
+	}
+}
+
+func tofuCallback(file string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		knownHostsLock.Lock()
+		defer knownHostsLock.Unlock()
+
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		check, err := knownhosts.New(file)
+		if err != nil {
+			return fmt.Errorf("failed reading %s: %w", file, err)
+		}
+
+		err = check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		switch {
+		case err == nil:
+			return nil
+		case errors.As(err, &keyErr) && len(keyErr.Want) == 0:
+			// First time we see this host, trust it
+			log.Infof("Trusting host key %s for %s", ssh.FingerprintSHA256(key), hostname)
+			_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+			return err
+		case errors.As(err, &keyErr):
+			want := []string{}
+			for _, k := range keyErr.Want {
+				want = append(want, ssh.FingerprintSHA256(k.Key))
+			}
+			return &HostKeyChangedError{Host: hostname, Want: want, Got: ssh.FingerprintSHA256(key)}
+		}
+		return err
+	}
+}
+
+func pinCallback(fingerprint string) ssh.HostKeyCallback {
+	want := fingerprint
+	if !strings.HasPrefix(want, "SHA256:") {
+		want = "SHA256:" + want
+	}
+
+	return func(hostname string, _ net.Addr, key ssh.PublicKey) error {
+		if fingerprint == "" {
+			return errors.New("host key policy is pin, but no fingerprint was given")
+		}
+		got := ssh.FingerprintSHA256(key)
+		if got != want {
+			return &HostKeyChangedError{Host: hostname, Want: []string{want}, Got: got}
+		}
+		return nil
+	}
+}
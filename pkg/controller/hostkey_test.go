@@ -0,0 +1,94 @@
+package controller_test
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/pkg/controller"
+	"github.com/spectrocloud/peg/pkg/machine/conformance/fakes"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("Host key verification", func() {
+	var sshd *fakes.SSHServer
+
+	BeforeEach(func() {
+		sshd = serveSSH()
+	})
+
+	Context("trusting the first key", func() {
+		var m *sshMachine
+
+		BeforeEach(func() {
+			m = newSSHMachine(sshd, types.SSH{Pass: "peg", HostKeyPolicy: types.HostKeyTOFU})
+		})
+
+		It("records the key and accepts it again", func() {
+			_, err := controller.SSHCommand(m, "true")
+			Expect(err).ToNot(HaveOccurred())
+			knownHosts, err := os.ReadFile(controller.KnownHostsFile(m))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(knownHosts)).To(ContainSubstring(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshd.HostKey())))))
+
+			Expect(controller.CloseConnection(m)).To(Succeed())
+			_, err = controller.SSHCommand(m, "true")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("rejects a changed key until it is forgotten", func() {
+			_, err := controller.SSHCommand(m, "true")
+			Expect(err).ToNot(HaveOccurred())
+			trusted := ssh.FingerprintSHA256(sshd.HostKey())
+
+			Expect(sshd.RotateHostKey()).To(Succeed())
+			Expect(controller.CloseConnection(m)).To(Succeed())
+			_, err = controller.SSHCommand(m, "true")
+			Expect(err).To(MatchError(controller.ErrHostKeyChanged))
+			var changed *controller.HostKeyChangedError
+			Expect(errors.As(err, &changed)).To(BeTrue())
+			Expect(changed.Want).To(Equal([]string{trusted}))
+			Expect(changed.Got).To(Equal(ssh.FingerprintSHA256(sshd.HostKey())))
+
+			Expect(controller.ForgetHostKeys(m)).To(Succeed())
+			_, err = controller.SSHCommand(m, "true")
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("pinning the key", func() {
+		It("accepts the pinned fingerprint, with or without its prefix", func() {
+			fingerprint := ssh.FingerprintSHA256(sshd.HostKey())
+			for _, f := range []string{fingerprint, strings.TrimPrefix(fingerprint, "SHA256:")} {
+				m := newSSHMachine(sshd, types.SSH{Pass: "peg", HostKeyPolicy: types.HostKeyPin, HostKeyFingerprint: f})
+				_, err := controller.SSHCommand(m, "true")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(controller.CloseConnection(m)).To(Succeed())
+			}
+		})
+
+		It("rejects other keys", func() {
+			fingerprint := ssh.FingerprintSHA256(sshd.HostKey())
+			Expect(sshd.RotateHostKey()).To(Succeed())
+
+			m := newSSHMachine(sshd, types.SSH{Pass: "peg", HostKeyPolicy: types.HostKeyPin, HostKeyFingerprint: fingerprint})
+			_, err := controller.SSHCommand(m, "true")
+			Expect(err).To(MatchError(controller.ErrHostKeyChanged))
+		})
+
+		It("fails without a fingerprint", func() {
+			m := newSSHMachine(sshd, types.SSH{Pass: "peg", HostKeyPolicy: types.HostKeyPin})
+			_, err := controller.SSHCommand(m, "true")
+			Expect(err).To(MatchError(ContainSubstring("no fingerprint was given")))
+		})
+	})
+
+	It("fails with an unknown policy", func() {
+		m := newSSHMachine(sshd, types.SSH{Pass: "peg", HostKeyPolicy: "trust-me"})
+		_, err := controller.SSHCommand(m, "true")
+		Expect(err).To(MatchError(ContainSubstring("invalid host key policy: trust-me")))
+	})
+})
@@ -0,0 +1,195 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// interfacesScript prints "<name> <mac> <address/prefix>" for every network interface of the guest.
+const interfacesScript = `for i in /sys/class/net/*; do d=$(basename "$i"); echo "$d $(cat "$i/address") $(ip -o -4 addr show dev "$d" | awk '{print $4}' | head -n1)"; done`
+
+type guestInterface struct {
+	Name    string
+	Address string
+}
+
+// guestInterfaces returns the network interfaces of the guest by MAC address.
+func guestInterfaces(ctx context.Context, m types.Machine) (map[string]guestInterface, error) {
+	res, err := m.Run(ctx, interfacesScript)
+	if err != nil {
+		return nil, err
+	}
+	if !res.Success() {
+		return nil, fmt.Errorf("failed listing guest interfaces: %s", res)
+	}
+
+	ifaces := map[string]guestInterface{}
+	for _, l := range strings.Split(res.Stdout, "\n") {
+		fields := strings.Fields(l)
+		if len(fields) < 2 {
+			continue
+		}
+		i := guestInterface{Name: fields[0]}
+		if len(fields) > 2 {
+			i.Address = fields[2]
+		}
+		ifaces[strings.ToLower(fields[1])] = i
+	}
+	return ifaces, nil
+}
+
+// GuestAddresses returns the IPv4 address of the machine on each of its private networks, by network name.
+// Networks the guest has no address on yet are left out.
+func GuestAddresses(ctx context.Context, m types.Machine) (map[string]string, error) {
+	addresses := map[string]string{}
+	networks := m.Config().Networks
+	if len(networks) == 0 {
+		return addresses, nil
+	}
+
+	ifaces, err := guestInterfaces(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range networks {
+		i, ok := ifaces[strings.ToLower(n.MAC)]
+		if !ok || i.Address == "" {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(i.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s on %s: %w", i.Address, i.Name, err)
+		}
+		addresses[n.Name] = ip.String()
+	}
+	return addresses, nil
+}
+
+// dhcpClientScript gets a lease on the interface $1 with the DHCP client of the guest, unless it has an address already.
+const dhcpClientScript = `if ! ip -o -4 addr show dev "$1" | grep -q inet; then
+  if command -v dhclient >/dev/null; then dhclient -1 "$1"
+  elif command -v udhcpc >/dev/null; then udhcpc -n -q -i "$1"
+  elif command -v dhcpcd >/dev/null; then dhcpcd -1 "$1"
+  else echo "no dhcp client to configure $1" >&2; exit 1
+  fi
+fi`
+
+// ConfigureNetworks brings up the guest interfaces of the private networks with a static address or DHCP, and
+// assigns the static address or gets a lease.
+func ConfigureNetworks(ctx context.Context, m types.Machine) error {
+	configured := []types.Network{}
+	for _, n := range m.Config().Networks {
+		if n.Address != "" || n.DHCP != "" {
+			configured = append(configured, n)
+		}
+	}
+	if len(configured) == 0 {
+		return nil
+	}
+
+	ifaces, err := guestInterfaces(ctx, m)
+	if err != nil {
+		return err
+	}
+
+	script := "set -e\n"
+	for _, n := range configured {
+		i, ok := ifaces[strings.ToLower(n.MAC)]
+		if !ok {
+			return fmt.Errorf("no guest interface with mac %s for network %s", n.MAC, n.Name)
+		}
+		script += fmt.Sprintf("ip link set dev %s up\n", i.Name)
+		if n.Address != "" {
+			script += fmt.Sprintf("ip addr replace %s dev %s\n", n.Address, i.Name)
+		} else {
+			script += fmt.Sprintf("sh -c %s dhcp %s\n", types.ShellQuote(dhcpClientScript), i.Name)
+		}
+	}
+
+	res, err := m.Run(ctx, "sudo /bin/sh", types.WithStdin(strings.NewReader(script)))
+	if err != nil {
+		return err
+	}
+	if !res.Success() {
+		return fmt.Errorf("failed configuring networks: %s", res)
+	}
+	return nil
+}
+
+// netemScript returns the script applying c to the guest network with tc.
+func netemScript(c types.NetworkConditions) (string, error) {
+	dev := `$(ip route show default | awk '{print $5; exit}')`
+	if c.Interface != "" {
+		dev = c.Interface
+	}
+
+	netem := ""
+	if c.Latency != "" {
+		netem += " delay " + c.Latency
+		if c.Jitter != "" {
+			netem += " " + c.Jitter
+		}
+	} else if c.Jitter != "" {
+		return "", fmt.Errorf("jitter requires a latency")
+	}
+	if c.Loss < 0 || c.Loss > 100 {
+		return "", fmt.Errorf("invalid packet loss %v%%", c.Loss)
+	}
+	if c.Loss > 0 {
+		netem += fmt.Sprintf(" loss %v%%", c.Loss)
+	}
+
+	// The rollback scheduled by the previous conditions would drop the new ones
+	script := fmt.Sprintf("set -e\ndev=%s\nwatchdog=\"${TMPDIR:-/tmp}/peg-netem-$dev.pid\"\n", dev) +
+		"if [ -f \"$watchdog\" ]; then kill \"$(cat \"$watchdog\")\" 2>/dev/null || true; rm -f \"$watchdog\"; fi\n"
+	if netem == "" {
+		// Nothing to degrade, drop the qdisc if any
+		return script + "tc qdisc del dev \"$dev\" root 2>/dev/null || true\n", nil
+	}
+	script += fmt.Sprintf("tc qdisc replace dev \"$dev\" root netem%s\n", netem)
+	if c.Duration == "" {
+		return script, nil
+	}
+
+	d, err := time.ParseDuration(c.Duration)
+	if err != nil || d <= 0 {
+		return "", fmt.Errorf("invalid network conditions duration %s", c.Duration)
+	}
+	// The guest rolls back by itself, as the conditions may keep the restore from reaching it.
+	// The rollback gets its own session when possible, and records its pid once in it, not to be
+	// killed along with the command if the session ends first.
+	return script + fmt.Sprintf(`detach=
+command -v setsid >/dev/null && detach=setsid
+$detach sh -c 'echo $$ > "$2"; sleep %d; tc qdisc del dev "$1" root; rm -f "$2"' netem-rollback "$dev" "$watchdog" </dev/null >/dev/null 2>&1 &
+i=0
+while [ ! -s "$watchdog" ] && [ $i -lt 50 ]; do sleep 0.1 2>/dev/null || sleep 1; i=$((i+1)); done
+`, int(math.Ceil(d.Seconds()))), nil
+}
+
+// SetNetworkConditions applies c to the guest network with tc/netem, running it with sudo.
+func SetNetworkConditions(ctx context.Context, m types.Machine, c types.NetworkConditions) error {
+	return SetNetworkConditionsWith(ctx, m, "sudo /bin/sh", c)
+}
+
+// SetNetworkConditionsWith is like SetNetworkConditions, the script is fed to shell, e.g. when sudo is not available.
+func SetNetworkConditionsWith(ctx context.Context, m types.Machine, shell string, c types.NetworkConditions) error {
+	script, err := netemScript(c)
+	if err != nil {
+		return err
+	}
+
+	res, err := m.Run(ctx, shell, types.WithStdin(strings.NewReader(script)))
+	if err != nil {
+		return err
+	}
+	if !res.Success() {
+		return fmt.Errorf("failed setting network conditions: %s", res)
+	}
+	return nil
+}
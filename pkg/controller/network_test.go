@@ -0,0 +1,58 @@
+package controller_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/pkg/controller"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+var _ = Describe("Network conditions", func() {
+	var m *sshMachine
+
+	// tcLog returns the tc commands the fake guest ran.
+	tcLog := func() string {
+		b, _ := os.ReadFile(filepath.Join(fake.GuestPath(), "tc.log"))
+		return string(b)
+	}
+
+	BeforeEach(func() {
+		m = newSSHMachine(serveSSH(), types.SSH{Pass: "peg"})
+		GinkgoT().Setenv("TMPDIR", GinkgoT().TempDir())
+		Expect(os.RemoveAll(filepath.Join(fake.GuestPath(), "tc.log"))).To(Succeed())
+	})
+
+	set := func(c types.NetworkConditions) error {
+		return controller.SetNetworkConditionsWith(context.Background(), m, "/bin/sh", c)
+	}
+
+	It("applies and restores netem", func() {
+		Expect(set(types.NetworkConditions{Interface: "eth0", Latency: "200ms", Jitter: "50ms", Loss: 20})).To(Succeed())
+		Expect(set(types.NetworkConditions{Interface: "eth0"})).To(Succeed())
+		Expect(tcLog()).To(Equal("tc qdisc replace dev eth0 root netem delay 200ms 50ms loss 20%\ntc qdisc del dev eth0 root\n"))
+	})
+
+	It("rolls back in the guest once the duration is over", func() {
+		Expect(set(types.NetworkConditions{Interface: "eth0", Loss: 100, Duration: "1s"})).To(Succeed())
+		Eventually(tcLog, "10s", "100ms").Should(HaveSuffix("tc qdisc del dev eth0 root\n"))
+	})
+
+	It("cancels the rollback when other conditions are set", func() {
+		Expect(set(types.NetworkConditions{Interface: "eth0", Loss: 100, Duration: "1s"})).To(Succeed())
+		Expect(set(types.NetworkConditions{Interface: "eth0", Loss: 10})).To(Succeed())
+		Consistently(tcLog, "2s", "100ms").Should(HaveSuffix("tc qdisc replace dev eth0 root netem loss 10%\n"))
+	})
+
+	DescribeTable("rejects invalid conditions",
+		func(c types.NetworkConditions, msg string) {
+			Expect(set(c)).To(MatchError(msg))
+		},
+		Entry("jitter without latency", types.NetworkConditions{Jitter: "10ms"}, "jitter requires a latency"),
+		Entry("loss above 100%", types.NetworkConditions{Loss: 101}, "invalid packet loss 101%"),
+		Entry("invalid duration", types.NetworkConditions{Loss: 1, Duration: "soon"}, "invalid network conditions duration soon"),
+	)
+})
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	"golang.org/x/crypto/ssh"
+)
+
+// pooledConn is the shared connection of a single machine.
+type pooledConn struct {
+	sync.Mutex
+	client *ssh.Client
+}
+
+var (
+	poolLock sync.Mutex
+	pool     = map[string]*pooledConn{}
+)
+
+func poolKey(m types.Machine) string {
+	return fmt.Sprintf("%s/%s", m.Config().ID, dialAddr(m))
+}
+
+func pooled(m types.Machine) *pooledConn {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+
+	k := poolKey(m)
+	if _, ok := pool[k]; !ok {
+		pool[k] = &pooledConn{}
+	}
+	return pool[k]
+}
+
+// Connection returns the SSH client shared by every operation on the machine, dialing it if needed.
+// The client is owned by the pool: callers must not close it, use CloseConnection instead.
+func Connection(m types.Machine) (*ssh.Client, error) {
+	p := pooled(m)
+	p.Lock()
+	defer p.Unlock()
+
+	if p.client != nil {
+		return p.client, nil
+	}
+
+	sshConfig, dialAddr := sshConfig(m)
+	client, err := SSHDialTimeout("tcp", dialAddr, sshConfig, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	p.client = client
+
+	// Forget the client as soon as the connection drops (e.g. the machine rebooted)
+	go func() {
+		_ = client.Wait()
+		p.Lock()
+		defer p.Unlock()
+		if p.client == client {
+			p.client = nil
+		}
+	}()
+
+	return client, nil
+}
+
+// NewSession opens a new session multiplexed over the shared connection of the machine.
+// If the connection went stale, it reconnects once before giving up.
+func NewSession(m types.Machine) (*ssh.Session, error) {
+	client, err := Connection(m)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := client.NewSession()
+	if err == nil {
+		return session, nil
+	}
+
+	log.Debugf("Session failed on pooled connection, reconnecting: %s", err.Error())
+	drop(m, client)
+
+	client, err = Connection(m)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewSession()
+}
+
+// CloseConnection closes the shared connection of the machine, if any, and forgets the machine.
+func CloseConnection(m types.Machine) error {
+	poolLock.Lock()
+	k := poolKey(m)
+	p, ok := pool[k]
+	delete(pool, k)
+	poolLock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.client == nil {
+		return nil
+	}
+	err := p.client.Close()
+	p.client = nil
+	return err
+}
+
+// drop closes the given client if it is still the shared one.
+func drop(m types.Machine, client *ssh.Client) {
+	p := pooled(m)
+	p.Lock()
+	defer p.Unlock()
+
+	if p.client == client {
+		p.client = nil
+	}
+	client.Close()
+}
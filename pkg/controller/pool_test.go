@@ -0,0 +1,62 @@
+package controller_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/pkg/controller"
+	"github.com/spectrocloud/peg/pkg/machine/conformance/fakes"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+var _ = Describe("Pooled connections", func() {
+	var sshd *fakes.SSHServer
+	var m *sshMachine
+
+	BeforeEach(func() {
+		sshd = serveSSH()
+		m = newSSHMachine(sshd, types.SSH{Pass: "peg"})
+	})
+
+	It("shares one connection between operations", func() {
+		client, err := controller.Connection(m)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = controller.SSHCommand(m, "true")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(controller.Connection(m)).To(BeIdenticalTo(client))
+	})
+
+	It("reconnects once the guest dropped the connection", func() {
+		client, err := controller.Connection(m)
+		Expect(err).ToNot(HaveOccurred())
+
+		sshd.Disconnect()
+		out, err := controller.SSHCommand(m, "echo back")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal("back\n"))
+		Expect(controller.Connection(m)).ToNot(BeIdenticalTo(client))
+	})
+
+	It("closes the shared connection, and dials a new one next", func() {
+		client, err := controller.Connection(m)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(controller.CloseConnection(m)).To(Succeed())
+		_, err = client.NewSession()
+		Expect(err).To(HaveOccurred())
+		Expect(controller.Connection(m)).ToNot(BeIdenticalTo(client))
+	})
+
+	It("forgets the machine once its connection is closed", func() {
+		size := controller.PoolSize()
+		_, err := controller.Connection(m)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(controller.PoolSize()).To(Equal(size + 1))
+
+		Expect(controller.CloseConnection(m)).To(Succeed())
+		Expect(controller.PoolSize()).To(Equal(size))
+	})
+
+	It("closes nothing when not connected", func() {
+		Expect(controller.CloseConnection(m)).To(Succeed())
+	})
+})
@@ -0,0 +1,144 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrExpectTimeout is returned by PTYSession.Expect when the output doesn't match in time.
+var ErrExpectTimeout = errors.New("timed out waiting for expected output")
+
+// PTYSession is a command running in a pseudo terminal on the machine, driven
+// with expect-style Expect and Send calls.
+type PTYSession struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+
+	mu     sync.Mutex
+	output []byte // everything read so far
+	unread int    // offset of the output not consumed by Expect yet
+	closed bool   // the command output is over
+	notify chan struct{}
+}
+
+// NewPTYSession starts cmd in a pseudo terminal on the machine, over the shared connection.
+func NewPTYSession(m types.Machine, cmd string) (*PTYSession, error) {
+	session, err := NewSession(m)
+	if err != nil {
+		return nil, err
+	}
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty("xterm", 50, 200, modes); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed requesting pty: %w", err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	// stderr is merged into stdout by the pty
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	if err := session.Start(cmd); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	p := &PTYSession{session: session, stdin: stdin, notify: make(chan struct{}, 1)}
+	go p.read(stdout)
+
+	return p, nil
+}
+
+func (p *PTYSession) read(r io.Reader) {
+	b := make([]byte, 4096)
+	for {
+		n, err := r.Read(b)
+		p.mu.Lock()
+		p.output = append(p.output, b[:n]...)
+		if err != nil {
+			p.closed = true
+		}
+		p.mu.Unlock()
+
+		select {
+		case p.notify <- struct{}{}:
+		default:
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Expect waits until the output not consumed yet matches re, and returns the match.
+// Output up to the end of the match is consumed, so following calls only see what comes after it.
+func (p *PTYSession) Expect(re *regexp.Regexp, timeout time.Duration) (string, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		p.mu.Lock()
+		pending := p.output[p.unread:]
+		if loc := re.FindIndex(pending); loc != nil {
+			match := string(pending[loc[0]:loc[1]])
+			p.unread += loc[1]
+			p.mu.Unlock()
+			return match, nil
+		}
+		closed := p.closed
+		p.mu.Unlock()
+
+		if closed {
+			return "", fmt.Errorf("session ended before %q showed up, output: %q: %w", re.String(), string(pending), io.EOF)
+		}
+
+		select {
+		case <-p.notify:
+		case <-timer.C:
+			return "", fmt.Errorf("%w %q after %s, output: %q", ErrExpectTimeout, re.String(), timeout, string(pending))
+		}
+	}
+}
+
+// Send writes s to the terminal, as if it was typed. Use "\n" to press enter.
+func (p *PTYSession) Send(s string) error {
+	_, err := io.WriteString(p.stdin, s)
+	return err
+}
+
+// Output returns the whole output of the session so far.
+func (p *PTYSession) Output() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return string(p.output)
+}
+
+// Wait waits for the command to exit.
+func (p *PTYSession) Wait() error {
+	return p.session.Wait()
+}
+
+// Close terminates the session.
+func (p *PTYSession) Close() error {
+	return p.session.Close()
+}
@@ -0,0 +1,55 @@
+package controller_test
+
+import (
+	"io"
+	"regexp"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/pkg/controller"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+var _ = Describe("PTY sessions", func() {
+	var m *sshMachine
+
+	BeforeEach(func() {
+		m = newSSHMachine(serveSSH(), types.SSH{Pass: "peg"})
+	})
+
+	It("consumes the output up to each match", func() {
+		p, err := controller.NewPTYSession(m, "")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(p.Close)
+
+		Expect(p.Send("echo one; echo two\n")).To(Succeed())
+		Expect(p.Expect(regexp.MustCompile(`one`), 10*time.Second)).To(Equal("one"))
+		Expect(p.Expect(regexp.MustCompile(`t\w+`), 10*time.Second)).To(Equal("two"))
+		// "one" was consumed already
+		_, err = p.Expect(regexp.MustCompile(`one`), 100*time.Millisecond)
+		Expect(err).To(MatchError(controller.ErrExpectTimeout))
+		Expect(p.Output()).To(Equal("one\ntwo\n"))
+	})
+
+	It("times out when the output doesn't match", func() {
+		p, err := controller.NewPTYSession(m, "echo nope; sleep 30")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(p.Close)
+
+		start := time.Now()
+		_, err = p.Expect(regexp.MustCompile(`yes`), 500*time.Millisecond)
+		Expect(err).To(MatchError(controller.ErrExpectTimeout))
+		Expect(err).To(MatchError(ContainSubstring("nope")))
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+
+	It("fails without waiting once the command exited", func() {
+		p, err := controller.NewPTYSession(m, "echo bye")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(p.Wait()).To(Succeed())
+		_, err = p.Expect(regexp.MustCompile(`hello`), time.Minute)
+		Expect(err).To(MatchError(io.EOF))
+	})
+})
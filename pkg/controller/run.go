@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHRun runs cmd on the machine over the shared connection.
+// A non-zero exit is reported in the result, the returned error is set only if the
+// command couldn't run or its outcome is unknown (e.g. the connection dropped).
+// Cancelling ctx kills the command.
+func SSHRun(ctx context.Context, m types.Machine, cmd string, opts ...types.RunOption) (*types.CommandResult, error) {
+	c := types.NewRunConfig(opts...)
+
+	session, err := NewSession(m)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout, session.Stderr = c.Tee(&stdout, &stderr)
+	session.Stdin = c.Stdin
+
+	start := time.Now()
+	err = runSession(ctx, session, c.Command(cmd))
+	res := &types.CommandResult{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Duration: time.Since(start),
+	}
+
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		return res, nil
+	case errors.As(err, &exitErr):
+		res.ExitCode = exitErr.ExitStatus()
+		res.Signal = exitErr.Signal()
+		return res, nil
+	}
+
+	return res, err
+}
+
+// runSession runs cmd in the session, closing it if ctx is done first.
+func runSession(ctx context.Context, session *ssh.Session, cmd string) error {
+	if err := session.Start(cmd); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// Not every sshd honours signals, closing the channel is what actually stops us from waiting
+		_ = session.Signal(ssh.SIGKILL)
+		session.Close()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// LineWriter forwards to an underlying writer only complete lines, so that output coming
+// from several LineWriters sharing the same lock doesn't get interleaved mid-line.
+type LineWriter struct {
+	w      io.Writer
+	lock   sync.Locker
+	prefix string
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// NewLineWriter returns a LineWriter prefixing every line with prefix.
+// Writers sharing the underlying writer should share lock too.
+func NewLineWriter(w io.Writer, lock sync.Locker, prefix string) *LineWriter {
+	if lock == nil {
+		lock = &sync.Mutex{}
+	}
+	return &LineWriter{w: w, lock: lock, prefix: prefix}
+}
+
+func (l *LineWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := l.emit(l.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		l.buf = l.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes out a trailing incomplete line, if any.
+func (l *LineWriter) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.buf) == 0 {
+		return nil
+	}
+	err := l.emit(append(l.buf, '\n'))
+	l.buf = nil
+	return err
+}
+
+func (l *LineWriter) emit(line []byte) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, err := l.w.Write(append([]byte(l.prefix), line...))
+	return err
+}
+
+// Stream runs cmd on the machine, writing stdout and stderr to w line by line while the command runs.
+// Lines of stdout and stderr are interleaved as they come. The full output is still collected in the returned result.
+func Stream(ctx context.Context, m types.Machine, cmd string, w io.Writer, opts ...types.RunOption) (*types.CommandResult, error) {
+	lock := &sync.Mutex{}
+	stdout := NewLineWriter(w, lock, "")
+	stderr := NewLineWriter(w, lock, "")
+	defer func() {
+		_ = stdout.Flush()
+		_ = stderr.Flush()
+	}()
+
+	// not appending to opts, which could write to the array of the caller
+	runOpts := append([]types.RunOption{}, opts...)
+	return m.Run(ctx, cmd, append(runOpts, types.WithStdout(stdout), types.WithStderr(stderr))...)
+}
@@ -0,0 +1,66 @@
+package controller_test
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/pkg/controller"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+var _ = Describe("Streaming output", func() {
+	Context("LineWriter", func() {
+		It("writes complete lines only, prefixed", func() {
+			out := &bytes.Buffer{}
+			w := controller.NewLineWriter(out, nil, "> ")
+
+			_, err := w.Write([]byte("hel"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out.String()).To(BeEmpty())
+			_, err = w.Write([]byte("lo\nwor"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out.String()).To(Equal("> hello\n"))
+			_, err = w.Write([]byte("ld\nand\nmore"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out.String()).To(Equal("> hello\n> world\n> and\n"))
+
+			Expect(w.Flush()).To(Succeed())
+			Expect(out.String()).To(Equal("> hello\n> world\n> and\n> more\n"))
+			Expect(w.Flush()).To(Succeed())
+			Expect(out.String()).To(Equal("> hello\n> world\n> and\n> more\n"))
+		})
+
+		It("doesn't interleave writers sharing a lock mid-line", func() {
+			out := &bytes.Buffer{}
+			lock := &sync.Mutex{}
+			a := controller.NewLineWriter(out, lock, "a: ")
+			b := controller.NewLineWriter(out, lock, "b: ")
+
+			_, _ = a.Write([]byte("first "))
+			_, _ = b.Write([]byte("second\n"))
+			_, _ = a.Write([]byte("half\n"))
+			Expect(out.String()).To(Equal("b: second\na: first half\n"))
+		})
+	})
+
+	It("streams the output of commands line by line, and returns it", func() {
+		sshd := serveSSH()
+		m := newSSHMachine(sshd, types.SSH{Pass: "peg"})
+
+		out := &bytes.Buffer{}
+		opts := make([]types.RunOption, 0, 2)
+		res, err := controller.Stream(context.Background(), m, "printf 'out\\npartial'; echo err >&2; exit 3", out, opts...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.ExitCode).To(Equal(3))
+		Expect(res.Stdout).To(Equal("out\npartial"))
+		Expect(res.Stderr).To(Equal("err\n"))
+		Expect(out.String()).To(ContainSubstring("out\n"))
+		Expect(out.String()).To(ContainSubstring("partial\n"))
+		Expect(out.String()).To(ContainSubstring("err\n"))
+		// the options of the caller are left alone
+		Expect(opts[:cap(opts)]).To(HaveEach(BeNil()))
+	})
+})
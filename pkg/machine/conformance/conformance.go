@@ -0,0 +1,77 @@
+// Package conformance holds ginkgo specs checking that machine engines behave as types.Machine documents.
+// Engines, including third-party ones, are validated by registering the specs in a ginkgo suite.
+// The fakes package provides stand-ins for the hypervisors and guests of the built-in engines, to run them offline.
+package conformance
+
+import (
+	"io"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/ginkgo/v2" //nolint:revive
+)
+
+// Feature is an optional part of types.Machine, that engines can leave unimplemented.
+type Feature string
+
+const (
+	// Screenshots are taken with Screenshot and ScreenshotContext.
+	Screenshots Feature = "screenshots"
+	// Keyboard is typing with SendKeys and TypeText.
+	Keyboard Feature = "keyboard"
+	// NetworkConditions are set with SetNetworkConditions.
+	NetworkConditions Feature = "network conditions"
+	// Pausing is done with Pause and Resume.
+	Pausing Feature = "pausing"
+	// Snapshots are taken with Snapshot and restored with Restore.
+	Snapshots Feature = "snapshots"
+	// LinkState is unplugging and plugging back the network with SetLinkUp.
+	LinkState Feature = "link state"
+)
+
+// Engine is a machine engine under test.
+type Engine struct {
+	Name string
+	// New returns a machine of the engine, not created yet.
+	New func() (types.Machine, error)
+	// Available tells whether the engine can run on this host, the specs are skipped with the returned reason otherwise.
+	Available func() (bool, string)
+	// Guest starts what stands in for the guest of a machine once created, e.g. a fake SSH server. Optional.
+	Guest func(m types.Machine) (io.Closer, error)
+	// Unsupported lists the features the engine doesn't implement, their specs are skipped.
+	Unsupported []Feature
+	// BootTimeout bounds the time the machine takes to boot or reboot. Defaults to 5 minutes.
+	BootTimeout time.Duration
+}
+
+// Suite registers every conformance spec for the engine.
+func Suite(e Engine) bool {
+	return Lifecycle(e) && Machine(e)
+}
+
+func (e Engine) bootTimeout() time.Duration {
+	if e.BootTimeout == 0 {
+		return 5 * time.Minute
+	}
+	return e.BootTimeout
+}
+
+// skipUnavailable skips the specs if the engine can't run here.
+func (e Engine) skipUnavailable() {
+	if e.Available == nil {
+		return
+	}
+	if ok, reason := e.Available(); !ok {
+		Skip(reason)
+	}
+}
+
+// requires skips the spec if the engine doesn't support f.
+func (e Engine) requires(f Feature) {
+	for _, u := range e.Unsupported {
+		if u == f {
+			Skip(e.Name + " doesn't support " + string(f))
+		}
+	}
+}
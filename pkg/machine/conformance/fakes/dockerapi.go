@@ -0,0 +1,748 @@
+package fakes
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DockerAPIServer is a fake Docker Engine API, serving just enough of it for the docker and podman engines.
+// Containers only hold a state, commands executed in them run on the host, like every fake guest command.
+type DockerAPIServer struct {
+	socket   string
+	server   *http.Server
+	stateDir string
+	// network is the network containers are attached to by default
+	network string
+
+	sync.Mutex
+	containers map[string]*apiContainer
+	// images are the labels of the images, by name:tag
+	images map[string]map[string]string
+	// local are the repositories of committed images, which can't be pulled
+	local map[string]bool
+	execs map[string]*apiExec
+	ids   int
+}
+
+type apiContainer struct {
+	image      string
+	entrypoint []string
+	privileged bool
+	// hostConfig is the host config the container was created with
+	hostConfig map[string]interface{}
+	labels     map[string]string
+	status     string
+	exitCode   int
+	networks   map[string]bool
+	// pgids are the process groups of the commands running in the container
+	pgids map[int]bool
+}
+
+// shell tells whether the container runs the shell, and not an init, as entrypoint.
+func (c *apiContainer) shell() bool {
+	return len(c.entrypoint) == 0 || c.entrypoint[0] == "/bin/sh"
+}
+
+type apiExec struct {
+	container string
+	cmd       []string
+	env       []string
+	stdin     bool
+	running   bool
+	exitCode  int
+}
+
+// ServeDocker serves the fake API on a unix socket in the runtime directory of the fakes, like the daemon of
+// runtime, "docker" or "podman", does: the podman socket is podman/podman.sock in the directory.
+func (f *Fakes) ServeDocker(runtime string) (*DockerAPIServer, error) {
+	socket := filepath.Join(f.Dir, runtime, runtime+".sock")
+	if err := os.MkdirAll(filepath.Dir(socket), os.ModePerm); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &DockerAPIServer{
+		socket:     socket,
+		stateDir:   f.stateDir(),
+		network:    "bridge",
+		containers: map[string]*apiContainer{},
+		images:     map[string]map[string]string{},
+		local:      map[string]bool{},
+		execs:      map[string]*apiExec{},
+	}
+	if runtime == "podman" {
+		s.network = "podman"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /images/create", s.pull)
+	mux.HandleFunc("GET /images/json", s.listImages)
+	mux.HandleFunc("DELETE /images/{name...}", s.removeImage)
+	mux.HandleFunc("POST /commit", s.commit)
+	mux.HandleFunc("POST /containers/create", s.create)
+	mux.HandleFunc("GET /containers/{id}/json", s.inspect)
+	mux.HandleFunc("GET /containers/{id}/logs", s.logs)
+	mux.HandleFunc("DELETE /containers/{id}", s.remove)
+	mux.HandleFunc("POST /containers/{id}/exec", s.createExec)
+	mux.HandleFunc("POST /containers/{id}/{action}", s.action)
+	mux.HandleFunc("PUT /containers/{id}/archive", s.putArchive)
+	mux.HandleFunc("GET /containers/{id}/archive", s.getArchive)
+	mux.HandleFunc("POST /exec/{id}/start", s.startExec)
+	mux.HandleFunc("GET /exec/{id}/json", s.inspectExec)
+	mux.HandleFunc("POST /networks/{network}/{action}", s.connect)
+
+	s.server = &http.Server{Handler: stripAPIVersion(mux), ReadHeaderTimeout: 10 * time.Second}
+	go func() { _ = s.server.Serve(l) }()
+	return s, nil
+}
+
+// Host is the docker host of the server.
+func (s *DockerAPIServer) Host() string {
+	return "unix://" + s.socket
+}
+
+// Close stops the server, killing the commands still running in containers.
+func (s *DockerAPIServer) Close() error {
+	s.Lock()
+	for _, c := range s.containers {
+		c.kill()
+	}
+	s.Unlock()
+	err := s.server.Close()
+	_ = os.Remove(s.socket)
+	return err
+}
+
+// stripAPIVersion serves versioned paths, e.g. /v1.41/containers/json, like unversioned ones.
+func stripAPIVersion(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if version, rest, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/"); ok && strings.HasPrefix(version, "v") {
+			r.URL.Path = "/" + rest
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func apiError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	writeJSON(w, code, map[string]string{"message": fmt.Sprintf(format, args...)})
+}
+
+// imageName returns the name:tag of an image, tagged latest when it has no tag, like the daemon does but when pulling.
+func imageName(name string) string {
+	if i := strings.LastIndex(name, ":"); i < 0 || strings.Contains(name[i:], "/") {
+		return name + ":latest"
+	}
+	return name
+}
+
+// kill kills the commands running in the container. The lock must be held.
+func (c *apiContainer) kill() {
+	for pgid := range c.pgids {
+		_ = syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+	c.pgids = map[int]bool{}
+}
+
+// container returns the container of the request, or fails it. The lock must be held.
+func (s *DockerAPIServer) container(w http.ResponseWriter, r *http.Request) (*apiContainer, bool) {
+	c, ok := s.containers[r.PathValue("id")]
+	if !ok {
+		apiError(w, http.StatusNotFound, "No such container: %s", r.PathValue("id"))
+	}
+	return c, ok
+}
+
+func (s *DockerAPIServer) pull(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	name := r.URL.Query().Get("fromImage")
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		name += ":" + tag
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// errors are reported in the progress stream
+	if name != imageName(name) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("refusing to pull all the tags of %s", name)})
+		return
+	}
+	repo := name[:strings.LastIndex(name, ":")]
+	if s.local[repo] {
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("pull access denied for %s, repository does not exist", repo)})
+		return
+	}
+	if _, ok := s.images[name]; !ok {
+		s.images[name] = map[string]string{}
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "Pulling from " + repo})
+}
+
+func (s *DockerAPIServer) listImages(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	filters := map[string][]string{}
+	if f := r.URL.Query().Get("filters"); f != "" {
+		if err := json.Unmarshal([]byte(f), &filters); err != nil {
+			apiError(w, http.StatusBadRequest, "invalid filter: %s", err.Error())
+			return
+		}
+	}
+
+	images := []map[string]interface{}{}
+	for name, labels := range s.images {
+		matches := true
+		for _, l := range filters["label"] {
+			k, v, hasValue := strings.Cut(l, "=")
+			if got, ok := labels[k]; !ok || (hasValue && got != v) {
+				matches = false
+			}
+		}
+		if matches {
+			images = append(images, map[string]interface{}{"Id": "sha256:" + name, "RepoTags": []string{name}, "Labels": labels})
+		}
+	}
+	writeJSON(w, http.StatusOK, images)
+}
+
+func (s *DockerAPIServer) removeImage(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	name := imageName(r.PathValue("name"))
+	if _, ok := s.images[name]; !ok {
+		apiError(w, http.StatusNotFound, "No such image: %s", name)
+		return
+	}
+	delete(s.images, name)
+	writeJSON(w, http.StatusOK, []map[string]string{{"Untagged": name}})
+}
+
+func (s *DockerAPIServer) commit(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	q := r.URL.Query()
+	c, ok := s.containers[q.Get("container")]
+	if !ok {
+		apiError(w, http.StatusNotFound, "No such container: %s", q.Get("container"))
+		return
+	}
+	var config struct {
+		Labels map[string]string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil && err != io.EOF {
+		apiError(w, http.StatusBadRequest, "%s", err.Error())
+		return
+	}
+
+	// the image has the labels of the container, overridden by the given ones
+	labels := map[string]string{}
+	for k, v := range c.labels {
+		labels[k] = v
+	}
+	for k, v := range config.Labels {
+		labels[k] = v
+	}
+	tag := q.Get("tag")
+	if tag == "" {
+		tag = "latest"
+	}
+	s.images[q.Get("repo")+":"+tag] = labels
+	s.local[q.Get("repo")] = true
+	writeJSON(w, http.StatusCreated, map[string]string{"Id": "sha256:peg-fake"})
+}
+
+func (s *DockerAPIServer) create(w http.ResponseWriter, r *http.Request) {
+	var config struct {
+		Image      string
+		Entrypoint []string
+		Labels     map[string]string
+		HostConfig json.RawMessage
+	}
+	var hostConfig struct {
+		Privileged  bool
+		NetworkMode string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		apiError(w, http.StatusBadRequest, "%s", err.Error())
+		return
+	}
+	raw := map[string]interface{}{}
+	if len(config.HostConfig) != 0 {
+		if err := json.Unmarshal(config.HostConfig, &hostConfig); err != nil {
+			apiError(w, http.StatusBadRequest, "%s", err.Error())
+			return
+		}
+		_ = json.Unmarshal(config.HostConfig, &raw)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	id := r.URL.Query().Get("name")
+	if _, ok := s.containers[id]; ok {
+		apiError(w, http.StatusConflict, "Conflict. The container name \"/%s\" is already in use.", id)
+		return
+	}
+	if _, ok := s.images[imageName(config.Image)]; !ok {
+		apiError(w, http.StatusNotFound, "No such image: %s", imageName(config.Image))
+		return
+	}
+	network := s.network
+	if hostConfig.NetworkMode != "" && hostConfig.NetworkMode != "default" {
+		network = hostConfig.NetworkMode
+	}
+	s.containers[id] = &apiContainer{
+		image:      config.Image,
+		entrypoint: config.Entrypoint,
+		privileged: hostConfig.Privileged,
+		hostConfig: raw,
+		labels:     config.Labels,
+		status:     "created",
+		networks:   map[string]bool{network: true},
+		pgids:      map[int]bool{},
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"Id": id, "Warnings": []string{}})
+}
+
+// HostConfig returns the host config container id was created with, decoded from JSON.
+func (s *DockerAPIServer) HostConfig(id string) map[string]interface{} {
+	s.Lock()
+	defer s.Unlock()
+	if c, ok := s.containers[id]; ok {
+		return c.hostConfig
+	}
+	return nil
+}
+
+func (s *DockerAPIServer) inspect(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	c, ok := s.container(w, r)
+	if !ok {
+		return
+	}
+	networks := map[string]interface{}{}
+	for n := range c.networks {
+		networks[n] = map[string]string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"Id":              r.PathValue("id"),
+		"State":           map[string]interface{}{"Status": c.status, "ExitCode": c.exitCode, "Running": c.status == "running", "Paused": c.status == "paused"},
+		"NetworkSettings": map[string]interface{}{"Networks": networks},
+		"Config":          map[string]interface{}{"Image": c.image, "Labels": c.labels},
+		"HostConfig":      c.hostConfig,
+	})
+}
+
+func (s *DockerAPIServer) logs(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	_, ok := s.container(w, r)
+	s.Unlock()
+	if !ok {
+		return
+	}
+	// containers run with a TTY, their output isn't multiplexed
+	w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+	_, _ = io.WriteString(w, console)
+}
+
+func (s *DockerAPIServer) remove(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	c, ok := s.container(w, r)
+	if !ok {
+		return
+	}
+	if c.status == "running" && r.URL.Query().Get("force") != "1" && r.URL.Query().Get("force") != "true" {
+		apiError(w, http.StatusConflict, "You cannot remove a running container %s. Stop the container before attempting removal or force remove", r.PathValue("id"))
+		return
+	}
+	c.kill()
+	delete(s.containers, r.PathValue("id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// action starts, stops, restarts, pauses or unpauses a container.
+func (s *DockerAPIServer) action(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	c, ok := s.container(w, r)
+	if !ok {
+		return
+	}
+	id := r.PathValue("id")
+	switch r.PathValue("action") {
+	case "start":
+		if c.status == "running" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		s.boot(c)
+	case "stop", "kill":
+		if c.status != "running" && c.status != "paused" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		c.kill()
+		c.status, c.exitCode = "exited", 0
+		// the entrypoint shell ignores SIGTERM as pid 1, it is killed once the timeout expires
+		if r.PathValue("action") == "kill" || r.URL.Query().Get("t") == "0" || c.shell() {
+			c.exitCode = 137
+		}
+	case "restart":
+		c.kill()
+		s.boot(c)
+	case "pause":
+		if c.status != "running" {
+			apiError(w, http.StatusConflict, "Container %s is not running", id)
+			return
+		}
+		c.status = "paused"
+	case "unpause":
+		if c.status != "paused" {
+			apiError(w, http.StatusConflict, "Container %s is not paused", id)
+			return
+		}
+		c.status = "running"
+	default:
+		apiError(w, http.StatusNotFound, "%s", "page not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// boot runs the container. Inits other than a shell can't mount what they need unprivileged, and exit.
+func (s *DockerAPIServer) boot(c *apiContainer) {
+	c.status, c.exitCode = "running", 0
+	if len(c.entrypoint) != 0 && c.entrypoint[0] != "/bin/sh" && !c.privileged {
+		c.status, c.exitCode = "exited", 1
+	}
+}
+
+// putArchive extracts the files of a tar archive to the directory given as path, with their permissions.
+func (s *DockerAPIServer) putArchive(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	_, ok := s.container(w, r)
+	s.Unlock()
+	if !ok {
+		return
+	}
+	dir := r.URL.Query().Get("path")
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		apiError(w, http.StatusNotFound, "Could not find the file %s in container %s", dir, r.PathValue("id"))
+		return
+	}
+
+	tr := tar.NewReader(r.Body)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "invalid archive: %s", err.Error())
+			return
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := extract(tr, filepath.Join(dir, h.Name), os.FileMode(h.Mode).Perm()); err != nil {
+			apiError(w, http.StatusInternalServerError, "%s", err.Error())
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func extract(r io.Reader, dst string, mode os.FileMode) error {
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// not masked by the umask
+	return os.Chmod(dst, mode)
+}
+
+// getArchive returns a tar archive of the file given as path.
+func (s *DockerAPIServer) getArchive(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	_, ok := s.container(w, r)
+	s.Unlock()
+	if !ok {
+		return
+	}
+	src := r.URL.Query().Get("path")
+	f, err := os.Open(src)
+	if err != nil {
+		apiError(w, http.StatusNotFound, "Could not find the file %s in container %s", src, r.PathValue("id"))
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "%s", err.Error())
+		return
+	}
+	h, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "%s", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(h); err != nil {
+		return
+	}
+	if info.Mode().IsRegular() {
+		if _, err := io.Copy(tw, f); err != nil {
+			return
+		}
+	}
+	_ = tw.Close()
+}
+
+func (s *DockerAPIServer) createExec(w http.ResponseWriter, r *http.Request) {
+	var config struct {
+		Cmd         []string
+		Env         []string
+		AttachStdin bool
+	}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		apiError(w, http.StatusBadRequest, "%s", err.Error())
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	c, ok := s.container(w, r)
+	if !ok {
+		return
+	}
+	id := r.PathValue("id")
+	switch c.status {
+	case "running":
+	case "paused":
+		apiError(w, http.StatusConflict, "Container %s is paused, unpause the container before exec", id)
+		return
+	default:
+		apiError(w, http.StatusConflict, "Container %s is not running", id)
+		return
+	}
+	if len(config.Cmd) == 0 {
+		apiError(w, http.StatusBadRequest, "No exec command specified")
+		return
+	}
+
+	s.ids++
+	execID := fmt.Sprintf("exec-%d", s.ids)
+	s.execs[execID] = &apiExec{container: id, cmd: config.Cmd, env: config.Env, stdin: config.AttachStdin}
+	writeJSON(w, http.StatusCreated, map[string]string{"Id": execID})
+}
+
+func (s *DockerAPIServer) inspectExec(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	e, ok := s.execs[r.PathValue("id")]
+	if !ok {
+		apiError(w, http.StatusNotFound, "No such exec instance: %s", r.PathValue("id"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"Running": e.running, "ExitCode": e.exitCode})
+}
+
+// muxWriter writes the output of a stream of a command in frames, multiplexed with the other streams.
+type muxWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (m *muxWriter) stream(stream byte) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		m.Lock()
+		defer m.Unlock()
+		header := []byte{stream, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(header[4:], uint32(len(p)))
+		if _, err := m.w.Write(append(header, p...)); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// startExec runs a command on the host, streaming its input and output over the hijacked connection like docker.
+func (s *DockerAPIServer) startExec(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	e, ok := s.execs[r.PathValue("id")]
+	var c *apiContainer
+	if ok {
+		c = s.containers[e.container]
+	}
+	s.Unlock()
+	if !ok || c == nil {
+		apiError(w, http.StatusNotFound, "No such exec instance: %s", r.PathValue("id"))
+		return
+	}
+
+	// the start options are read before hijacking, they would be taken as stdin otherwise
+	var start struct {
+		Detach bool
+	}
+	if err := json.NewDecoder(r.Body).Decode(&start); err != nil && err != io.EOF {
+		apiError(w, http.StatusBadRequest, "%s", err.Error())
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "%s", err.Error())
+		return
+	}
+	defer conn.Close()
+	_, _ = io.WriteString(rw, "HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	cmd := exec.Command(e.cmd[0], e.cmd[1:]...)
+	cmd.Env = append(guestEnv(s.stateDir), e.env...)
+	cmd.Dir = "/"
+	// the whole process group is killed with the container, so children don't keep the output open
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	out := &muxWriter{w: conn}
+	cmd.Stdout, cmd.Stderr = out.stream(1), out.stream(2)
+	var stdin io.WriteCloser
+	if e.stdin {
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			_, _ = out.stream(3).Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	s.Lock()
+	err = cmd.Start()
+	if err == nil {
+		e.running = true
+		c.pgids[cmd.Process.Pid] = true
+	} else {
+		// like runc failing to exec the command
+		e.exitCode = 126
+	}
+	s.Unlock()
+	if err != nil {
+		_, _ = out.stream(2).Write([]byte(fmt.Sprintf("OCI runtime exec failed: %s\n", err.Error())))
+		return
+	}
+	pgid := cmd.Process.Pid
+
+	go func() {
+		if stdin != nil {
+			_, _ = io.Copy(stdin, rw.Reader)
+			stdin.Close()
+			return
+		}
+		// like with the daemon, the command keeps running when the client goes away
+		_, _ = io.Copy(io.Discard, bufio.NewReader(rw.Reader))
+	}()
+
+	err = cmd.Wait()
+	s.Lock()
+	delete(c.pgids, pgid)
+	e.running, e.exitCode = false, exitCode(err)
+	s.Unlock()
+}
+
+// exitCode returns the exit code of a command. Like with docker, commands killed by a signal exit with 128+signal.
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		if err != nil {
+			return 126
+		}
+		return 0
+	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return exitErr.ExitCode()
+}
+
+// connect connects a container to a network, or disconnects it.
+func (s *DockerAPIServer) connect(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Container string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		apiError(w, http.StatusBadRequest, "%s", err.Error())
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	network := r.PathValue("network")
+	if network != s.network && network != "host" && network != "none" {
+		apiError(w, http.StatusNotFound, "network %s not found", network)
+		return
+	}
+	c, ok := s.containers[body.Container]
+	if !ok {
+		apiError(w, http.StatusNotFound, "No such container: %s", body.Container)
+		return
+	}
+	switch r.PathValue("action") {
+	case "connect":
+		if c.networks[network] {
+			apiError(w, http.StatusForbidden, "endpoint with name %s already exists in network %s", body.Container, network)
+			return
+		}
+		c.networks[network] = true
+	case "disconnect":
+		if !c.networks[network] {
+			apiError(w, http.StatusForbidden, "container %s is not connected to network %s", body.Container, network)
+			return
+		}
+		delete(c.networks, network)
+	default:
+		apiError(w, http.StatusNotFound, "%s", "page not found")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,170 @@
+// Package fakes stands in for the qemu-system-x86_64, qemu-img, VBoxManage and nerdctl executables, for the
+// docker, podman and kubernetes API servers and for the guest SSH server, so machine engines can be exercised
+// without any hypervisor.
+//
+// The fake executables are the test binary itself: Install writes wrapper scripts running it again
+// with PEG_FAKE set, and Run, called first thing in TestMain, turns the process into the named fake.
+// Guests are the host: commands run on it with the guest directory first in PATH, where sudo, reboot,
+// ip and tc are replaced by harmless scripts.
+package fakes
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	envFake  = "PEG_FAKE"
+	envState = "PEG_FAKE_STATE"
+)
+
+var fakes = map[string]func(args []string) int{
+	"qemu-system-x86_64": qemuSystem,
+	"qemu-img":           qemuImg,
+	"VBoxManage":         vboxManage,
+	"nerdctl":            nerdctl,
+}
+
+// guestScripts replace the guest commands that would otherwise change the host.
+var guestScripts = map[string]string{
+	"sudo":     `exec "$@"`,
+	"reboot":   `echo "fake reboot" >&2`,
+	"poweroff": `echo "fake poweroff" >&2`,
+	"systemctl": `case "$1" in
+  is-system-running) echo running ;;
+  *) echo "systemctl $*" >> "$(dirname "$0")/systemctl.log" ;;
+esac`,
+	"rc-status": `echo default`,
+	"tc":        `echo "tc $*" >> "$(dirname "$0")/tc.log"`,
+	"kill":      `echo "kill $*" >> "$(dirname "$0")/kill.log"`,
+	"ip": `case "$*" in
+  *"addr show"*) echo "2: eth0    inet 10.0.2.15/24 brd 10.0.2.255 scope global eth0" ;;
+  *) echo "ip $*" >> "$(dirname "$0")/ip.log" ;;
+esac`,
+}
+
+// Run turns the process into the fake named by PEG_FAKE, if any, and exits with its exit code.
+func Run() {
+	name := os.Getenv(envFake)
+	if name == "" {
+		return
+	}
+	f, ok := fakes[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown fake %s\n", name)
+		os.Exit(127)
+	}
+	os.Exit(f(os.Args[1:]))
+}
+
+// Fakes are fake executables installed in a directory.
+type Fakes struct {
+	Dir string
+}
+
+// Install writes the fake executables and guest scripts in dir. The state of the fakes is kept in dir too.
+func Install(dir string) (*Fakes, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	f := &Fakes{Dir: dir}
+	for _, d := range []string{f.stateDir(), f.GuestPath()} {
+		if err := os.MkdirAll(d, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+
+	for name := range fakes {
+		script := fmt.Sprintf("#!/bin/sh\n%s=%s %s=%s exec %s \"$@\"\n", envFake, name, envState, quote(f.stateDir()), quote(exe))
+		if err := os.WriteFile(f.Bin(name), []byte(script), 0755); err != nil {
+			return nil, err
+		}
+	}
+	for name, body := range guestScripts {
+		if err := os.WriteFile(filepath.Join(f.GuestPath(), name), []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Bin returns the path of the named fake executable.
+func (f *Fakes) Bin(name string) string {
+	return filepath.Join(f.Dir, name)
+}
+
+// GuestPath is the directory to put first in the PATH of guest commands.
+func (f *Fakes) GuestPath() string {
+	return guestPath(f.stateDir())
+}
+
+func (f *Fakes) stateDir() string {
+	return filepath.Join(f.Dir, "state")
+}
+
+func guestPath(stateDir string) string {
+	return filepath.Join(filepath.Dir(stateDir), "guest")
+}
+
+// guestEnv is the environment of guest commands.
+func guestEnv(stateDir string) []string {
+	env := []string{}
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, envFake+"=") || strings.HasPrefix(e, envState+"=") || strings.HasPrefix(e, "PATH=") {
+			continue
+		}
+		env = append(env, e)
+	}
+	return append(env, "PATH="+guestPath(stateDir)+":"+os.Getenv("PATH"))
+}
+
+// load reads the JSON state of a fake object, and tells whether it exists.
+func load(path string, v interface{}) (bool, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(b, v)
+}
+
+func save(path string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+func fail(format string, args ...interface{}) int {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	return 1
+}
+
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// png is a 1x1 image, what fake screenshots are.
+var png = []byte{
+	0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d, 0x49, 0x48, 0x44, 0x52,
+	0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x08, 0x06, 0x00, 0x00, 0x00, 0x1f, 0x15, 0xc4,
+	0x89, 0x00, 0x00, 0x00, 0x0d, 0x49, 0x44, 0x41, 0x54, 0x78, 0x9c, 0x63, 0x00, 0x01, 0x00, 0x00,
+	0x05, 0x00, 0x01, 0x0d, 0x0a, 0x2d, 0xb4, 0x00, 0x00, 0x00, 0x00, 0x49, 0x45, 0x4e, 0x44, 0xae,
+	0x42, 0x60, 0x82,
+}
+
+// ppm is a 1x1 image, what fake screendumps of QEMU before 7.1 are.
+var ppm = []byte("P6\n1 1\n255\n\x00\x80\xff")
+
+// console is what fake guests print on their console while booting.
+const console = "peg fake guest\nWelcome\nlogin: "
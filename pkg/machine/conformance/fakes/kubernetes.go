@@ -0,0 +1,604 @@
+package fakes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	"k8s.io/apimachinery/pkg/util/remotecommand"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// KubeAPIServer is a fake kubernetes API server, serving just enough of the pods API for the kubernetes engine,
+// and of the nodes and discovery APIs for the cluster matchers.
+// Pods run as soon as they are created and their exec commands run on the host, like every fake guest command.
+type KubeAPIServer struct {
+	listener net.Listener
+	server   *http.Server
+	stateDir string
+	dir      string
+
+	sync.Mutex
+	pods map[string]*corev1.Pod
+	// execs are the process groups of the commands running in each pod
+	execs map[string]map[int]bool
+	nodes map[string]*corev1.Node
+	// graces are the grace periods pods were deleted with, by namespace/name
+	graces map[string]*int64
+	// objects are the resources of the other types, by resource/namespace/name
+	objects map[string]map[string]interface{}
+}
+
+// kubeResource is a type of resource the fake API server knows of.
+type kubeResource struct {
+	groupVersion string
+	kind         string
+	namespaced   bool
+	shortNames   []string
+}
+
+var kubeResources = map[string]kubeResource{
+	"pods":        {groupVersion: "v1", kind: "Pod", namespaced: true, shortNames: []string{"po"}},
+	"nodes":       {groupVersion: "v1", kind: "Node", shortNames: []string{"no"}},
+	"namespaces":  {groupVersion: "v1", kind: "Namespace", shortNames: []string{"ns"}},
+	"configmaps":  {groupVersion: "v1", kind: "ConfigMap", namespaced: true, shortNames: []string{"cm"}},
+	"deployments": {groupVersion: "apps/v1", kind: "Deployment", namespaced: true, shortNames: []string{"deploy"}},
+}
+
+// ServeKubernetes serves the fake API server on a local port.
+func (f *Fakes) ServeKubernetes() (*KubeAPIServer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &KubeAPIServer{
+		listener: l,
+		stateDir: f.stateDir(),
+		dir:      f.Dir,
+		pods:     map[string]*corev1.Pod{},
+		execs:    map[string]map[int]bool{},
+		nodes:    map[string]*corev1.Node{},
+		graces:   map[string]*int64{},
+		objects:  map[string]map[string]interface{}{},
+	}
+	s.server = &http.Server{Handler: http.HandlerFunc(s.handle), ReadHeaderTimeout: 10 * time.Second}
+	go func() { _ = s.server.Serve(l) }()
+	return s, nil
+}
+
+// URL is the address of the API server.
+func (s *KubeAPIServer) URL() string {
+	return "http://" + s.listener.Addr().String()
+}
+
+// Kubeconfig writes a kubeconfig for the server, with peg as the namespace, and returns its path.
+func (s *KubeAPIServer) Kubeconfig() (string, error) {
+	path := filepath.Join(s.dir, "kubeconfig")
+	config := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: fake
+  cluster:
+    server: %s
+users:
+- name: peg
+  user:
+    token: peg
+contexts:
+- name: fake
+  context:
+    cluster: fake
+    user: peg
+    namespace: peg
+current-context: fake
+`, s.URL())
+	return path, os.WriteFile(path, []byte(config), 0600)
+}
+
+// Close stops the server, killing the commands still running in pods.
+func (s *KubeAPIServer) Close() error {
+	s.Lock()
+	for key := range s.pods {
+		s.kill(key)
+	}
+	s.Unlock()
+	return s.server.Close()
+}
+
+// AddNode adds a node to the cluster, ready or not.
+func (s *KubeAPIServer) AddNode(name string, ready bool) {
+	condition := corev1.ConditionFalse
+	if ready {
+		condition = corev1.ConditionTrue
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.nodes[name] = &corev1.Node{
+		TypeMeta:   metav1.TypeMeta{Kind: "Node", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status:     corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: condition}}},
+	}
+}
+
+// AddPod adds a pod as it is, without running it.
+func (s *KubeAPIServer) AddPod(pod *corev1.Pod) {
+	pod.TypeMeta = metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}
+	s.Lock()
+	defer s.Unlock()
+	s.pods[pod.Namespace+"/"+pod.Name] = pod
+}
+
+// AddResource adds a resource of one of the other types the server knows of, e.g. "deployments".
+// The namespace is ignored for cluster-wide resources.
+func (s *KubeAPIServer) AddResource(resource, namespace, name string) error {
+	t, ok := kubeResources[resource]
+	if !ok {
+		return fmt.Errorf("unknown resource type %s", resource)
+	}
+	metadata := map[string]interface{}{"name": name}
+	if !t.namespaced {
+		namespace = ""
+	} else {
+		metadata["namespace"] = namespace
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.objects[resource+"/"+namespace+"/"+name] = map[string]interface{}{"apiVersion": t.groupVersion, "kind": t.kind, "metadata": metadata}
+	return nil
+}
+
+func (s *KubeAPIServer) handle(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	if d, ok := discovery(path); ok && r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, d)
+		return
+	}
+
+	// /api/v1[/namespaces/{namespace}]/{resource}[/{name}[/{subresource}]], or /apis/{group}/{version}/...
+	parts := strings.Split(path, "/")
+	groupVersion := ""
+	switch {
+	case len(parts) > 2 && parts[0] == "api":
+		groupVersion, parts = parts[1], parts[2:]
+	case len(parts) > 3 && parts[0] == "apis":
+		groupVersion, parts = parts[1]+"/"+parts[2], parts[3:]
+	}
+	namespace := ""
+	if len(parts) > 2 && parts[0] == "namespaces" {
+		namespace, parts = parts[1], parts[2:]
+	}
+	t, ok := kubeResources[parts[0]]
+	if !ok || t.groupVersion != groupVersion || t.namespaced != (namespace != "") {
+		status(w, http.StatusNotFound, metav1.StatusReasonNotFound, "the server could not find the requested resource")
+		return
+	}
+
+	switch parts[0] {
+	case "pods":
+		s.handlePods(w, r, namespace, parts[1:])
+	case "nodes":
+		s.handleNodes(w, r, parts[1:])
+	default:
+		s.handleObjects(w, r, parts[0], namespace, parts[1:])
+	}
+}
+
+// discovery returns the discovery document at path, if it is one.
+func discovery(path string) (interface{}, bool) {
+	switch path {
+	case "version":
+		return map[string]string{"major": "1", "minor": "31", "gitVersion": "v1.31.0"}, true
+	case "api":
+		return &metav1.APIVersions{TypeMeta: metav1.TypeMeta{Kind: "APIVersions"}, Versions: []string{"v1"}}, true
+	case "apis":
+		apps := metav1.GroupVersionForDiscovery{GroupVersion: "apps/v1", Version: "v1"}
+		return &metav1.APIGroupList{
+			TypeMeta: metav1.TypeMeta{Kind: "APIGroupList", APIVersion: "v1"},
+			Groups:   []metav1.APIGroup{{Name: "apps", Versions: []metav1.GroupVersionForDiscovery{apps}, PreferredVersion: apps}},
+		}, true
+	case "api/v1", "apis/apps/v1":
+		groupVersion := strings.TrimPrefix(strings.TrimPrefix(path, "apis/"), "api/")
+		list := &metav1.APIResourceList{TypeMeta: metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"}, GroupVersion: groupVersion}
+		for name, t := range kubeResources {
+			if t.groupVersion != groupVersion {
+				continue
+			}
+			list.APIResources = append(list.APIResources, metav1.APIResource{
+				Name:         name,
+				SingularName: strings.ToLower(t.kind),
+				Namespaced:   t.namespaced,
+				Kind:         t.kind,
+				Verbs:        metav1.Verbs{"get", "list"},
+				ShortNames:   t.shortNames,
+			})
+		}
+		return list, true
+	}
+	return nil, false
+}
+
+func (s *KubeAPIServer) handlePods(w http.ResponseWriter, r *http.Request, namespace string, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		s.create(w, r, namespace)
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		s.list(w, r, namespace)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.get(w, namespace, parts[0])
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		s.delete(w, r, namespace, parts[0])
+	case len(parts) == 2 && parts[1] == "log" && r.Method == http.MethodGet:
+		s.logs(w, namespace, parts[0])
+	case len(parts) == 2 && parts[1] == "exec":
+		s.exec(w, r, namespace, parts[0])
+	default:
+		notAllowed(w)
+	}
+}
+
+// list lists the pods of namespace matching the label selector.
+func (s *KubeAPIServer) list(w http.ResponseWriter, r *http.Request, namespace string) {
+	selector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+	if err != nil {
+		status(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	list := &corev1.PodList{TypeMeta: metav1.TypeMeta{Kind: "PodList", APIVersion: "v1"}}
+	for _, pod := range s.pods {
+		if pod.Namespace == namespace && selector.Matches(labels.Set(pod.Labels)) {
+			list.Items = append(list.Items, *pod)
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *KubeAPIServer) handleNodes(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodGet || len(parts) > 1 {
+		notAllowed(w)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if len(parts) == 1 {
+		node, ok := s.nodes[parts[0]]
+		if !ok {
+			status(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("nodes %q not found", parts[0]))
+			return
+		}
+		writeJSON(w, http.StatusOK, node)
+		return
+	}
+	list := &corev1.NodeList{TypeMeta: metav1.TypeMeta{Kind: "NodeList", APIVersion: "v1"}}
+	for _, node := range s.nodes {
+		list.Items = append(list.Items, *node)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleObjects serves the resources of the other types, which can only be read one by one.
+func (s *KubeAPIServer) handleObjects(w http.ResponseWriter, r *http.Request, resource, namespace string, parts []string) {
+	if r.Method != http.MethodGet || len(parts) != 1 {
+		notAllowed(w)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	obj, ok := s.objects[resource+"/"+namespace+"/"+parts[0]]
+	if !ok {
+		status(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("%s %q not found", resource, parts[0]))
+		return
+	}
+	writeJSON(w, http.StatusOK, obj)
+}
+
+func (s *KubeAPIServer) create(w http.ResponseWriter, r *http.Request, namespace string) {
+	// clients send protobuf or JSON
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		status(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+		return
+	}
+	obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(body, nil, nil)
+	if err != nil {
+		status(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+		return
+	}
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		status(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("expected a pod, got %T", obj))
+		return
+	}
+	if pod.Name == "" {
+		status(w, http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "Pod \"\" is invalid: metadata.name: Required value: name or generateName is required")
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	key := namespace + "/" + pod.Name
+	if _, ok := s.pods[key]; ok {
+		status(w, http.StatusConflict, metav1.StatusReasonAlreadyExists, fmt.Sprintf("pods %q already exists", pod.Name))
+		return
+	}
+	pod.TypeMeta = metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}
+	pod.Namespace = namespace
+	pod.CreationTimestamp = metav1.Now()
+	pod.UID = ktypes.UID("fake-" + strconv.FormatInt(time.Now().UnixNano(), 10))
+	// the pod runs once it is seen pending
+	pod.Status.Phase = corev1.PodPending
+	s.pods[key] = pod
+	writeJSON(w, http.StatusCreated, pod)
+}
+
+func (s *KubeAPIServer) get(w http.ResponseWriter, namespace, name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	pod, ok := s.pods[namespace+"/"+name]
+	if !ok {
+		notFound(w, name)
+		return
+	}
+	writeJSON(w, http.StatusOK, pod)
+	if pod.Status.Phase == corev1.PodPending {
+		pod.Status.Phase = corev1.PodRunning
+		pod.Status.PodIP = "10.0.2.15"
+	}
+}
+
+func (s *KubeAPIServer) delete(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	// clients send the options as protobuf or JSON
+	var grace *int64
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		status(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+		return
+	}
+	if len(body) != 0 {
+		obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(body, nil, nil)
+		if err != nil {
+			status(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+			return
+		}
+		if opts, ok := obj.(*metav1.DeleteOptions); ok {
+			grace = opts.GracePeriodSeconds
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	key := namespace + "/" + name
+	pod, ok := s.pods[key]
+	if !ok {
+		notFound(w, name)
+		return
+	}
+	s.graces[key] = grace
+	s.kill(key)
+	delete(s.pods, key)
+	writeJSON(w, http.StatusOK, pod)
+}
+
+func (s *KubeAPIServer) logs(w http.ResponseWriter, namespace, name string) {
+	s.Lock()
+	_, ok := s.pods[namespace+"/"+name]
+	s.Unlock()
+	if !ok {
+		notFound(w, name)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = io.WriteString(w, console)
+}
+
+// GracePeriod returns the grace period the named pod was last deleted with, nil for the default one.
+func (s *KubeAPIServer) GracePeriod(namespace, name string) *int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.graces[namespace+"/"+name]
+}
+
+// kill kills the commands running in the pod. The lock must be held.
+func (s *KubeAPIServer) kill(key string) {
+	for pgid := range s.execs[key] {
+		_ = syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+	delete(s.execs, key)
+}
+
+// exec runs a command of the pod, streaming its input and output over SPDY like the kubelet does.
+func (s *KubeAPIServer) exec(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	key := namespace + "/" + name
+	s.Lock()
+	pod, ok := s.pods[key]
+	running := ok && pod.Status.Phase == corev1.PodRunning
+	s.Unlock()
+	if !ok {
+		notFound(w, name)
+		return
+	}
+	if !running {
+		status(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("pod %s is not running", name))
+		return
+	}
+
+	q := r.URL.Query()
+	command := q["command"]
+	if len(command) == 0 {
+		status(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, "you must specify at least 1 command")
+		return
+	}
+	enabled := func(k string) bool {
+		v := q.Get(k)
+		return v == "true" || v == "1"
+	}
+	expected := map[string]bool{"error": true, "stdin": enabled("stdin"), "stdout": enabled("stdout"), "stderr": enabled("stderr")}
+
+	if _, err := httpstream.Handshake(r, w, []string{remotecommand.StreamProtocolV4Name}); err != nil {
+		return
+	}
+	streams := make(chan httpstream.Stream, 4)
+	conn := spdy.NewResponseUpgrader().UpgradeResponse(w, r, func(stream httpstream.Stream, _ <-chan struct{}) error {
+		streams <- stream
+		return nil
+	})
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	byType := map[string]httpstream.Stream{}
+	wanted := 0
+	for _, ok := range expected {
+		if ok {
+			wanted++
+		}
+	}
+	timeout := time.After(30 * time.Second)
+	for len(byType) < wanted {
+		select {
+		case stream := <-streams:
+			byType[stream.Headers().Get("streamType")] = stream
+		case <-timeout:
+			return
+		}
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = guestEnv(s.stateDir)
+	cmd.Dir = "/"
+	// the whole process group is killed, so children don't keep the output open
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if stream, ok := byType["stdout"]; ok {
+		cmd.Stdout = stream
+	}
+	if stream, ok := byType["stderr"]; ok {
+		cmd.Stderr = stream
+	}
+	var stdin io.WriteCloser
+	if _, ok := byType["stdin"]; ok {
+		var err error
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			writeExecStatus(byType["error"], err)
+			return
+		}
+	}
+
+	if err := cmd.Start(); err != nil {
+		writeExecStatus(byType["error"], err)
+		return
+	}
+	pgid := cmd.Process.Pid
+	s.Lock()
+	if s.execs[key] == nil {
+		s.execs[key] = map[int]bool{}
+	}
+	s.execs[key][pgid] = true
+	s.Unlock()
+
+	if stdin != nil {
+		go func() {
+			_, _ = io.Copy(stdin, byType["stdin"])
+			stdin.Close()
+		}()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		s.Lock()
+		delete(s.execs[key], pgid)
+		s.Unlock()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		for _, t := range []string{"stdout", "stderr"} {
+			if stream, ok := byType[t]; ok {
+				stream.Close()
+			}
+		}
+		writeExecStatus(byType["error"], err)
+	case <-conn.CloseChan():
+		// like with the kubelet, the command keeps running when the client goes away, until the pod is deleted
+	}
+}
+
+// writeExecStatus reports how a command ended, as a status on the error stream.
+func writeExecStatus(stream httpstream.Stream, err error) {
+	st := metav1.Status{Status: metav1.StatusSuccess}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		code := exitErr.ExitCode()
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			// like a container runtime, commands killed by a signal exit with 128+signal
+			code = 128 + int(ws.Signal())
+		}
+		st = metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  remotecommand.NonZeroExitCodeReason,
+			Message: fmt.Sprintf("command terminated with non-zero exit code: exit status %d", code),
+			Details: &metav1.StatusDetails{Causes: []metav1.StatusCause{{
+				Type:    remotecommand.ExitCodeCauseType,
+				Message: strconv.Itoa(code),
+			}}},
+		}
+	default:
+		st = metav1.Status{Status: metav1.StatusFailure, Message: err.Error()}
+	}
+	b, _ := json.Marshal(st)
+	_, _ = stream.Write(b)
+	stream.Close()
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func notAllowed(w http.ResponseWriter) {
+	status(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "the server does not allow this method on the requested resource")
+}
+
+func notFound(w http.ResponseWriter, name string) {
+	status(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("pods %q not found", name))
+}
+
+func status(w http.ResponseWriter, code int, reason metav1.StatusReason, message string) {
+	writeJSON(w, code, &metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  message,
+		Reason:   reason,
+		Code:     int32(code),
+		Details:  &metav1.StatusDetails{Kind: "pods"},
+	})
+}
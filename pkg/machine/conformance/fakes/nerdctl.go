@@ -0,0 +1,327 @@
+package fakes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+type container struct {
+	Status   string
+	ExitCode int
+	Image    string
+	Networks map[string]bool
+	// Shell is set when the entrypoint is the shell, and not an init
+	Shell bool
+}
+
+// nerdctlValueFlags are the flags of nerdctl commands taking a value.
+var nerdctlValueFlags = map[string]bool{
+	"-p": true, "--publish": true, "--name": true, "--entrypoint": true, "-v": true, "--volume": true,
+	"-e": true, "--env": true, "--network": true, "--cap-add": true, "--tmpfs": true, "--cgroupns": true,
+	"--time": true, "--format": true, "-u": true, "--user": true, "-w": true, "--workdir": true,
+	"--label": true, "-l": true, "--hostname": true, "--security-opt": true, "--stop-signal": true,
+}
+
+// takesValue tells whether flag a of nerdctl cmd takes a value. -t and -f are booleans for some commands.
+func takesValue(cmd, a string) bool {
+	switch a {
+	case "-t":
+		return cmd == "stop" || cmd == "restart"
+	case "-f":
+		return cmd == "inspect"
+	}
+	return cmd != "exec" && nerdctlValueFlags[a]
+}
+
+// nerdctl fakes the nerdctl CLI, which has no API the docker engine could drive instead.
+// Containers only hold a state, commands executed in them run on the host.
+func nerdctl(args []string) int {
+	if len(args) == 0 {
+		return fail("missing command")
+	}
+	if args[0] == "container" && len(args) > 1 {
+		args = args[1:]
+	}
+	d := nerdctlState(os.Getenv(envState))
+
+	cmd, flags, positional := args[0], map[string]string{}, []string{}
+	rest := args[1:]
+	for i := 0; i < len(rest); i++ {
+		a := rest[i]
+		// commands run by exec and the image of run come after the container or image positional argument
+		if (cmd == "exec" && len(positional) == 1) || (cmd == "run" && len(positional) == 1) {
+			positional = append(positional, rest[i:]...)
+			break
+		}
+		switch {
+		case strings.HasPrefix(a, "-") && strings.Contains(a, "="):
+			k, v, _ := strings.Cut(a, "=")
+			flags[k] = v
+		case takesValue(cmd, a) && i+1 < len(rest):
+			flags[a] = rest[i+1]
+			i++
+		case strings.HasPrefix(a, "-"):
+			flags[a] = "true"
+		default:
+			positional = append(positional, a)
+		}
+	}
+
+	switch cmd {
+	case "info":
+		fmt.Println("Server Version: peg-fake")
+		return 0
+	case "run":
+		return d.run(flags, positional)
+	case "images":
+		return d.images(positional)
+	case "rmi":
+		return d.rmi(positional)
+	case "cp", "network":
+		// like nerdctl before v0.22
+		return fail("nerdctl: unknown command %q for \"nerdctl\"", cmd)
+	}
+
+	if len(positional) == 0 {
+		return fail("\"nerdctl %s\" requires at least 1 argument.", cmd)
+	}
+	id := positional[0]
+	c := &container{}
+	exists, err := load(d.container(id), c)
+	if err != nil {
+		return fail(err.Error())
+	}
+	if !exists {
+		if cmd == "rm" && flags["-f"] != "" {
+			return 0
+		}
+		return noSuchContainer(id)
+	}
+
+	switch cmd {
+	case "inspect":
+		return d.inspect(c, flags["-f"]+flags["--format"])
+	case "exec":
+		return d.exec(id, c, flags, positional[1:])
+	case "logs":
+		fmt.Print(console)
+		return 0
+	case "stop", "kill":
+		if c.Status == "running" || c.Status == "paused" {
+			c.Status, c.ExitCode = "exited", 0
+			// the entrypoint shell ignores SIGTERM as pid 1, it is killed once the timeout expires
+			if cmd == "kill" || flags["-t"] == "0" || c.Shell {
+				c.ExitCode = 137
+			}
+		}
+	case "restart":
+		c.Status, c.ExitCode = "running", 0
+	case "pause":
+		if c.Status != "running" {
+			return fail("Error response from daemon: Container %s is not running", id)
+		}
+		c.Status = "paused"
+	case "unpause":
+		if c.Status != "paused" {
+			return fail("Error response from daemon: Container %s is not paused", id)
+		}
+		c.Status = "running"
+	case "rm":
+		if c.Status == "running" && flags["-f"] == "" {
+			return fail("Error response from daemon: You cannot remove a running container %s. Stop the container before attempting removal or force remove", id)
+		}
+		if err := os.Remove(d.container(id)); err != nil {
+			return fail(err.Error())
+		}
+		fmt.Println(id)
+		return 0
+	case "commit":
+		if len(positional) != 2 {
+			return fail("\"nerdctl commit\" requires 2 arguments.")
+		}
+		repo, _, _ := strings.Cut(positional[1], ":")
+		if err := save(d.local(repo), true); err != nil {
+			return fail(err.Error())
+		}
+		if err := d.addImage(positional[1]); err != nil {
+			return fail(err.Error())
+		}
+		fmt.Println("sha256:peg-fake")
+		return 0
+	default:
+		return fail("nerdctl: unknown command %q for \"nerdctl\"", cmd)
+	}
+
+	if err := save(d.container(id), c); err != nil {
+		return fail(err.Error())
+	}
+	fmt.Println(id)
+	return 0
+}
+
+// noSuchContainer fails like nerdctl does on missing containers.
+func noSuchContainer(id string) int {
+	return fail("time=\"2024-01-01T00:00:00Z\" level=fatal msg=\"1 errors:\\nno such container: %s\"", id)
+}
+
+type nerdctlState string
+
+func (d nerdctlState) container(id string) string {
+	return filepath.Join(string(d), "nerdctl", "containers", id+".json")
+}
+
+// image returns the file of an image, named repository:tag.
+func (d nerdctlState) image(name string) string {
+	repo, tag, ok := strings.Cut(name, ":")
+	if !ok {
+		tag = "latest"
+	}
+	return filepath.Join(d.repository(repo), tag)
+}
+
+func (d nerdctlState) repository(repo string) string {
+	return filepath.Join(string(d), "nerdctl", "images", url.PathEscape(repo))
+}
+
+// local marks the repositories of committed images.
+func (d nerdctlState) local(repo string) string {
+	return filepath.Join(string(d), "nerdctl", "local", url.PathEscape(repo))
+}
+
+func (d nerdctlState) addImage(name string) error {
+	if err := os.MkdirAll(filepath.Dir(d.image(name)), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(d.image(name), nil, 0644)
+}
+
+func (d nerdctlState) run(flags map[string]string, positional []string) int {
+	if len(positional) == 0 {
+		return fail("\"nerdctl run\" requires at least 1 argument.")
+	}
+	id := flags["--name"]
+	if id == "" {
+		return fail("fake nerdctl run needs --name")
+	}
+	if _, err := os.Stat(d.container(id)); err == nil {
+		return fail("docker: Error response from daemon: Conflict. The container name \"/%s\" is already in use.", id)
+	}
+
+	// images are pulled on demand, but those committed locally can't be
+	image := positional[0]
+	repo, _, _ := strings.Cut(image, ":")
+	if _, err := os.Stat(d.image(image)); err != nil {
+		if _, err := os.Stat(d.local(repo)); err == nil {
+			return fail("Unable to find image '%s' locally\ndocker: Error response from daemon: pull access denied for %s, repository does not exist", image, repo)
+		}
+	}
+	if err := d.addImage(image); err != nil {
+		return fail(err.Error())
+	}
+	// inits can't mount what they need unprivileged
+	entrypoint := strings.Trim(flags["--entrypoint"], `[]"`)
+	if entrypoint != "/bin/sh" && flags["--privileged"] == "" {
+		return fail("Failed to mount cgroup at /sys/fs/cgroup/systemd: Operation not permitted\n[!!!!!!] Failed to mount API filesystems.")
+	}
+	c := &container{Status: "running", Image: image, Networks: map[string]bool{"bridge": true}, Shell: entrypoint == "/bin/sh"}
+	if err := save(d.container(id), c); err != nil {
+		return fail(err.Error())
+	}
+	fmt.Println(id)
+	return 0
+}
+
+func (d nerdctlState) images(positional []string) int {
+	if len(positional) == 0 {
+		return 0
+	}
+	tags, err := os.ReadDir(d.repository(positional[0]))
+	if err != nil && !os.IsNotExist(err) {
+		return fail(err.Error())
+	}
+	for _, t := range tags {
+		fmt.Println(t.Name())
+	}
+	return 0
+}
+
+func (d nerdctlState) rmi(positional []string) int {
+	code := 0
+	for _, name := range positional {
+		if err := os.Remove(d.image(name)); err != nil {
+			code = fail("Error response from daemon: No such image: %s", name)
+			continue
+		}
+		fmt.Printf("Untagged: %s\n", name)
+	}
+	return code
+}
+
+func (d nerdctlState) inspect(c *container, format string) int {
+	if format == "" {
+		format = "{{json .}}"
+	}
+	t, err := template.New("inspect").Funcs(template.FuncMap{"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	}}).Parse(format)
+	if err != nil {
+		return fail("Error parsing format: %s", err.Error())
+	}
+
+	networks := map[string]struct{}{}
+	for n := range c.Networks {
+		networks[n] = struct{}{}
+	}
+	data := map[string]interface{}{
+		"State":           map[string]interface{}{"Status": c.Status, "ExitCode": c.ExitCode, "Running": c.Status == "running"},
+		"NetworkSettings": map[string]interface{}{"Networks": networks},
+		"Config":          map[string]interface{}{"Image": c.Image},
+	}
+	if err := t.Execute(os.Stdout, data); err != nil {
+		return fail(err.Error())
+	}
+	fmt.Println()
+	return 0
+}
+
+// exec runs the command on the host.
+func (d nerdctlState) exec(id string, c *container, flags map[string]string, args []string) int {
+	switch c.Status {
+	case "running":
+	case "paused":
+		return fail("Error response from daemon: Container %s is paused, unpause the container before exec", id)
+	default:
+		return fail("Error response from daemon: container %s is not running", id)
+	}
+	if len(args) == 0 {
+		return fail("\"nerdctl exec\" requires at least 2 arguments.")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = guestEnv(string(d))
+	if env := flags["--env"] + flags["-e"]; env != "" {
+		cmd.Env = append(cmd.Env, env)
+	}
+	cmd.Dir = "/"
+	// Not handing our descriptors over, so the command outliving a killed nerdctl exec doesn't hold its output open
+	cmd.Stdout, cmd.Stderr = struct{ io.Writer }{os.Stdout}, struct{ io.Writer }{os.Stderr}
+	if flags["-i"] != "" {
+		cmd.Stdin = struct{ io.Reader }{os.Stdin}
+	}
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		fmt.Fprintf(os.Stderr, "OCI runtime exec failed: %s\n", err.Error())
+		return 126
+	}
+	return exitCode(err)
+}
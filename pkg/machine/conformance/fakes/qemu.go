@@ -0,0 +1,380 @@
+package fakes
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// qemuImg fakes qemu-img create, info and commit.
+func qemuImg(args []string) int {
+	if len(args) == 0 {
+		return fail("missing command")
+	}
+	switch args[0] {
+	case "create":
+		// create -f fmt [-b base -F fmt] file [size]
+		positional := []string{}
+		for i := 1; i < len(args); i++ {
+			switch args[i] {
+			case "-f", "-b", "-F", "-o":
+				i++
+			default:
+				positional = append(positional, args[i])
+			}
+		}
+		if len(positional) == 0 {
+			return fail("missing file name")
+		}
+		if err := os.WriteFile(positional[0], nil, 0644); err != nil {
+			return fail("failed creating %s: %s", positional[0], err.Error())
+		}
+		fmt.Printf("Formatting '%s'\n", positional[0])
+	case "info":
+		file := args[len(args)-1]
+		if _, err := os.Stat(file); err != nil {
+			return fail("qemu-img: Could not open '%s': %s", file, err.Error())
+		}
+		fmt.Printf(`{"filename": %q, "format": "raw", "virtual-size": 1073741824}`+"\n", file)
+	case "commit":
+		fmt.Println("Image committed.")
+	default:
+		return fail("unknown command %s", args[0])
+	}
+	return 0
+}
+
+// qcodes are the QEMU key codes send-key accepts.
+var qcodes = map[string]bool{}
+
+func init() {
+	for _, k := range strings.Fields(`shift shift_r alt alt_r ctrl ctrl_r meta_l meta_r menu esc minus equal
+		backspace tab bracket_left bracket_right ret semicolon apostrophe grave_accent backslash comma dot
+		slash asterisk spc caps_lock num_lock scroll_lock print sysrq home end pgup pgdn up down left right
+		insert delete pause less kp_add kp_subtract kp_multiply kp_divide kp_enter kp_decimal`) {
+		qcodes[k] = true
+	}
+	for c := 'a'; c <= 'z'; c++ {
+		qcodes[string(c)] = true
+	}
+	for i := 0; i <= 9; i++ {
+		qcodes[fmt.Sprint(i)] = true
+		qcodes[fmt.Sprintf("kp_%d", i)] = true
+	}
+	for i := 1; i <= 12; i++ {
+		qcodes[fmt.Sprintf("f%d", i)] = true
+	}
+}
+
+type qemuDrive struct {
+	Device    string
+	File      string
+	Removable bool
+}
+
+// EnvQEMUVersion is the major.minor version fake qemu-system processes behave like, 8.0 by default.
+const EnvQEMUVersion = "PEG_FAKE_QEMU_VERSION"
+
+// qemuVM is the state of a fake qemu-system process.
+type qemuVM struct {
+	sync.Mutex
+
+	major, minor int
+
+	status    string
+	drives    []qemuDrive
+	netdevs   map[string]bool
+	snapshots []string
+
+	conns map[net.Conn]bool
+	exit  chan int
+}
+
+// qemuSystem fakes qemu-system-x86_64: it serves QMP, logs a console and runs until powered down or killed.
+func qemuSystem(args []string) int {
+	vm := &qemuVM{major: 8, status: "running", netdevs: map[string]bool{}, conns: map[net.Conn]bool{}, exit: make(chan int, 1)}
+	if v := os.Getenv(EnvQEMUVersion); v != "" {
+		if _, err := fmt.Sscanf(v, "%d.%d", &vm.major, &vm.minor); err != nil {
+			return fail("invalid %s: %s", EnvQEMUVersion, v)
+		}
+	}
+
+	cds, disks := 0, 0
+	for i := 0; i < len(args)-1; i++ {
+		opt, val := args[i], args[i+1]
+		props := qemuProps(val)
+		switch opt {
+		case "-qmp":
+			l, err := qemuListen(val)
+			if err != nil {
+				return fail("failed listening for qmp: %s", err.Error())
+			}
+			go vm.serveQMP(l)
+		case "-monitor":
+			if _, err := qemuListen(val); err != nil {
+				return fail("failed listening for the monitor: %s", err.Error())
+			}
+		case "-chardev":
+			if props["path"] != "" {
+				if _, err := net.Listen("unix", props["path"]); err != nil {
+					return fail("failed listening for the console: %s", err.Error())
+				}
+			}
+			if props["logfile"] != "" {
+				if err := os.WriteFile(props["logfile"], []byte(console), 0644); err != nil {
+					return fail("failed writing the console: %s", err.Error())
+				}
+			}
+		case "-drive":
+			if props["media"] == "cdrom" {
+				vm.drives = append(vm.drives, qemuDrive{Device: fmt.Sprintf("ide0-cd%d", cds), File: props["file"], Removable: true})
+				cds++
+			} else {
+				vm.drives = append(vm.drives, qemuDrive{Device: fmt.Sprintf("virtio%d", disks), File: props["file"]})
+				disks++
+			}
+		case "-nic", "-netdev":
+			if props["id"] != "" {
+				vm.netdevs[props["id"]] = true
+			}
+		}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case code := <-vm.exit:
+		return code
+	case s := <-sigs:
+		fmt.Fprintf(os.Stderr, "qemu-system-x86_64: terminating on signal %s\n", s)
+		return 1
+	}
+}
+
+// qemuProps parses comma separated key=value option properties. Bare values are keyed by themselves.
+func qemuProps(s string) map[string]string {
+	props := map[string]string{}
+	for _, p := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok {
+			v = k
+		}
+		props[k] = v
+	}
+	return props
+}
+
+// qemuListen listens on a unix:path,server,nowait chardev.
+func qemuListen(spec string) (net.Listener, error) {
+	path := strings.TrimPrefix(strings.Split(spec, ",")[0], "unix:")
+	return net.Listen("unix", path)
+}
+
+func (vm *qemuVM) serveQMP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go vm.handleQMP(conn)
+	}
+}
+
+type qmpRequest struct {
+	Execute   string                 `json:"execute"`
+	Arguments map[string]interface{} `json:"arguments"`
+	ID        json.RawMessage        `json:"id"`
+}
+
+func (vm *qemuVM) handleQMP(conn net.Conn) {
+	defer conn.Close()
+
+	vm.Lock()
+	vm.conns[conn] = true
+	vm.Unlock()
+	defer func() {
+		vm.Lock()
+		delete(vm.conns, conn)
+		vm.Unlock()
+	}()
+
+	vm.send(conn, map[string]interface{}{"QMP": map[string]interface{}{
+		"version":      map[string]interface{}{"qemu": map[string]int{"major": vm.major, "minor": vm.minor, "micro": 0}, "package": "peg-fake"},
+		"capabilities": []string{},
+	}})
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		req := qmpRequest{}
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			vm.send(conn, map[string]interface{}{"error": map[string]string{"class": "GenericError", "desc": "invalid json"}})
+			continue
+		}
+
+		ret, err := vm.execute(req)
+		reply := map[string]interface{}{}
+		if req.ID != nil {
+			reply["id"] = req.ID
+		}
+		if err != nil {
+			reply["error"] = map[string]string{"class": "GenericError", "desc": err.Error()}
+		} else {
+			reply["return"] = ret
+		}
+		vm.send(conn, reply)
+
+		if req.Execute == "system_powerdown" || req.Execute == "quit" {
+			vm.exit <- 0
+		}
+	}
+}
+
+func (vm *qemuVM) send(conn net.Conn, msg interface{}) {
+	b, _ := json.Marshal(msg)
+	_, _ = conn.Write(append(b, '\n'))
+}
+
+// event sends an event to every QMP client.
+func (vm *qemuVM) event(name string) {
+	now := time.Now()
+	for conn := range vm.conns {
+		vm.send(conn, map[string]interface{}{
+			"event":     name,
+			"data":      map[string]interface{}{},
+			"timestamp": map[string]int64{"seconds": now.Unix(), "microseconds": int64(now.Nanosecond() / 1000)},
+		})
+	}
+}
+
+func (vm *qemuVM) execute(req qmpRequest) (interface{}, error) {
+	vm.Lock()
+	defer vm.Unlock()
+
+	arg := func(k string) string {
+		s, _ := req.Arguments[k].(string)
+		return s
+	}
+
+	switch req.Execute {
+	case "qmp_capabilities", "quit":
+		return map[string]interface{}{}, nil
+	case "send-key":
+		keys, _ := req.Arguments["keys"].([]interface{})
+		for i, k := range keys {
+			key, _ := k.(map[string]interface{})
+			if code, _ := key["data"].(string); !qcodes[code] {
+				return nil, fmt.Errorf("Parameter 'keys[%d].data' does not accept value '%s'", i, code)
+			}
+		}
+	case "query-status":
+		return map[string]interface{}{"status": vm.status, "running": vm.status == "running"}, nil
+	case "stop":
+		vm.status = "paused"
+		vm.event("STOP")
+	case "cont":
+		vm.status = "running"
+		vm.event("RESUME")
+	case "system_reset":
+		vm.status = "running"
+		vm.event("RESET")
+	case "system_powerdown":
+		vm.event("POWERDOWN")
+		vm.event("SHUTDOWN")
+	case "screendump":
+		// the format argument came with QEMU 7.1, dumps were PPM only before
+		image := png
+		switch {
+		case req.Arguments["format"] != nil && vm.major*100+vm.minor < 701:
+			return nil, fmt.Errorf("Parameter 'format' is unexpected")
+		case arg("format") != "png":
+			image = ppm
+		}
+		if err := os.WriteFile(arg("filename"), image, 0644); err != nil {
+			return nil, err
+		}
+	case "set_link":
+		if !vm.netdevs[arg("name")] {
+			return nil, fmt.Errorf("Device '%s' not found", arg("name"))
+		}
+	case "query-block":
+		return vm.queryBlock(), nil
+	case "eject":
+		for i, d := range vm.drives {
+			if d.Device == arg("device") {
+				if !d.Removable {
+					return nil, fmt.Errorf("Device '%s' is not removable", d.Device)
+				}
+				vm.drives[i].File = ""
+				return map[string]interface{}{}, nil
+			}
+		}
+		return nil, fmt.Errorf("Device '%s' not found", arg("device"))
+	case "human-monitor-command":
+		return vm.hmp(arg("command-line")), nil
+	default:
+		return nil, fmt.Errorf("The command %s has not been found", req.Execute)
+	}
+	return map[string]interface{}{}, nil
+}
+
+func (vm *qemuVM) queryBlock() []interface{} {
+	snapshots := []interface{}{}
+	for i, s := range vm.snapshots {
+		snapshots = append(snapshots, map[string]string{"id": fmt.Sprint(i + 1), "name": s})
+	}
+
+	devices := []interface{}{}
+	for _, d := range vm.drives {
+		dev := map[string]interface{}{"device": d.Device, "qdev": d.Device, "removable": d.Removable, "locked": false}
+		if d.File != "" {
+			image := map[string]interface{}{"filename": d.File, "format": "raw"}
+			if !d.Removable {
+				image["snapshots"] = snapshots
+			}
+			dev["inserted"] = map[string]interface{}{"file": d.File, "ro": d.Removable, "drv": "raw", "image": image}
+		}
+		devices = append(devices, dev)
+	}
+	return devices
+}
+
+// hmp runs savevm, loadvm and delvm. Like qemu, it returns the error message as output.
+func (vm *qemuVM) hmp(cmd string) string {
+	fields := strings.Fields(cmd)
+	if len(fields) != 2 {
+		return fmt.Sprintf("unknown command: '%s'\r\n", cmd)
+	}
+	name := fields[1]
+	found := -1
+	for i, s := range vm.snapshots {
+		if s == name {
+			found = i
+		}
+	}
+
+	switch fields[0] {
+	case "savevm":
+		if found == -1 {
+			vm.snapshots = append(vm.snapshots, name)
+		}
+	case "loadvm":
+		if found == -1 {
+			return fmt.Sprintf("Error: Snapshot '%s' does not exist in one or more devices\r\n", name)
+		}
+		vm.status = "running"
+	case "delvm":
+		if found != -1 {
+			vm.snapshots = append(vm.snapshots[:found], vm.snapshots[found+1:]...)
+		}
+	default:
+		return fmt.Sprintf("unknown command: '%s'\r\n", fields[0])
+	}
+	return ""
+}
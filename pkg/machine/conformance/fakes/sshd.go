@@ -0,0 +1,323 @@
+package fakes
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshSignals are the signals SSH clients can send, by name.
+var sshSignals = map[string]syscall.Signal{
+	"ABRT": syscall.SIGABRT, "ALRM": syscall.SIGALRM, "FPE": syscall.SIGFPE, "HUP": syscall.SIGHUP,
+	"ILL": syscall.SIGILL, "INT": syscall.SIGINT, "KILL": syscall.SIGKILL, "PIPE": syscall.SIGPIPE,
+	"QUIT": syscall.SIGQUIT, "SEGV": syscall.SIGSEGV, "TERM": syscall.SIGTERM, "USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// SSHServer is the SSH server of fake guests. Commands run on the host, like every fake guest command.
+type SSHServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	stateDir string
+
+	sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+	// authorized are the public keys user can log in with, offered the keys clients offered
+	authorized []ssh.PublicKey
+	offered    []ssh.PublicKey
+	hostKey    ssh.PublicKey
+}
+
+// ServeSSH serves SSH on addr, accepting user with password pass, and with the keys authorized with AuthorizeKey.
+func (f *Fakes) ServeSSH(addr, user, pass string) (*SSHServer, error) {
+	signer, err := newHostKey()
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &SSHServer{listener: l, stateDir: f.stateDir(), conns: map[net.Conn]bool{}}
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, p []byte) (*ssh.Permissions, error) {
+			if c.User() == user && string(p) == pass {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", c.User())
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			s.Lock()
+			defer s.Unlock()
+			s.offered = append(s.offered, key)
+			for _, k := range s.authorized {
+				if c.User() == user && bytes.Equal(k.Marshal(), key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("key rejected for %s", c.User())
+		},
+	}
+	s.config.AddHostKey(signer)
+	s.hostKey = signer.PublicKey()
+	go s.serve()
+	return s, nil
+}
+
+func newHostKey() (ssh.Signer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+// HostKey is the host key the server presents.
+func (s *SSHServer) HostKey() ssh.PublicKey {
+	s.Lock()
+	defer s.Unlock()
+	return s.hostKey
+}
+
+// RotateHostKey makes the server present a new host key to the next connections, like a reinstalled guest.
+func (s *SSHServer) RotateHostKey() error {
+	signer, err := newHostKey()
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	config := &ssh.ServerConfig{PasswordCallback: s.config.PasswordCallback, PublicKeyCallback: s.config.PublicKeyCallback}
+	config.AddHostKey(signer)
+	s.config, s.hostKey = config, signer.PublicKey()
+	return nil
+}
+
+// AuthorizeKey lets the user log in with key.
+func (s *SSHServer) AuthorizeKey(key ssh.PublicKey) {
+	s.Lock()
+	defer s.Unlock()
+	s.authorized = append(s.authorized, key)
+}
+
+// OfferedKeys returns the public keys offered by clients so far, in order.
+func (s *SSHServer) OfferedKeys() []ssh.PublicKey {
+	s.Lock()
+	defer s.Unlock()
+	return append([]ssh.PublicKey{}, s.offered...)
+}
+
+// Addr is the address the server listens on.
+func (s *SSHServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Disconnect drops every connection but keeps listening, like a guest rebooting.
+func (s *SSHServer) Disconnect() {
+	s.Lock()
+	defer s.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// Close stops listening and drops every connection, like a guest going away.
+func (s *SSHServer) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.closed = true
+	err := s.listener.Close()
+	for c := range s.conns {
+		c.Close()
+	}
+	return err
+}
+
+func (s *SSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.Lock()
+		if s.closed {
+			s.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+func (s *SSHServer) handle(conn net.Conn) {
+	defer func() {
+		s.Lock()
+		delete(s.conns, conn)
+		s.Unlock()
+		conn.Close()
+	}()
+
+	s.Lock()
+	config := s.config
+	s.Unlock()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			_ = nc.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(ch, requests)
+	}
+}
+
+// session serves the requests of a session channel, running at most one command.
+func (s *SSHServer) session(ch ssh.Channel, requests <-chan *ssh.Request) {
+	var cmd *exec.Cmd
+	env := []string{}
+
+	for req := range requests {
+		switch req.Type {
+		case "env":
+			kv := struct{ Name, Value string }{}
+			if err := ssh.Unmarshal(req.Payload, &kv); err == nil {
+				env = append(env, kv.Name+"="+kv.Value)
+			}
+			reply(req, true)
+		case "pty-req", "window-change":
+			reply(req, true)
+		case "exec", "shell":
+			if cmd != nil {
+				reply(req, false)
+				continue
+			}
+			command := ""
+			if req.Type == "exec" {
+				payload := struct{ Command string }{}
+				if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+					reply(req, false)
+					continue
+				}
+				command = payload.Command
+			}
+			cmd = s.start(ch, command, env)
+			reply(req, cmd != nil)
+			if cmd == nil {
+				ch.Close()
+			}
+		case "signal":
+			payload := struct{ Signal string }{}
+			if err := ssh.Unmarshal(req.Payload, &payload); err == nil && cmd != nil && cmd.Process != nil {
+				if sig, ok := sshSignals[payload.Signal]; ok {
+					_ = syscall.Kill(-cmd.Process.Pid, sig)
+				}
+			}
+			reply(req, false)
+		default:
+			reply(req, false)
+		}
+	}
+
+	// The client went away, don't leave its command behind
+	if cmd != nil && cmd.Process != nil {
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// start runs command, or an interactive shell if empty, and reports its exit on the channel once done.
+func (s *SSHServer) start(ch ssh.Channel, command string, env []string) *exec.Cmd {
+	cmd := exec.Command("/bin/sh")
+	if command != "" {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	cmd.Env = append(guestEnv(s.stateDir), env...)
+	cmd.Dir = "/"
+	cmd.Stdout, cmd.Stderr = ch, ch.Stderr()
+	// the whole process group is signaled, so children don't keep the output open
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(ch.Stderr(), "%s\n", err.Error())
+		return nil
+	}
+	go func() {
+		_, _ = io.Copy(stdin, ch)
+		stdin.Close()
+	}()
+
+	go func() {
+		err := cmd.Wait()
+		var exitErr *exec.ExitError
+		switch {
+		case err == nil:
+			_, _ = ch.SendRequest("exit-status", false, exitStatus(0))
+		case errors.As(err, &exitErr):
+			if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+				_, _ = ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+					Signal     string
+					CoreDumped bool
+					Error      string
+					Lang       string
+				}{Signal: signalName(ws.Signal())}))
+				break
+			}
+			_, _ = ch.SendRequest("exit-status", false, exitStatus(exitErr.ExitCode()))
+		default:
+			_, _ = ch.SendRequest("exit-status", false, exitStatus(255))
+		}
+		ch.Close()
+	}()
+	return cmd
+}
+
+func exitStatus(code int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(code))
+	return b
+}
+
+func signalName(sig syscall.Signal) string {
+	for name, s := range sshSignals {
+		if s == sig {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d", int(sig))
+}
+
+func reply(req *ssh.Request, ok bool) {
+	if req.WantReply {
+		_ = req.Reply(ok, nil)
+	}
+}
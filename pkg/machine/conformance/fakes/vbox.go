@@ -0,0 +1,242 @@
+package fakes
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type vboxVM struct {
+	State     string
+	UARTFile  string
+	Snapshots []string
+	// Media attached, by port
+	Media map[string]string
+}
+
+// vboxManage fakes the VBoxManage commands used by the VBox engine.
+func vboxManage(args []string) int {
+	if len(args) < 2 {
+		return fail("Syntax error: missing arguments")
+	}
+	v := vboxState(os.Getenv(envState))
+	cmd, args := args[0], args[1:]
+
+	switch cmd {
+	case "createmedium":
+		file := flag(args, "--filename")
+		if _, err := os.Stat(file); err == nil {
+			return fail("VBoxManage: error: Failed to create medium\nVBoxManage: error: Could not create the medium storage unit '%s'. VERR_ALREADY_EXISTS", file)
+		}
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			return fail("VBoxManage: error: %s", err.Error())
+		}
+		fmt.Println("Medium created. UUID: 00000000-0000-0000-0000-000000000000")
+		return 0
+	case "createvm":
+		id := flag(args, "--name")
+		if _, err := os.Stat(v.vm(id)); err == nil {
+			return fail("VBoxManage: error: Machine settings file '%s' already exists", id)
+		}
+		if err := save(v.vm(id), &vboxVM{State: "poweroff", Media: map[string]string{}}); err != nil {
+			return fail(err.Error())
+		}
+		fmt.Printf("Virtual machine '%s' is created and registered.\n", id)
+		return 0
+	}
+
+	// the VM is the last argument of unregistervm, the first one of the other commands
+	id := args[0]
+	if cmd == "unregistervm" {
+		id = args[len(args)-1]
+	}
+	vm := &vboxVM{}
+	exists, err := load(v.vm(id), vm)
+	if err != nil {
+		return fail(err.Error())
+	}
+	if !exists {
+		return fail("VBoxManage: error: Could not find a registered machine named '%s'", id)
+	}
+	args = args[1:]
+
+	code := 0
+	switch cmd {
+	case "showvminfo":
+		fmt.Printf("name=\"%s\"\nVMState=\"%s\"\nLogFldr=\"%s\"\n", id, vm.State, filepath.Dir(v.vm(id)))
+		return 0
+	case "unregistervm":
+		if vm.State == "running" || vm.State == "paused" {
+			return fail("VBoxManage: error: Cannot unregister the machine '%s' while it is locked", id)
+		}
+		if err := os.Remove(v.vm(id)); err != nil {
+			return fail(err.Error())
+		}
+		return 0
+	case "modifyvm":
+		if vm.State == "running" || vm.State == "paused" {
+			return fail("VBoxManage: error: The machine '%s' is already locked for a session (or being unlocked)", id)
+		}
+		if f := flag(args, "--uartmode1"); f == "file" {
+			vm.UARTFile = flag(args, "file")
+		}
+	case "storagectl":
+	case "storageattach":
+		port, medium := flag(args, "--port"), flag(args, "--medium")
+		if medium == "none" {
+			delete(vm.Media, port)
+			break
+		}
+		if _, err := os.Stat(medium); err != nil {
+			return fail("VBoxManage: error: Could not find file for the medium '%s'", medium)
+		}
+		if vm.Media == nil {
+			vm.Media = map[string]string{}
+		}
+		vm.Media[port] = medium
+	case "startvm":
+		if vm.State == "running" || vm.State == "paused" {
+			return fail("VBoxManage: error: The machine '%s' is already locked by a session (or being locked or unlocked)", id)
+		}
+		vm.State = "running"
+		if vm.UARTFile != "" {
+			if err := os.WriteFile(vm.UARTFile, []byte(console), 0644); err != nil {
+				return fail(err.Error())
+			}
+		}
+		fmt.Printf("VM \"%s\" has been successfully started.\n", id)
+	case "controlvm":
+		code = vm.control(id, args)
+	case "snapshot":
+		code = vm.snapshot(id, args)
+	default:
+		return fail("Syntax error: Invalid command '%s'", cmd)
+	}
+	if code != 0 {
+		return code
+	}
+
+	if err := save(v.vm(id), vm); err != nil {
+		return fail(err.Error())
+	}
+	return 0
+}
+
+func (vm *vboxVM) control(id string, args []string) int {
+	if len(args) == 0 {
+		return fail("Syntax error: Not enough parameters")
+	}
+	action := args[0]
+	if vm.State != "running" && vm.State != "paused" {
+		return fail("VBoxManage: error: Machine '%s' is not currently running", id)
+	}
+
+	switch action {
+	case "poweroff":
+		vm.State = "poweroff"
+	case "acpipowerbutton":
+		// the guest obeys right away
+		vm.State = "poweroff"
+	case "pause":
+		vm.State = "paused"
+	case "resume":
+		vm.State = "running"
+	case "reset":
+		vm.State = "running"
+	case "screenshotpng":
+		if len(args) != 2 {
+			return fail("Syntax error: Incorrect number of parameters")
+		}
+		if err := os.WriteFile(args[1], png, 0644); err != nil {
+			return fail(err.Error())
+		}
+	case "keyboardputscancode":
+		for _, c := range args[1:] {
+			if b, err := hex.DecodeString(c); err != nil || len(b) != 1 {
+				return fail("VBoxManage: error: Error: '%s' is not a hex byte!", c)
+			}
+		}
+	case "setlinkstate1":
+		if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+			return fail("Syntax error: Invalid link state")
+		}
+	default:
+		return fail("Syntax error: Invalid parameter '%s'", action)
+	}
+	return 0
+}
+
+func (vm *vboxVM) snapshot(id string, args []string) int {
+	if len(args) == 0 {
+		return fail("Syntax error: Not enough parameters")
+	}
+
+	switch args[0] {
+	case "list":
+		if len(vm.Snapshots) == 0 {
+			fmt.Println("This machine does not have any snapshots")
+			return 1
+		}
+		for i, s := range vm.Snapshots {
+			key := "SnapshotName"
+			if i > 0 {
+				key += "-" + strconv.Itoa(i)
+			}
+			fmt.Printf("%s=\"%s\"\n", key, s)
+		}
+		return 0
+	}
+
+	if len(args) < 2 {
+		return fail("Syntax error: Not enough parameters")
+	}
+	name, found := args[1], -1
+	for i, s := range vm.Snapshots {
+		if s == name {
+			found = i
+		}
+	}
+
+	switch args[0] {
+	case "take":
+		vm.Snapshots = append(vm.Snapshots, name)
+	case "delete", "restore":
+		if found == -1 {
+			return fail("VBoxManage: error: Could not find a snapshot named '%s'", name)
+		}
+		if args[0] == "delete" {
+			vm.Snapshots = append(vm.Snapshots[:found], vm.Snapshots[found+1:]...)
+			break
+		}
+		if vm.State == "running" || vm.State == "paused" {
+			return fail("VBoxManage: error: Cannot restore a snapshot of the machine '%s' while it is running", id)
+		}
+		// live snapshots restore to a saved state
+		vm.State = "saved"
+	default:
+		return fail("Syntax error: Invalid parameter '%s'", args[0])
+	}
+	return 0
+}
+
+type vboxState string
+
+func (v vboxState) vm(id string) string {
+	return filepath.Join(string(v), "vbox", id, "vm.json")
+}
+
+// flag returns the value following name in args.
+func flag(args []string, name string) string {
+	for i, a := range args {
+		if a == name && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(a, name+"=") {
+			return strings.TrimPrefix(a, name+"=")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/ginkgo/v2" //nolint:revive
+	. "github.com/onsi/gomega"    //nolint:revive
+)
+
+// Lifecycle registers the specs checking the machine states through create, pause, resume, restart, shutdown and clean.
+func Lifecycle(e Engine) bool {
+	return Describe(e.Name+" machine lifecycle", Ordered, func() {
+		var m types.Machine
+
+		state := func() types.State {
+			s, err := m.State()
+			Expect(err).ToNot(HaveOccurred())
+			return s
+		}
+
+		BeforeAll(func() {
+			e.skipUnavailable()
+
+			var err error
+			m, err = e.New()
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(func() {
+				_ = m.Stop()
+				_ = m.Clean()
+			})
+		})
+
+		It("is gone before being created", func() {
+			Expect(state()).To(Equal(types.StateGone))
+		})
+
+		It("runs once created", func() {
+			_, err := m.Create(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(state, e.bootTimeout(), time.Second).Should(Equal(types.StateRunning))
+		})
+
+		It("pauses and resumes", func() {
+			e.requires(Pausing)
+
+			Expect(m.Pause()).To(Succeed())
+			Eventually(state, time.Minute, time.Second).Should(Equal(types.StatePaused))
+			Expect(m.Resume()).To(Succeed())
+			Eventually(state, time.Minute, time.Second).Should(Equal(types.StateRunning))
+		})
+
+		It("runs again after a hard restart", func() {
+			Expect(m.Restart(true)).To(Succeed())
+			Eventually(state, e.bootTimeout(), time.Second).Should(Equal(types.StateRunning))
+		})
+
+		It("is stopped after shutting down", func() {
+			err := m.Shutdown(true, 30*time.Second)
+			if err != nil {
+				Expect(errors.Is(err, types.ErrShutdownTimeout)).To(BeTrue(), err.Error())
+			}
+			Eventually(state, time.Minute, time.Second).Should(Equal(types.StateStopped))
+		})
+
+		It("can be stopped again", func() {
+			Expect(m.Stop()).To(Succeed())
+			Expect(state()).To(Equal(types.StateStopped))
+		})
+
+		It("is gone once cleaned", func() {
+			Expect(m.Clean()).To(Succeed())
+			Expect(state()).To(Equal(types.StateGone))
+		})
+	})
+}
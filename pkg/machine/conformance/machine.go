@@ -0,0 +1,242 @@
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/ginkgo/v2" //nolint:revive
+	. "github.com/onsi/gomega"    //nolint:revive
+)
+
+// Machine registers the specs exercising the types.Machine methods on a running machine.
+func Machine(e Engine) bool {
+	return Describe(e.Name+" machine", Ordered, func() {
+		var m types.Machine
+		// guestDir is a scratch directory in the guest
+		var guestDir string
+
+		run := func(cmd string, opts ...types.RunOption) *types.CommandResult {
+			res, err := m.Run(context.Background(), cmd, opts...)
+			Expect(err).ToNot(HaveOccurred())
+			return res
+		}
+
+		BeforeAll(func() {
+			e.skipUnavailable()
+
+			var err error
+			m, err = e.New()
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(func() {
+				_ = m.Stop()
+				_ = m.Clean()
+			})
+
+			_, err = m.Create(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+
+			if e.Guest != nil {
+				guest, err := e.Guest(m)
+				Expect(err).ToNot(HaveOccurred())
+				DeferCleanup(guest.Close)
+			}
+
+			Eventually(func() error {
+				_, err := m.Command("true")
+				return err
+			}, e.bootTimeout(), time.Second).Should(Succeed())
+
+			out, err := m.Command("mktemp -d")
+			Expect(err).ToNot(HaveOccurred(), out)
+			guestDir = strings.TrimSpace(out)
+			DeferCleanup(func() {
+				_, _ = m.Command("rm -rf " + guestDir)
+			})
+		})
+
+		It("has an ID", func() {
+			Expect(m.Config().ID).ToNot(BeEmpty())
+		})
+
+		It("runs commands", func() {
+			out, err := m.Command("echo peg")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out).To(ContainSubstring("peg"))
+
+			_, err = m.Command("exit 3")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("kills commands once the context is done", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			start := time.Now()
+			_, err := m.CommandContext(ctx, "sleep 30")
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+			Expect(time.Since(start)).To(BeNumerically("<", 20*time.Second))
+		})
+
+		It("leaves no process of cancelled commands behind", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			pidFile := filepath.Join(guestDir, "cancelled.pid")
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				_, _ = m.CommandContext(ctx, fmt.Sprintf("sleep 300 & echo $! > %s; wait", pidFile))
+			}()
+			Eventually(func() error {
+				_, err := m.Command("test -s " + pidFile)
+				return err
+			}, time.Minute, 100*time.Millisecond).Should(Succeed())
+
+			cancel()
+			Eventually(done, time.Minute).Should(BeClosed())
+			Eventually(func() error {
+				// kill -0 fails once the process is gone
+				_, err := m.Command(fmt.Sprintf("kill -0 $(cat %s)", pidFile))
+				return err
+			}, 30*time.Second, 500*time.Millisecond).Should(HaveOccurred())
+		})
+
+		It("reports exit codes and output streams", func() {
+			res := run("echo out; echo err >&2; exit 3")
+			Expect(res.ExitCode).To(Equal(3))
+			Expect(res.Stdout).To(Equal("out\n"))
+			Expect(res.Stderr).To(Equal("err\n"))
+			Expect(res.Success()).To(BeFalse())
+		})
+
+		It("reports commands killed by a signal", func() {
+			res := run("kill -TERM $$")
+			Expect(res.Signal).To(Equal("TERM"))
+			Expect(res.Success()).To(BeFalse())
+		})
+
+		It("feeds stdin and sets the environment", func() {
+			res := run("cat", types.WithStdin(strings.NewReader("hello")))
+			Expect(res.Stdout).To(Equal("hello"))
+
+			res = run(`echo "$PEG_CONFORMANCE"`, types.WithEnv("PEG_CONFORMANCE", "it's set"))
+			Expect(res.Stdout).To(Equal("it's set\n"))
+		})
+
+		It("sends and receives files", func() {
+			local := GinkgoT().TempDir()
+			src := filepath.Join(local, "src")
+			Expect(os.WriteFile(src, []byte("peg conformance\n"), 0644)).To(Succeed())
+
+			dst := filepath.Join(guestDir, "file")
+			Expect(m.SendFile(src, dst, "0644")).To(Succeed())
+			out, err := m.Command("cat " + dst)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out).To(ContainSubstring("peg conformance"))
+
+			Expect(m.SendFileContext(context.Background(), src, dst+"-ctx", "0644")).To(Succeed())
+
+			back := filepath.Join(local, "back")
+			Expect(m.ReceiveFile(dst, back)).To(Succeed())
+			Expect(os.ReadFile(back)).To(Equal([]byte("peg conformance\n")))
+
+			Expect(m.ReceiveFileContext(context.Background(), dst+"-ctx", back+"-ctx")).To(Succeed())
+			Expect(os.ReadFile(back + "-ctx")).To(Equal([]byte("peg conformance\n")))
+		})
+
+		It("has a console", func() {
+			c, err := m.Console()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Close()).To(Succeed())
+		})
+
+		It("takes screenshots", func() {
+			e.requires(Screenshots)
+
+			f, err := m.Screenshot()
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.Remove, f)
+			Expect(f).To(BeAnExistingFile())
+
+			f, err = m.ScreenshotContext(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.Remove, f)
+		})
+
+		It("types on the keyboard", func() {
+			e.requires(Keyboard)
+
+			Expect(m.SendKeys("shift-a", "ret")).To(Succeed())
+			Expect(m.TypeText("peg\n")).To(Succeed())
+			Expect(m.SendKeys("not-a-key")).ToNot(Succeed())
+		})
+
+		It("creates disks", func() {
+			Expect(m.CreateDisk("conformance.img", "1G")).To(Succeed())
+		})
+
+		It("detaches the CD", func() {
+			if m.Config().ISO == "" {
+				Skip("the machine has no ISO")
+			}
+			Expect(m.DetachCD()).To(Succeed())
+		})
+
+		It("forwards ports", func() {
+			for _, p := range m.Config().Ports {
+				Expect(m.HostPort(p.Guest)).To(Equal(p.Host))
+			}
+			_, err := m.HostPort(1)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("reports its addresses", func() {
+			_, err := m.Addresses(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("takes and restores snapshots", func() {
+			e.requires(Snapshots)
+
+			Expect(m.Snapshot("conformance")).To(Succeed())
+			// a snapshot with the same name is replaced
+			Expect(m.Snapshot("conformance")).To(Succeed())
+			snapshots, err := m.ListSnapshots()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(snapshots).To(ConsistOf("conformance"))
+
+			Expect(m.Restore("conformance")).To(Succeed())
+			Eventually(func() error {
+				_, err := m.Command("true")
+				return err
+			}, e.bootTimeout(), time.Second).Should(Succeed())
+
+			Expect(m.Restore("missing")).ToNot(Succeed())
+		})
+
+		It("sets the network conditions", func() {
+			e.requires(NetworkConditions)
+
+			Expect(m.SetNetworkConditions(types.NetworkConditions{Latency: "10ms", Loss: 1})).To(Succeed())
+			Expect(m.SetNetworkConditions(types.NetworkConditions{})).To(Succeed())
+		})
+
+		It("unplugs and plugs the network back", func() {
+			e.requires(LinkState)
+
+			Expect(m.SetLinkUp(false)).To(Succeed())
+			Expect(m.SetLinkUp(true)).To(Succeed())
+			Eventually(func() error {
+				_, err := m.Command("true")
+				return err
+			}, e.bootTimeout(), time.Second).Should(Succeed())
+
+			Expect(m.SetLinkUp(false, "not-a-network")).ToNot(Succeed())
+		})
+	})
+}
@@ -0,0 +1,133 @@
+package machine_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	"github.com/spectrocloud/peg/pkg/machine"
+	"github.com/spectrocloud/peg/pkg/machine/conformance"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// fakeISO returns an empty ISO file to boot fake VMs from.
+func fakeISO() types.MachineOption {
+	iso := filepath.Join(GinkgoT().TempDir(), "boot.iso")
+	return func(mc *types.MachineConfig) error {
+		mc.ISO = iso
+		return os.WriteFile(iso, nil, 0644)
+	}
+}
+
+func fakeSSH(m types.Machine) (io.Closer, error) {
+	return fake.ServeSSH("127.0.0.1:"+m.Config().SSH.Port, "peg", "peg")
+}
+
+var _ = conformance.Suite(conformance.Engine{
+	Name: "fake qemu",
+	New: func() (types.Machine, error) {
+		return machine.New(
+			types.QEMUEngine,
+			types.WithProcessName(fake.Bin("qemu-system-x86_64")),
+			fakeISO(),
+			types.WithSSHUser("peg"),
+			types.WithSSHPass("peg"),
+			types.WithPorts(8080),
+		)
+	},
+	Guest:       fakeSSH,
+	BootTimeout: 30 * time.Second,
+})
+
+var _ = conformance.Suite(conformance.Engine{
+	Name: "fake vbox",
+	New: func() (types.Machine, error) {
+		return machine.New(
+			types.VBoxEngine,
+			fakeISO(),
+			types.WithSSHUser("peg"),
+			types.WithSSHPass("peg"),
+			types.WithPorts(8080),
+		)
+	},
+	Guest:       fakeSSH,
+	BootTimeout: 30 * time.Second,
+})
+
+var _ = conformance.Suite(conformance.Engine{
+	Name: "fake docker",
+	New: func() (types.Machine, error) {
+		return machine.New(
+			types.DockerEngine,
+			types.WithContainerHost(dockerHost),
+			types.WithImage("alpine"),
+			types.WithPorts(8080),
+		)
+	},
+	Unsupported: []conformance.Feature{conformance.Screenshots, conformance.Keyboard},
+	BootTimeout: 30 * time.Second,
+})
+
+var _ = conformance.Suite(conformance.Engine{
+	Name: "fake docker booting systemd",
+	New: func() (types.Machine, error) {
+		return machine.New(
+			types.DockerEngine,
+			types.WithContainerHost(dockerHost),
+			types.WithImage("fedora"),
+			types.WithInit("systemd"),
+			types.WithPorts(8080),
+		)
+	},
+	Unsupported: []conformance.Feature{conformance.Screenshots, conformance.Keyboard},
+	BootTimeout: 30 * time.Second,
+})
+
+var _ = conformance.Suite(conformance.Engine{
+	Name: "fake podman",
+	New: func() (types.Machine, error) {
+		return machine.New(
+			types.PodmanEngine,
+			types.WithContainerHost(podmanHost),
+			types.WithImage("alpine"),
+			types.WithPorts(8080),
+		)
+	},
+	Unsupported: []conformance.Feature{conformance.Screenshots, conformance.Keyboard},
+	BootTimeout: 30 * time.Second,
+})
+
+var _ = conformance.Suite(conformance.Engine{
+	Name: "fake nerdctl",
+	New: func() (types.Machine, error) {
+		return machine.New(
+			types.NerdctlEngine,
+			types.WithProcessName(fake.Bin("nerdctl")),
+			types.WithImage("alpine"),
+			types.WithPorts(8080),
+		)
+	},
+	Unsupported: []conformance.Feature{conformance.Screenshots, conformance.Keyboard, conformance.LinkState},
+	BootTimeout: 30 * time.Second,
+})
+
+var _ = conformance.Suite(conformance.Engine{
+	Name: "fake kubernetes",
+	New: func() (types.Machine, error) {
+		return machine.New(
+			types.KubernetesEngine,
+			types.WithKubeconfig(kubeconfig),
+			types.WithImage("alpine"),
+		)
+	},
+	Unsupported: []conformance.Feature{
+		conformance.Screenshots,
+		conformance.Keyboard,
+		conformance.Pausing,
+		conformance.Snapshots,
+		conformance.LinkState,
+	},
+	BootTimeout: 30 * time.Second,
+})
@@ -0,0 +1,259 @@
+package machine
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// containerInit is an init machine containers boot, and how to tell it is done booting.
+type containerInit struct {
+	name string
+	path string
+	// stopSignal makes the init shut the container down gracefully
+	stopSignal string
+	// ready is the command printing one of readyStates once the init booted, any state when empty
+	ready       string
+	readyStates []string
+}
+
+var containerInits = map[string]containerInit{
+	// systemd is degraded as soon as a unit failed, which is common in containers
+	"systemd": {name: "systemd", path: "/sbin/init", stopSignal: "SIGRTMIN+3", ready: "systemctl is-system-running", readyStates: []string{"running", "degraded"}},
+	// busybox init runs openrc from its inittab, and powers off on SIGUSR2
+	"openrc": {name: "openrc", path: "/sbin/init", stopSignal: "SIGUSR2", ready: "rc-status --runlevel", readyStates: []string{"default"}},
+}
+
+// findInit returns the init named name, or the one at path name. Nil when no init is given, containers run a shell.
+func findInit(name string) *containerInit {
+	if name == "" {
+		return nil
+	}
+	if i, ok := containerInits[name]; ok {
+		return &i
+	}
+	// other inits are booted once commands run
+	return &containerInit{name: path.Base(name), path: name, ready: "true"}
+}
+
+// booted tells whether the output of the ready command shows the init booted.
+func (i *containerInit) booted(out string, err error) bool {
+	if len(i.readyStates) == 0 {
+		return err == nil
+	}
+	return slices.Contains(i.readyStates, strings.TrimSpace(out))
+}
+
+// Inits need privileges, their own cgroup and a writable /run.
+var initTmpfs = []string{"/run", "/run/lock", "/tmp"}
+
+// configure sets up the container to boot the init, for the container runtime named runtime.
+func (i *containerInit) configure(config *dockerContainerConfig, runtime string) {
+	config.Entrypoint = []string{i.path}
+	config.StopSignal = i.stopSignal
+	config.Env = append(config.Env, "container="+runtime)
+	config.HostConfig.Privileged = true
+	config.HostConfig.CgroupnsMode = "private"
+	if config.HostConfig.Tmpfs == nil {
+		config.HostConfig.Tmpfs = map[string]string{}
+	}
+	for _, t := range initTmpfs {
+		config.HostConfig.Tmpfs[t] = ""
+	}
+}
+
+// runFlags returns the flags of the run command of container CLIs booting the init. See configure.
+func (i *containerInit) runFlags(runtime string) string {
+	flags := "--privileged --cgroupns=private -e container=" + runtime
+	for _, t := range initTmpfs {
+		flags += " --tmpfs " + t
+	}
+	if i.stopSignal != "" {
+		flags += " --stop-signal " + i.stopSignal
+	}
+	return flags
+}
+
+// containerBootTimeout bounds the wait for the init of a container to boot.
+const containerBootTimeout = 5 * time.Minute
+
+// snapshotRepository is the image repository holding the snapshots of the machine id.
+func snapshotRepository(id string) string {
+	return fmt.Sprintf("peg-snapshot-%s", strings.ToLower(id))
+}
+
+// isContainerEngine tells whether the engine runs machines as containers, which have no SSH server.
+func isContainerEngine(e types.Engine) bool {
+	switch e {
+	case types.Docker, types.Podman, types.Nerdctl, types.Kubernetes:
+		return true
+	}
+	return false
+}
+
+// newContainer returns a machine of the docker, podman or nerdctl engine. Docker and podman are driven through
+// the Docker Engine API. nerdctl has no API, it is driven through its CLI, also by the docker engine when no
+// API is found but nerdctl is.
+func newContainer(mc types.MachineConfig) (types.Machine, error) {
+	if mc.Engine == types.Nerdctl || filepath.Base(mc.Process) == "nerdctl" {
+		return newNerdctl(mc), nil
+	}
+	switch bin := filepath.Base(mc.Process); bin {
+	case ".":
+	case "docker", "podman":
+		// bin used to pick the CLI driving the containers, now it picks the engine whose API is used
+		log.Warnf("bin is deprecated with the %s engine, which drives the API of the engine, set engine: %s and container.host instead", mc.Engine, bin)
+		mc.Engine = types.Engine(bin)
+	default:
+		log.Warnf("Ignoring bin %s, the %s engine drives the API at container.host and runs no executable", mc.Process, mc.Engine)
+	}
+
+	host := findDockerHost(mc)
+	if host == "" {
+		if _, err := exec.LookPath("nerdctl"); err == nil && mc.Engine == types.Docker {
+			return newNerdctl(mc), nil
+		}
+		if mc.Engine == types.Podman || (!onPath("docker") && onPath("podman")) {
+			return nil, fmt.Errorf("no podman API socket at %s, podman is driven through its API and needs it: start it with `systemctl --user start podman.socket` or `podman system service`, or set container.host",
+				strings.Join(dockerSockets(types.Podman), " or "))
+		}
+		host = "unix://" + dockerSockets(mc.Engine)[0]
+	}
+	client, err := newDockerClient(host)
+	if err != nil {
+		return nil, err
+	}
+	return &Docker{machineConfig: mc, client: client}, nil
+}
+
+// findDockerHost returns the Docker API endpoint of mc: the configured one, $DOCKER_HOST with the docker engine,
+// or the first socket found. Empty when none is.
+func findDockerHost(mc types.MachineConfig) string {
+	if mc.Container.Host != "" {
+		return mc.Container.Host
+	}
+	if host := os.Getenv("DOCKER_HOST"); host != "" && mc.Engine == types.Docker {
+		return host
+	}
+	for _, s := range dockerSockets(mc.Engine) {
+		if _, err := os.Stat(s); err == nil {
+			return "unix://" + s
+		}
+	}
+	return ""
+}
+
+// onPath tells if the executable name is found in $PATH.
+func onPath(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// dockerSockets are where the API of the engine is served, in the order they are looked for.
+// The docker engine falls back to the podman sockets, so it runs on rootless CI runners too.
+func dockerSockets(e types.Engine) []string {
+	podman := []string{"/run/podman/podman.sock"}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		podman = append([]string{filepath.Join(dir, "podman", "podman.sock")}, podman...)
+	}
+	if e == types.Podman {
+		return podman
+	}
+	return append([]string{"/var/run/docker.sock"}, podman...)
+}
+
+// tarFile returns a tar archive of the file src, named name in the archive, for containers without cp.
+// Permissions are octal, 0644 by default.
+func tarFile(src, name, permissions string) (io.ReadCloser, error) {
+	mode := int64(0644)
+	if permissions != "" {
+		m, err := strconv.ParseInt(permissions, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid permissions %s: %w", permissions, err)
+		}
+		mode = m
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		defer f.Close()
+		tw := tar.NewWriter(w)
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: mode, Size: info.Size(), ModTime: info.ModTime(), Typeflag: tar.TypeReg})
+		if err == nil {
+			_, err = io.Copy(tw, f)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
+
+// receiveTar writes the first regular file of the tar archive to dst.
+func receiveTar(r io.Reader, dst string) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return errors.New("no file received")
+		}
+		if err != nil {
+			return fmt.Errorf("failed reading archive: %w", err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		f, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+}
+
+// execMarker is set in the environment of the commands run in containers, to find their processes and children.
+const execMarker = "PEG_EXEC"
+
+// execs counts the commands run in containers, to tell their markers apart.
+var execs atomic.Int64
+
+// newExecMarker returns a variable to set in the environment of a command, unique to it.
+func newExecMarker() string {
+	return fmt.Sprintf("%s=%d-%d-%d", execMarker, os.Getpid(), time.Now().UnixNano(), execs.Add(1))
+}
+
+// killMarkedScript returns a script killing the processes of the container with marker in their environment.
+// Commands keep running in containers when the exec of the runtime they were started with is killed.
+func killMarkedScript(marker string) string {
+	return fmt.Sprintf(`for p in /proc/[0-9]*; do
+  if tr '\0' '\n' < "$p/environ" 2>/dev/null | grep -qx '%s'; then kill -KILL "${p#/proc/}" 2>/dev/null; fi
+done`, marker)
+}
@@ -0,0 +1,189 @@
+package machine_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/pkg/machine"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+var _ = Describe("Container runtimes", func() {
+	It("drives the API at $DOCKER_HOST with the docker engine", func() {
+		host := os.Getenv("DOCKER_HOST")
+		Expect(os.Setenv("DOCKER_HOST", podmanHost)).To(Succeed())
+		DeferCleanup(os.Setenv, "DOCKER_HOST", host)
+
+		m, err := machine.New(types.DockerEngine, types.WithImage("alpine"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = m.Create(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(m.Clean)
+
+		// podman containers are attached to the "podman" network by default
+		Expect(m.SetLinkUp(false, types.DefaultNetwork)).To(Succeed())
+		Expect(m.SetLinkUp(true)).To(Succeed())
+	})
+	It("finds the rootless podman socket with the podman engine", func() {
+		dir := os.Getenv("XDG_RUNTIME_DIR")
+		Expect(os.Setenv("XDG_RUNTIME_DIR", fake.Dir)).To(Succeed())
+		DeferCleanup(os.Setenv, "XDG_RUNTIME_DIR", dir)
+
+		m, err := machine.New(types.PodmanEngine, types.WithImage("alpine"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = m.Create(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(m.Clean)
+		Expect(m.State()).To(Equal(types.StateRunning))
+	})
+	It("fails without a podman API socket with the podman engine", func() {
+		if _, err := os.Stat("/run/podman/podman.sock"); err == nil {
+			Skip("the host runs a rootful podman API")
+		}
+		dir := os.Getenv("XDG_RUNTIME_DIR")
+		Expect(os.Setenv("XDG_RUNTIME_DIR", GinkgoT().TempDir())).To(Succeed())
+		DeferCleanup(os.Setenv, "XDG_RUNTIME_DIR", dir)
+
+		_, err := machine.New(types.PodmanEngine, types.WithImage("alpine"))
+		Expect(err).To(MatchError(ContainSubstring("systemctl --user start podman.socket")))
+	})
+	It("takes a deprecated docker or podman executable as the engine to drive the API of", func() {
+		m, err := machine.New(types.PodmanEngine, types.WithContainerHost(dockerHost), types.WithProcessName("/usr/bin/docker"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.Config().Engine).To(Equal(types.Docker))
+	})
+	It("creates containers with the docker run flags of the args", func() {
+		m, err := machine.New(types.DockerEngine, types.WithContainerHost(dockerHost), types.WithImage("alpine"),
+			withArgs("--memory=512m", "--cpus", "1.5", "--device /dev/fuse", "--shm-size=1g",
+				"--ulimit", "nofile=1024:2048", "--init", "--rm", "--read-only=false", "--privileged"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = m.Create(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(m.Clean)
+
+		hc := dockerAPI.HostConfig(m.Config().ID)
+		Expect(hc).To(HaveKeyWithValue("Memory", BeNumerically("==", 512<<20)))
+		Expect(hc).To(HaveKeyWithValue("NanoCpus", BeNumerically("==", 1.5e9)))
+		Expect(hc).To(HaveKeyWithValue("ShmSize", BeNumerically("==", 1<<30)))
+		Expect(hc).To(HaveKeyWithValue("Init", true))
+		Expect(hc).To(HaveKeyWithValue("Privileged", true))
+		Expect(hc).ToNot(HaveKey("ReadonlyRootfs"))
+		Expect(hc["Devices"]).To(ConsistOf(HaveKeyWithValue("PathInContainer", "/dev/fuse")))
+		Expect(hc["Ulimits"]).To(ConsistOf(And(HaveKeyWithValue("Name", "nofile"),
+			HaveKeyWithValue("Soft", BeNumerically("==", 1024)), HaveKeyWithValue("Hard", BeNumerically("==", 2048)))))
+	})
+	It("splits the args like a shell", func() {
+		m, err := machine.New(types.DockerEngine, types.WithContainerHost(dockerHost), types.WithImage("alpine"),
+			withArgs("--privileged -v /a:/b", `--add-host "db host:10.0.0.2" --env='GREETING=hello world'`))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = m.Create(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(m.Clean)
+
+		hc := dockerAPI.HostConfig(m.Config().ID)
+		Expect(hc).To(HaveKeyWithValue("Privileged", true))
+		Expect(hc["Binds"]).To(ConsistOf("/a:/b"))
+		Expect(hc["ExtraHosts"]).To(ConsistOf("db host:10.0.0.2"))
+	})
+	It("ignores the docker run flags it doesn't know", func() {
+		m, err := machine.New(types.DockerEngine, types.WithContainerHost(dockerHost), types.WithImage("alpine"),
+			withArgs("--oom-kill-disable", "--blkio-weight 300", "--pid=host", "--gpus", "all", "--privileged"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = m.Create(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(m.Clean)
+
+		hc := dockerAPI.HostConfig(m.Config().ID)
+		Expect(hc).To(HaveKeyWithValue("Privileged", true))
+		Expect(hc).To(HaveKeyWithValue("PidMode", "host"))
+		Expect(hc["DeviceRequests"]).To(ConsistOf(HaveKeyWithValue("Count", BeNumerically("==", -1))))
+	})
+	It("fails on invalid values of the docker run flags it knows", func() {
+		m, err := machine.New(types.DockerEngine, types.WithContainerHost(dockerHost), types.WithImage("alpine"),
+			withArgs("--memory lots"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = m.Create(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("invalid value lots of docker run flag --memory")))
+	})
+	It("sends files with their permissions and runs commands as given", func() {
+		m, err := machine.New(types.DockerEngine, types.WithContainerHost(dockerHost), types.WithImage("alpine"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = m.Create(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(m.Clean)
+
+		dir := GinkgoT().TempDir()
+		src := filepath.Join(dir, "script")
+		Expect(os.WriteFile(src, []byte("#!/bin/sh\necho \"it's sent\"\n"), 0600)).To(Succeed())
+		dst := filepath.Join(dir, "sent")
+		Expect(m.SendFile(src, dst, "0755")).To(Succeed())
+
+		out, err := m.Command("stat -c %a " + dst)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal("755\n"))
+		out, err = m.Command(dst)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal("it's sent\n"))
+		_, err = m.Command("exit 3")
+		Expect(err).To(MatchError(ContainSubstring("3")))
+	})
+	DescribeTable("boots the init of machine containers",
+		func(engine types.MachineOption, runtime string, opts ...types.MachineOption) {
+			m, err := machine.New(append(opts, engine, runtimeEndpoint(runtime))...)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = m.Create(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(m.Clean)
+
+			Expect(m.Restart(false)).To(Succeed())
+			Expect(m.State()).To(Equal(types.StateRunning))
+			out, err := m.Command("systemctl is-system-running")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out).To(Equal("running\n"))
+		},
+		Entry("docker with systemd", types.DockerEngine, "docker", types.WithImage("fedora"), types.WithInit("systemd")),
+		Entry("podman with systemd", types.PodmanEngine, "podman", types.WithImage("fedora"), types.WithInit("systemd")),
+		Entry("nerdctl with openrc", types.NerdctlEngine, "nerdctl", types.WithImage("alpine"), types.WithInit("openrc")),
+		Entry("docker with any init", types.DockerEngine, "docker", types.WithImage("alpine"), types.WithInit("/sbin/tini")),
+	)
+	DescribeTable("shuts containers down gracefully",
+		func(engine types.MachineOption, runtime string, opts ...types.MachineOption) {
+			m, err := machine.New(append(opts, engine, runtimeEndpoint(runtime))...)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = m.Create(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(m.Clean)
+
+			Expect(m.Shutdown(true, 30*time.Second)).To(Succeed())
+			Expect(m.State()).To(Equal(types.StateStopped))
+		},
+		Entry("docker without an init", types.DockerEngine, "docker", types.WithImage("alpine")),
+		Entry("docker with systemd", types.DockerEngine, "docker", types.WithImage("fedora"), types.WithInit("systemd")),
+		Entry("podman without an init", types.PodmanEngine, "podman", types.WithImage("alpine")),
+		Entry("nerdctl without an init", types.NerdctlEngine, "nerdctl", types.WithImage("alpine")),
+		Entry("nerdctl with openrc", types.NerdctlEngine, "nerdctl", types.WithImage("alpine"), types.WithInit("openrc")),
+	)
+})
+
+// runtimeEndpoint points machines to the fake API server of runtime, or to its fake CLI when it has none.
+func runtimeEndpoint(runtime string) types.MachineOption {
+	switch runtime {
+	case "docker":
+		return types.WithContainerHost(dockerHost)
+	case "podman":
+		return types.WithContainerHost(podmanHost)
+	}
+	return types.WithProcessName(fake.Bin(runtime))
+}
+
+// withArgs sets the args of the machine, which are read from the configuration file otherwise.
+func withArgs(args ...string) types.MachineOption {
+	return func(mc *types.MachineConfig) error {
+		mc.Args = args
+		return nil
+	}
+}
@@ -1,78 +1,775 @@
 package machine
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/spectrocloud/peg/internal/utils"
+	"github.com/spectrocloud/peg/pkg/controller"
 	"github.com/spectrocloud/peg/pkg/machine/types"
 )
 
+// dockerMachineLabel labels the containers and snapshot images of a machine with its ID.
+const dockerMachineLabel = "io.spectrocloud.peg.machine"
+
+// Docker runs machines as containers, through the Docker Engine API of docker or podman.
 type Docker struct {
 	machineConfig types.MachineConfig
+	client        *dockerClient
+
+	// defaultNetwork is the network the container was attached to when created, "bridge" with docker and "podman" with podman
+	defaultNetwork string
+	// networks the container was disconnected from by SetLinkUp
+	disconnected []string
+
+	// lifecycle is held while peg itself replaces the container, so monitoring doesn't take it for dead
+	lifecycle sync.Mutex
+	// stopped is set by Stop, the container exiting then is not a failure
+	stopped  atomic.Bool
+	creating atomic.Bool
 }
 
-func (q *Docker) whereIsDocker() string {
-	processName := "/usr/bin/docker"
-	if q.machineConfig.Process != "" {
-		processName = q.machineConfig.Process
+func (q *Docker) Create(ctx context.Context) (context.Context, error) {
+	log.Infof("Create %s machine", q.machineConfig.Engine)
+	q.creating.Store(true)
+	defer q.creating.Store(false)
+
+	if q.machineConfig.BaseImage != "" {
+		return ctx, errors.New("base images are supported only by the qemu engine")
+	}
+	if len(q.machineConfig.Networks) != 0 {
+		return ctx, errors.New("private networks are supported only by the qemu engine")
+	}
+
+	log.Infof("Starting %s container with %s. Image: %s", q.machineConfig.Engine, q.client.host, q.machineConfig.Image)
+
+	if err := q.run(q.machineConfig.Image); err != nil {
+		return ctx, err
 	}
-	return processName
+
+	q.stopped.Store(false)
+	return watch(ctx, q.alive, q.failed), nil
 }
 
-func (q *Docker) Create(ctx context.Context) (context.Context, error) {
-	log.Info("Create docker machine")
+// state returns the status and exit code of the container.
+func (q *Docker) state() (string, int, error) {
+	c, err := q.client.inspect(context.Background(), q.machineConfig.ID)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed inspecting container: %w", err)
+	}
+	return strings.ToLower(c.State.Status), c.State.ExitCode, nil
+}
 
-	processName := q.whereIsDocker()
+// alive polls the container state. A container that can't be found anymore is gone, which is a failure unless it was stopped.
+// Holding the lifecycle lock, containers replaced by peg itself (e.g. restoring snapshots) are not seen.
+func (q *Docker) alive() (bool, bool) {
+	q.lifecycle.Lock()
+	defer q.lifecycle.Unlock()
 
-	log.Infof("Starting Docker container with %s. Image: %s", processName, q.machineConfig.Image)
+	status, code, err := q.state()
+	if err != nil {
+		log.Debugf("Container %s is gone: %s", q.machineConfig.ID, err.Error())
+		return false, !q.stopped.Load()
+	}
+	if status != "exited" && status != "dead" {
+		return true, false
+	}
+	log.Infof("Container %s is not running anymore, status: %s, exit code: %d", q.machineConfig.ID, status, code)
+	return false, (status == "dead" || code != 0) && !q.stopped.Load()
+}
 
-	cmd := fmt.Sprintf("%s run %s --entrypoint /bin/sh -d -t --name %s %s", processName, strings.Join(q.machineConfig.Args, " "), q.machineConfig.ID, q.machineConfig.Image)
-	out, err := utils.SH(cmd)
+// failed calls OnFailure with the container logs.
+func (q *Docker) failed() {
+	if q.machineConfig.OnFailure == nil {
+		return
+	}
+
+	_, code, err := q.state()
 	if err != nil {
-		return ctx, fmt.Errorf("failed creating container: %w - cmd: %s, out: %s", err, cmd, out)
+		code = 1
+	}
+	out, _ := q.client.logs(context.Background(), q.machineConfig.ID)
+	q.machineConfig.OnFailure(deadGuest(q.machineConfig.StateDir, out, strconv.Itoa(code)))
+}
+
+// run starts the machine container from image, and waits for its init to boot if it has one.
+func (q *Docker) run(image string) error {
+	ctx := context.Background()
+	config := dockerContainerConfig{
+		Image:      image,
+		Entrypoint: []string{"/bin/sh"},
+		// the shell waits on the TTY
+		Tty:    true,
+		Labels: map[string]string{dockerMachineLabel: q.machineConfig.ID},
+	}
+	if err := applyRunArgs(&config, q.machineConfig.Args); err != nil {
+		return err
+	}
+	for _, p := range q.machineConfig.Ports {
+		port := fmt.Sprintf("%d/%s", p.Guest, p.Protocol)
+		if config.ExposedPorts == nil {
+			config.ExposedPorts = map[string]struct{}{}
+			config.HostConfig.PortBindings = map[string][]dockerPortBinding{}
+		}
+		config.ExposedPorts[port] = struct{}{}
+		config.HostConfig.PortBindings[port] = append(config.HostConfig.PortBindings[port], dockerPortBinding{HostIP: "127.0.0.1", HostPort: strconv.Itoa(p.Host)})
+	}
+	init := findInit(q.machineConfig.Container.Init)
+	if init != nil {
+		init.configure(&config, string(q.machineConfig.Engine))
+	}
+
+	if err := q.client.create(ctx, q.machineConfig.ID, config); err != nil {
+		return fmt.Errorf("failed creating container: %w", err)
+	}
+	if err := q.client.container(ctx, q.machineConfig.ID, "start", nil); err != nil {
+		return fmt.Errorf("failed starting container: %w", err)
+	}
+	if q.defaultNetwork == "" {
+		if networks, err := q.networks(); err == nil && len(networks) != 0 {
+			q.defaultNetwork = networks[0]
+		}
+	}
+	if init != nil {
+		return q.waitBoot(init)
+	}
+	return nil
+}
+
+// applyRunArgs applies the machine args to the container config. Args are the flags of `docker run` that make sense
+// for machines, split in words like a shell does, so an arg may hold several flags, e.g. "--privileged -v /a:/b".
+// Flags take their value as "--flag=value" or as the next word, boolean flags take none but "=false". Flags that
+// can't be given through the API are ignored with a warning.
+func applyRunArgs(config *dockerContainerConfig, args []string) error {
+	var words []string
+	for _, arg := range args {
+		w, err := shellSplit(arg)
+		if err != nil {
+			return fmt.Errorf("invalid args %s: %w", arg, err)
+		}
+		words = append(words, w...)
+	}
+
+	hc := &config.HostConfig
+	for i := 0; i < len(words); i++ {
+		flag, value, hasValue := strings.Cut(words[i], "=")
+		if !strings.HasPrefix(flag, "-") {
+			log.Warnf("Ignoring docker run arg %s, only flags can be given", words[i])
+			continue
+		}
+
+		if set, ok := runBoolFlags[flag]; ok {
+			b := true
+			if hasValue {
+				var err error
+				if b, err = strconv.ParseBool(value); err != nil {
+					return fmt.Errorf("invalid value %s of docker run flag %s", value, flag)
+				}
+			}
+			set(hc, b)
+			continue
+		}
+		next := !hasValue && i+1 < len(words)
+		if next {
+			value = words[i+1]
+		}
+		err := applyRunFlag(config, flag, value)
+		if errors.Is(err, errUnsupportedRunFlag) {
+			// unknown flags are taken to have a value when the next word isn't a flag
+			if next && !strings.HasPrefix(value, "-") {
+				i++
+			}
+			log.Warnf("Ignoring docker run flag %s, it can't be given through the Docker Engine API", flag)
+			continue
+		}
+		if !hasValue && !next {
+			return fmt.Errorf("docker run flag %s needs a value", flag)
+		}
+		if err != nil {
+			return err
+		}
+		if next {
+			i++
+		}
+	}
+	return nil
+}
+
+// errUnsupportedRunFlag is returned by applyRunFlag for the flags of `docker run` it doesn't know.
+var errUnsupportedRunFlag = errors.New("unsupported docker run flag")
+
+// shellSplit splits s in words like a shell does, honoring single and double quotes and backslash escapes.
+func shellSplit(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	var quote rune
+	inWord, escaped := false, false
+	for _, r := range s {
+		switch {
+		case escaped:
+			// in double quotes, backslashes only escape the characters special there
+			if quote == '"' && !strings.ContainsRune("\"\\$`", r) {
+				word.WriteRune('\\')
+			}
+			if r != '\n' {
+				word.WriteRune(r)
+			}
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inWord = true, true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if escaped || quote != 0 {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		words = append(words, word.String())
 	}
-	return ctx, nil
+	return words, nil
 }
+
+// runBoolFlags are the boolean flags of `docker run` machines can be given. --rm is accepted and has no effect,
+// the containers of machines are removed by Delete already, and must outlive Stop.
+var runBoolFlags = map[string]func(hc *dockerHostConfig, b bool){
+	"--privileged": func(hc *dockerHostConfig, b bool) { hc.Privileged = b },
+	"--init":       func(hc *dockerHostConfig, b bool) { hc.Init = &b },
+	"--read-only":  func(hc *dockerHostConfig, b bool) { hc.ReadonlyRootfs = b },
+	"--rm":         func(*dockerHostConfig, bool) {},
+}
+
+func applyRunFlag(config *dockerContainerConfig, flag, value string) error {
+	hc := &config.HostConfig
+	var err error
+	switch flag {
+	case "-e", "--env":
+		config.Env = append(config.Env, value)
+	case "-v", "--volume":
+		hc.Binds = append(hc.Binds, value)
+	case "--tmpfs":
+		dst, opts, _ := strings.Cut(value, ":")
+		if hc.Tmpfs == nil {
+			hc.Tmpfs = map[string]string{}
+		}
+		hc.Tmpfs[dst] = opts
+	case "--cap-add":
+		hc.CapAdd = append(hc.CapAdd, value)
+	case "--cap-drop":
+		hc.CapDrop = append(hc.CapDrop, value)
+	case "--security-opt":
+		hc.SecurityOpt = append(hc.SecurityOpt, value)
+	case "--network", "--net":
+		hc.NetworkMode = value
+	case "--pid":
+		hc.PidMode = value
+	case "--ipc":
+		hc.IpcMode = value
+	case "--add-host":
+		hc.ExtraHosts = append(hc.ExtraHosts, value)
+	case "--dns":
+		hc.DNS = append(hc.DNS, value)
+	case "--sysctl":
+		k, v, ok := strings.Cut(value, "=")
+		if !ok {
+			err = errors.New("not name=value")
+			break
+		}
+		if hc.Sysctls == nil {
+			hc.Sysctls = map[string]string{}
+		}
+		hc.Sysctls[k] = v
+	case "--mount":
+		var m dockerMount
+		if m, err = parseMount(value); err == nil {
+			hc.Mounts = append(hc.Mounts, m)
+		}
+	case "--gpus":
+		var r dockerDeviceRequest
+		if r, err = parseGPUs(value); err == nil {
+			hc.DeviceRequests = append(hc.DeviceRequests, r)
+		}
+	case "--cgroupns":
+		hc.CgroupnsMode = value
+	case "-u", "--user":
+		config.User = value
+	case "-w", "--workdir":
+		config.WorkingDir = value
+	case "-h", "--hostname":
+		config.Hostname = value
+	case "--stop-signal":
+		config.StopSignal = value
+	case "-l", "--label":
+		k, v, _ := strings.Cut(value, "=")
+		config.Labels[k] = v
+	case "-m", "--memory":
+		hc.Memory, err = parseBytes(value)
+	case "--memory-swap":
+		// -1 is unlimited swap
+		if value == "-1" {
+			hc.MemorySwap = -1
+		} else {
+			hc.MemorySwap, err = parseBytes(value)
+		}
+	case "--shm-size":
+		hc.ShmSize, err = parseBytes(value)
+	case "--cpus":
+		var cpus float64
+		if cpus, err = strconv.ParseFloat(value, 64); err == nil {
+			hc.NanoCpus = int64(cpus * 1e9)
+		}
+	case "--device":
+		hc.Devices = append(hc.Devices, parseDevice(value))
+	case "--ulimit":
+		var u dockerUlimit
+		if u, err = parseUlimit(value); err == nil {
+			hc.Ulimits = append(hc.Ulimits, u)
+		}
+	default:
+		return errUnsupportedRunFlag
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %s of docker run flag %s: %w", value, flag, err)
+	}
+	return nil
+}
+
+// parseBytes parses a size like docker does, a number of bytes with an optional b, k, m or g unit, e.g. 512m.
+func parseBytes(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.ToLower(s), "b")
+	mult := int64(1)
+	if n := len(num); n > 0 {
+		switch num[n-1] {
+		case 'k':
+			mult = 1 << 10
+		case 'm':
+			mult = 1 << 20
+		case 'g':
+			mult = 1 << 30
+		}
+		if mult != 1 {
+			num = num[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size %s", s)
+	}
+	return int64(f * float64(mult)), nil
+}
+
+// parseDevice parses a device given as host[:container][:permissions].
+func parseDevice(s string) dockerDevice {
+	d := dockerDevice{CgroupPermissions: "rwm"}
+	parts := strings.Split(s, ":")
+	d.PathOnHost, d.PathInContainer = parts[0], parts[0]
+	switch len(parts) {
+	case 2:
+		if strings.HasPrefix(parts[1], "/") {
+			d.PathInContainer = parts[1]
+		} else {
+			d.CgroupPermissions = parts[1]
+		}
+	case 3:
+		d.PathInContainer, d.CgroupPermissions = parts[1], parts[2]
+	}
+	return d
+}
+
+// parseUlimit parses a ulimit given as name=soft[:hard].
+func parseUlimit(s string) (dockerUlimit, error) {
+	name, limits, ok := strings.Cut(s, "=")
+	if !ok {
+		return dockerUlimit{}, fmt.Errorf("ulimit %s is not name=soft[:hard]", s)
+	}
+	soft, hard, ok := strings.Cut(limits, ":")
+	if !ok {
+		hard = soft
+	}
+	u := dockerUlimit{Name: name}
+	var err error
+	if u.Soft, err = strconv.ParseInt(soft, 10, 64); err != nil {
+		return u, err
+	}
+	u.Hard, err = strconv.ParseInt(hard, 10, 64)
+	return u, err
+}
+
+// parseMount parses a mount given as comma separated key=value, e.g. type=bind,source=/a,target=/b,readonly.
+func parseMount(s string) (dockerMount, error) {
+	m := dockerMount{Type: "volume"}
+	for _, field := range strings.Split(s, ",") {
+		k, v, hasValue := strings.Cut(field, "=")
+		switch k {
+		case "type":
+			m.Type = v
+		case "source", "src":
+			m.Source = v
+		case "target", "destination", "dst":
+			m.Target = v
+		case "readonly", "ro":
+			m.ReadOnly = true
+			if hasValue {
+				var err error
+				if m.ReadOnly, err = strconv.ParseBool(v); err != nil {
+					return m, err
+				}
+			}
+		default:
+			log.Warnf("Ignoring option %s of mount %s", k, s)
+		}
+	}
+	if m.Target == "" {
+		return m, fmt.Errorf("mount %s has no target", s)
+	}
+	return m, nil
+}
+
+// parseGPUs parses the GPUs to request, all, a count or device=id[,id].
+func parseGPUs(s string) (dockerDeviceRequest, error) {
+	r := dockerDeviceRequest{Capabilities: [][]string{{"gpu"}}}
+	switch {
+	case s == "all":
+		r.Count = -1
+	case strings.HasPrefix(s, "device="):
+		r.DeviceIDs = strings.Split(strings.TrimPrefix(s, "device="), ",")
+	default:
+		count, err := strconv.Atoi(s)
+		if err != nil {
+			return r, fmt.Errorf("gpus %s is not all, a count or device=id[,id]", s)
+		}
+		r.Count = count
+	}
+	return r, nil
+}
+
+// waitBoot waits for the init of the container to be done booting.
+func (q *Docker) waitBoot(init *containerInit) error {
+	ctx, cancel := context.WithTimeout(context.Background(), containerBootTimeout)
+	defer cancel()
+
+	for {
+		out, err := q.CommandContext(ctx, init.ready)
+		if init.booted(out, err) {
+			return nil
+		}
+		if status, code, err := q.state(); err == nil && (status == "exited" || status == "dead") {
+			logs, _ := q.client.logs(ctx, q.machineConfig.ID)
+			return fmt.Errorf("%s exited with code %d while booting - %s", init.name, code, logs)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %s to boot: %w - %s", init.name, ctx.Err(), out)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Snapshot commits the container filesystem to an image. Running processes are not part of it.
+func (q *Docker) Snapshot(name string) error {
+	labels := map[string]string{dockerMachineLabel: q.machineConfig.ID}
+	if err := q.client.commit(context.Background(), q.machineConfig.ID, snapshotRepository(q.machineConfig.ID), name, labels); err != nil {
+		return fmt.Errorf("failed committing container: %w", err)
+	}
+	return nil
+}
+
+// Restore replaces the container with a new one started from the named snapshot.
+func (q *Docker) Restore(name string) error {
+	if err := hasSnapshot(q, name); err != nil {
+		return err
+	}
+
+	q.lifecycle.Lock()
+	defer q.lifecycle.Unlock()
+
+	if err := q.client.remove(context.Background(), q.machineConfig.ID); err != nil {
+		return fmt.Errorf("failed deleting container: %w", err)
+	}
+	// The new container starts with its networks connected
+	q.disconnected = nil
+	return q.run(fmt.Sprintf("%s:%s", snapshotRepository(q.machineConfig.ID), name))
+}
+
+// ListSnapshots returns the snapshots of the machine, the tags of the images labelled with it in the snapshot repository.
+func (q *Docker) ListSnapshots() ([]string, error) {
+	tags, err := q.client.images(context.Background(), dockerMachineLabel+"="+q.machineConfig.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing snapshots: %w", err)
+	}
+	snapshots := []string{}
+	for _, t := range tags {
+		if name, ok := strings.CutPrefix(t, snapshotRepository(q.machineConfig.ID)+":"); ok {
+			snapshots = append(snapshots, name)
+		}
+	}
+	return snapshots, nil
+}
+
 func (q *Docker) Screenshot() (string, error) {
+	return q.ScreenshotContext(context.Background())
+}
+
+func (q *Docker) ScreenshotContext(_ context.Context) (string, error) {
 	return "", errors.New("Screenshot is not implemented in docker machine")
 }
 
+// networks returns the networks the container is attached to.
+func (q *Docker) networks() ([]string, error) {
+	c, err := q.client.inspect(context.Background(), q.machineConfig.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing container networks: %w", err)
+	}
+	networks := []string{}
+	for n := range c.NetworkSettings.Networks {
+		networks = append(networks, n)
+	}
+	sort.Strings(networks)
+	return networks, nil
+}
+
+// SetLinkUp disconnects the container from the given networks, or reconnects it. The default network is the one
+// the container was attached to when created, e.g. the docker "bridge" one. When no network is given, the container
+// is disconnected from all of its networks, or reconnected to all the networks it was disconnected from.
+func (q *Docker) SetLinkUp(up bool, networks ...string) error {
+	ctx := context.Background()
+	nets := []string{}
+	for _, n := range networks {
+		if n == types.DefaultNetwork {
+			n = q.defaultNetwork
+		}
+		nets = append(nets, n)
+	}
+
+	if up {
+		if len(nets) == 0 {
+			nets = q.disconnected
+		}
+		for _, n := range nets {
+			if err := q.client.network(ctx, q.machineConfig.ID, n, true); err != nil {
+				return fmt.Errorf("failed connecting to network %s: %w", n, err)
+			}
+			q.disconnected = remove(q.disconnected, n)
+		}
+		return nil
+	}
+
+	if len(nets) == 0 {
+		var err error
+		if nets, err = q.networks(); err != nil {
+			return err
+		}
+	}
+	for _, n := range nets {
+		if err := q.client.network(ctx, q.machineConfig.ID, n, false); err != nil {
+			return fmt.Errorf("failed disconnecting from network %s: %w", n, err)
+		}
+		q.disconnected = append(remove(q.disconnected, n), n)
+	}
+	return nil
+}
+
+// SetNetworkConditions adds packet loss and latency to the container network with netem.
+// The container needs the NET_ADMIN capability and tc.
+func (q *Docker) SetNetworkConditions(c types.NetworkConditions) error {
+	return controller.SetNetworkConditionsWith(context.Background(), q, "/bin/sh", c)
+}
+
+func remove(s []string, e string) []string {
+	res := []string{}
+	for _, ss := range s {
+		if ss != e {
+			res = append(res, ss)
+		}
+	}
+	return res
+}
+
+// HostPort returns the host port a guest port is forwarded to.
+func (q *Docker) HostPort(guestPort int) (int, error) {
+	return hostPort(q.machineConfig, guestPort)
+}
+
+// Addresses returns no address, docker machines can't be attached to private networks.
+func (q *Docker) Addresses(_ context.Context) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+// Console returns the container logs, which is the closest thing to a console a container has.
+func (q *Docker) Console() (io.ReadCloser, error) {
+	out, err := q.client.logs(context.Background(), q.machineConfig.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting container logs: %w", err)
+	}
+	return io.NopCloser(strings.NewReader(out)), nil
+}
+
+func (q *Docker) SendKeys(_ ...string) error {
+	return errors.New("SendKeys is not implemented in docker machine")
+}
+
+func (q *Docker) TypeText(_ string) error {
+	return errors.New("TypeText is not implemented in docker machine")
+}
+
 func (q *Docker) Config() types.MachineConfig {
 	return q.machineConfig
 }
 
 func (q *Docker) Stop() error {
-	out, err := utils.SH(fmt.Sprintf("%s stop %s", q.whereIsDocker(), q.machineConfig.ID))
+	q.stopped.Store(true)
+	return q.container("stop", 0)
+}
+
+// State returns the container state reported by docker.
+func (q *Docker) State() (types.State, error) {
+	if q.creating.Load() {
+		return types.StateCreating, nil
+	}
+
+	status, code, err := q.state()
 	if err != nil {
-		return fmt.Errorf("failed stopping container: %w - %s", err, out)
+		if isDockerNotFound(err) {
+			return types.StateGone, nil
+		}
+		return "", err
+	}
+
+	switch status {
+	case "running":
+		return types.StateRunning, nil
+	case "paused":
+		return types.StatePaused, nil
+	case "created", "restarting":
+		return types.StateCreating, nil
+	case "exited":
+		if code == 0 || q.stopped.Load() {
+			return types.StateStopped, nil
+		}
+		return types.StateCrashed, nil
+	case "dead":
+		return types.StateCrashed, nil
+	default:
+		// removing
+		return types.StateGone, nil
+	}
+}
+
+func (q *Docker) Pause() error {
+	return q.container("pause", -1)
+}
+
+func (q *Docker) Resume() error {
+	return q.container("unpause", -1)
+}
+
+// Restart restarts the container, killing it right away when hard. Containers booting an init are
+// restarted once it booted again.
+func (q *Docker) Restart(hard bool) error {
+	q.lifecycle.Lock()
+	defer q.lifecycle.Unlock()
+
+	timeout := -1
+	if hard {
+		timeout = 0
+	}
+	if err := q.container("restart", timeout); err != nil {
+		return err
+	}
+	if init := findInit(q.machineConfig.Container.Init); init != nil {
+		return q.waitBoot(init)
 	}
 	return nil
 }
 
-func (q *Docker) Clean() error {
-	out, err := utils.SH(fmt.Sprintf("%s rm %s", q.whereIsDocker(), q.machineConfig.ID))
-	if err != nil {
-		return fmt.Errorf("failed deleting container: %w - %s", err, out)
+// Shutdown stops the container. When graceful, the init of the container is sent its stop signal and
+// killed if it didn't exit within timeout. Containers without an init are killed right away.
+func (q *Docker) Shutdown(graceful bool, timeout time.Duration) error {
+	// The shell run instead of an init ignores the stop signal as pid 1, and has nothing to shut down
+	if !graceful || findInit(q.machineConfig.Container.Init) == nil {
+		return q.Stop()
 	}
-	out, err = utils.SH(fmt.Sprintf("%s rmi %s", q.whereIsDocker(), q.machineConfig.Image))
-	if err != nil {
-		log.Warn("failed deleting image: %w s %s", err.Error(), out)
+
+	q.stopped.Store(true)
+	if err := q.container("stop", int(timeout.Seconds())); err != nil {
+		return err
+	}
+	// docker stop kills the container silently on timeout
+	if _, code, err := q.state(); err == nil && code == 137 {
+		return types.ErrShutdownTimeout
 	}
 	return nil
 }
 
-func (q *Docker) Alive() bool {
-	out, err := utils.SH(fmt.Sprintf("%s container inspect -f '{{.State.Running}}' %s", q.whereIsDocker(), q.machineConfig.Image))
+// container runs an action on the container. Actions stopping it wait for timeout seconds before killing it,
+// or for the default of the container when negative.
+func (q *Docker) container(action string, timeout int) error {
+	query := url.Values{}
+	if timeout >= 0 {
+		query.Set("t", strconv.Itoa(timeout))
+	}
+	if err := q.client.container(context.Background(), q.machineConfig.ID, action, query); err != nil {
+		return fmt.Errorf("failed running %s: %w", action, err)
+	}
+	return nil
+}
+
+// Clean removes the container, its image and the snapshot images labelled with the machine.
+func (q *Docker) Clean() error {
+	ctx := context.Background()
+	q.stopped.Store(true)
+	if err := q.client.remove(ctx, q.machineConfig.ID); err != nil && !isDockerNotFound(err) {
+		return fmt.Errorf("failed deleting container: %w", err)
+	}
+	if err := q.client.removeImage(ctx, q.machineConfig.Image); err != nil {
+		log.Warnf("failed deleting image: %s", err.Error())
+	}
+	snapshots, err := q.ListSnapshots()
 	if err != nil {
-		return false
+		log.Warnf("failed listing snapshots: %s", err.Error())
 	}
-	if strings.Contains(out, "true") {
-		return true
+	for _, s := range snapshots {
+		if err := q.client.removeImage(ctx, fmt.Sprintf("%s:%s", snapshotRepository(q.machineConfig.ID), s)); err != nil {
+			log.Warnf("failed deleting snapshot %s: %s", s, err.Error())
+		}
 	}
-	return false
+	return nil
+}
+
+func (q *Docker) Alive() bool {
+	s, err := q.State()
+	return err == nil && (s == types.StateRunning || s == types.StatePaused)
 }
 
 func (q *Docker) CreateDisk(_, _ string) error {
@@ -80,10 +777,44 @@ func (q *Docker) CreateDisk(_, _ string) error {
 }
 
 func (q *Docker) Command(cmd string) (string, error) {
-	generatedCmd := fmt.Sprintf("%s exec %s /bin/sh -c '%s'", q.whereIsDocker(), q.machineConfig.ID, cmd)
-	log.Infof("Running command: ", generatedCmd)
+	return q.CommandContext(context.Background(), cmd)
+}
+
+// CommandContext runs cmd in the container, killing it if ctx is done before it exits.
+func (q *Docker) CommandContext(ctx context.Context, cmd string) (string, error) {
+	log.Infof("Running command in %s: %s", q.machineConfig.ID, cmd)
+
+	out := &lockedBuffer{}
+	err := q.client.exec(ctx, q.machineConfig.ID, []string{"/bin/sh", "-c", cmd}, nil, out, out)
+	return out.String(), err
+}
+
+// dockerSignals maps the exit codes of commands killed by a signal (128+n) to the signal name.
+var dockerSignals = map[int]string{
+	129: "HUP", 130: "INT", 131: "QUIT", 134: "ABRT", 137: "KILL", 139: "SEGV", 141: "PIPE", 143: "TERM",
+}
+
+func (q *Docker) Run(ctx context.Context, cmd string, opts ...types.RunOption) (*types.CommandResult, error) {
+	c := types.NewRunConfig(opts...)
 
-	return utils.SH(generatedCmd)
+	var stdout, stderr bytes.Buffer
+	outW, errW := c.Tee(&stdout, &stderr)
+
+	start := time.Now()
+	err := q.client.exec(ctx, q.machineConfig.ID, []string{"/bin/sh", "-c", c.Command(cmd)}, c.Stdin, outW, errW)
+	res := &types.CommandResult{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Duration: time.Since(start),
+	}
+
+	var exitErr *dockerExitError
+	if !errors.As(err, &exitErr) {
+		return res, err
+	}
+	res.ExitCode = exitErr.code
+	res.Signal = dockerSignals[res.ExitCode]
+	return res, nil
 }
 
 func (q *Docker) DetachCD() error {
@@ -91,17 +822,33 @@ func (q *Docker) DetachCD() error {
 }
 
 func (q *Docker) ReceiveFile(src, dst string) error {
-	out, err := utils.SH(fmt.Sprintf("%s cp %s:%s %s", q.whereIsDocker(), q.machineConfig.ID, src, dst))
+	return q.ReceiveFileContext(context.Background(), src, dst)
+}
+
+// ReceiveFileContext copies src from the container to dst, from a tar archive of it.
+func (q *Docker) ReceiveFileContext(ctx context.Context, src, dst string) error {
+	r, err := q.client.getArchive(ctx, q.machineConfig.ID, src)
 	if err != nil {
-		return fmt.Errorf("failed receiving file from container: %w - %s", err, out)
+		return fmt.Errorf("failed receiving file from container: %w", err)
 	}
-	return nil
+	defer r.Close()
+	return receiveTar(r, dst)
+}
+
+func (q *Docker) SendFile(src, dst, permissions string) error {
+	return q.SendFileContext(context.Background(), src, dst, permissions)
 }
 
-func (q *Docker) SendFile(src, dst, _ string) error {
-	out, err := utils.SH(fmt.Sprintf("%s cp %s %s:%s", q.whereIsDocker(), src, q.machineConfig.ID, dst))
+// SendFileContext copies src to dst in the container, as a tar archive giving it the permissions.
+func (q *Docker) SendFileContext(ctx context.Context, src, dst, permissions string) error {
+	r, err := tarFile(src, path.Base(dst), permissions)
 	if err != nil {
-		return fmt.Errorf("failed receiving file from container: %w - %s", err, out)
+		return err
+	}
+	defer r.Close()
+
+	if err := q.client.putArchive(ctx, q.machineConfig.ID, path.Dir(dst), r); err != nil {
+		return fmt.Errorf("failed sending file to container: %w", err)
 	}
 	return nil
 }
@@ -0,0 +1,522 @@
+package machine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// dockerAPIVersion is the version of the Docker Engine API used, served by docker 20.10 and podman 3 onwards.
+const dockerAPIVersion = "v1.41"
+
+// dockerClient is a client of the Docker Engine API, served by docker and podman.
+type dockerClient struct {
+	host string
+	// base is the URL requests are sent to, connections are opened by dial whatever the host in it
+	base string
+	dial func(ctx context.Context) (net.Conn, error)
+	http *http.Client
+}
+
+// newDockerClient returns a client of the API served at host, unix:///path/to/socket or tcp://host:port.
+func newDockerClient(host string) (*dockerClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %s: %w", host, err)
+	}
+
+	var d net.Dialer
+	c := &dockerClient{host: host}
+	switch u.Scheme {
+	case "unix":
+		c.base = "http://docker"
+		c.dial = func(ctx context.Context) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", u.Path)
+		}
+	case "tcp", "http":
+		c.base = "http://" + u.Host
+		c.dial = func(ctx context.Context) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", u.Host)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported docker host %s, only unix and tcp hosts are", host)
+	}
+	c.http = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return c.dial(ctx)
+		},
+	}}
+	return c, nil
+}
+
+// dockerError is an error returned by the API.
+type dockerError struct {
+	status  int
+	Message string `json:"message"`
+}
+
+func (e *dockerError) Error() string {
+	return e.Message
+}
+
+// isDockerNotFound tells whether err is the API reporting a missing container, image or network.
+func isDockerNotFound(err error) bool {
+	var de *dockerError
+	return errors.As(err, &de) && de.status == http.StatusNotFound
+}
+
+// dockerExitError is returned when a command run in a container exits with a non-zero code.
+type dockerExitError struct {
+	code int
+}
+
+func (e *dockerExitError) Error() string {
+	return fmt.Sprintf("command exited with code %d", e.code)
+}
+
+func (c *dockerClient) url(path string, query url.Values) string {
+	u := c.base + "/" + dockerAPIVersion + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// newRequest returns a request to the API. in is sent as JSON, or as a tar archive when it is a reader.
+func (c *dockerClient) newRequest(ctx context.Context, method, path string, query url.Values, in interface{}) (*http.Request, error) {
+	var body io.Reader
+	contentType := ""
+	switch in := in.(type) {
+	case nil:
+	case io.Reader:
+		body, contentType = in, "application/x-tar"
+	default:
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body, contentType = bytes.NewReader(b), "application/json"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path, query), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req, nil
+}
+
+// request sends a request to the API and returns its response, unless it is an error.
+func (c *dockerClient) request(ctx context.Context, method, path string, query url.Values, in interface{}) (*http.Response, error) {
+	req, err := c.newRequest(ctx, method, path, query, in)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed reaching docker at %s: %w", c.host, err)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		return nil, readDockerError(resp)
+	}
+	return resp, nil
+}
+
+func readDockerError(resp *http.Response) error {
+	b, _ := io.ReadAll(resp.Body)
+	e := &dockerError{status: resp.StatusCode}
+	if err := json.Unmarshal(b, e); err != nil || e.Message == "" {
+		e.Message = fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return e
+}
+
+// do sends a request to the API, decoding its JSON response into out unless out is nil.
+func (c *dockerClient) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	resp, err := c.request(ctx, method, path, query, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// dockerContainerConfig is the configuration containers are created with.
+type dockerContainerConfig struct {
+	Image        string
+	Entrypoint   []string
+	Tty          bool
+	Env          []string            `json:",omitempty"`
+	User         string              `json:",omitempty"`
+	WorkingDir   string              `json:",omitempty"`
+	Hostname     string              `json:",omitempty"`
+	StopSignal   string              `json:",omitempty"`
+	Labels       map[string]string   `json:",omitempty"`
+	ExposedPorts map[string]struct{} `json:",omitempty"`
+	HostConfig   dockerHostConfig
+}
+
+type dockerHostConfig struct {
+	PortBindings   map[string][]dockerPortBinding `json:",omitempty"`
+	Binds          []string                       `json:",omitempty"`
+	Tmpfs          map[string]string              `json:",omitempty"`
+	Privileged     bool                           `json:",omitempty"`
+	CgroupnsMode   string                         `json:",omitempty"`
+	CapAdd         []string                       `json:",omitempty"`
+	CapDrop        []string                       `json:",omitempty"`
+	SecurityOpt    []string                       `json:",omitempty"`
+	NetworkMode    string                         `json:",omitempty"`
+	Init           *bool                          `json:",omitempty"`
+	ReadonlyRootfs bool                           `json:",omitempty"`
+	Memory         int64                          `json:",omitempty"`
+	MemorySwap     int64                          `json:",omitempty"`
+	NanoCpus       int64                          `json:",omitempty"`
+	ShmSize        int64                          `json:",omitempty"`
+	Devices        []dockerDevice                 `json:",omitempty"`
+	Ulimits        []dockerUlimit                 `json:",omitempty"`
+	PidMode        string                         `json:",omitempty"`
+	IpcMode        string                         `json:",omitempty"`
+	ExtraHosts     []string                       `json:",omitempty"`
+	DNS            []string                       `json:"Dns,omitempty"`
+	Sysctls        map[string]string              `json:",omitempty"`
+	Mounts         []dockerMount                  `json:",omitempty"`
+	DeviceRequests []dockerDeviceRequest          `json:",omitempty"`
+}
+
+type dockerMount struct {
+	Type     string
+	Source   string `json:",omitempty"`
+	Target   string
+	ReadOnly bool `json:",omitempty"`
+}
+
+type dockerDeviceRequest struct {
+	Count        int        `json:",omitempty"`
+	DeviceIDs    []string   `json:",omitempty"`
+	Capabilities [][]string `json:",omitempty"`
+}
+
+type dockerDevice struct {
+	PathOnHost        string
+	PathInContainer   string
+	CgroupPermissions string
+}
+
+type dockerUlimit struct {
+	Name string
+	Soft int64
+	Hard int64
+}
+
+type dockerPortBinding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string
+}
+
+// dockerContainer is the part of the inspected state of containers peg looks at.
+type dockerContainer struct {
+	State struct {
+		Status   string
+		ExitCode int
+	}
+	NetworkSettings struct {
+		Networks map[string]json.RawMessage
+	}
+}
+
+// create creates the container name, pulling its image when missing.
+func (c *dockerClient) create(ctx context.Context, name string, config dockerContainerConfig) error {
+	query := url.Values{"name": {name}}
+	err := c.do(ctx, http.MethodPost, "/containers/create", query, config, nil)
+	if !isDockerNotFound(err) {
+		return err
+	}
+	if err := c.pull(ctx, config.Image); err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, "/containers/create", query, config, nil)
+}
+
+// pull pulls image, tagged latest when it has neither a tag nor a digest. Pull errors are reported in the progress stream.
+func (c *dockerClient) pull(ctx context.Context, image string) error {
+	// without a tag, every tag of the repository is pulled
+	query := url.Values{"fromImage": {image}}
+	if i := strings.LastIndex(image, ":"); !strings.Contains(image, "@") && (i < 0 || strings.Contains(image[i:], "/")) {
+		query.Set("tag", "latest")
+	}
+	resp, err := c.request(ctx, http.MethodPost, "/images/create", query, nil)
+	if err != nil {
+		return fmt.Errorf("failed pulling %s: %w", image, err)
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var progress struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&progress); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed pulling %s: %w", image, err)
+		}
+		if progress.Error != "" {
+			return fmt.Errorf("failed pulling %s: %s", image, progress.Error)
+		}
+	}
+}
+
+// inspect returns the state of the container.
+func (c *dockerClient) inspect(ctx context.Context, id string) (*dockerContainer, error) {
+	container := &dockerContainer{}
+	return container, c.do(ctx, http.MethodGet, "/containers/"+id+"/json", nil, nil, container)
+}
+
+// container runs an action on the container, e.g. "start" or "pause".
+func (c *dockerClient) container(ctx context.Context, id, action string, query url.Values) error {
+	return c.do(ctx, http.MethodPost, "/containers/"+id+"/"+action, query, nil, nil)
+}
+
+// remove removes the container, killing it first if it is running.
+func (c *dockerClient) remove(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/containers/"+id, url.Values{"force": {"1"}}, nil, nil)
+}
+
+// logs returns the output of the container, which runs with a TTY so it is not multiplexed.
+func (c *dockerClient) logs(ctx context.Context, id string) (string, error) {
+	resp, err := c.request(ctx, http.MethodGet, "/containers/"+id+"/logs", url.Values{"stdout": {"1"}, "stderr": {"1"}}, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return string(b), err
+}
+
+// putArchive extracts the tar archive r in the directory dir of the container.
+func (c *dockerClient) putArchive(ctx context.Context, id, dir string, r io.Reader) error {
+	return c.do(ctx, http.MethodPut, "/containers/"+id+"/archive", url.Values{"path": {dir}}, r, nil)
+}
+
+// getArchive returns a tar archive of path in the container.
+func (c *dockerClient) getArchive(ctx context.Context, id, path string) (io.ReadCloser, error) {
+	resp, err := c.request(ctx, http.MethodGet, "/containers/"+id+"/archive", url.Values{"path": {path}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// network connects the container to network, or disconnects it.
+func (c *dockerClient) network(ctx context.Context, id, network string, connect bool) error {
+	action := "disconnect"
+	if connect {
+		action = "connect"
+	}
+	return c.do(ctx, http.MethodPost, "/networks/"+network+"/"+action, nil, map[string]string{"Container": id}, nil)
+}
+
+// commit saves the filesystem of the container as the image repository:tag, with labels on top of the container ones.
+func (c *dockerClient) commit(ctx context.Context, id, repository, tag string, labels map[string]string) error {
+	query := url.Values{"container": {id}, "repo": {repository}, "tag": {tag}}
+	return c.do(ctx, http.MethodPost, "/commit", query, map[string]interface{}{"Labels": labels}, nil)
+}
+
+// images returns the tags (repository:tag) of the images with the label, given as key=value.
+func (c *dockerClient) images(ctx context.Context, label string) ([]string, error) {
+	filters, err := json.Marshal(map[string][]string{"label": {label}})
+	if err != nil {
+		return nil, err
+	}
+	images := []struct {
+		RepoTags []string
+	}{}
+	if err := c.do(ctx, http.MethodGet, "/images/json", url.Values{"filters": {string(filters)}}, nil, &images); err != nil {
+		return nil, err
+	}
+	tags := []string{}
+	for _, i := range images {
+		tags = append(tags, i.RepoTags...)
+	}
+	return tags, nil
+}
+
+// removeImage untags the image name, removing it once it has no tag left.
+func (c *dockerClient) removeImage(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/images/"+name, nil, nil, nil)
+}
+
+// exec runs cmd in the container, feeding it stdin and demultiplexing its output to stdout and stderr.
+// A non-zero exit is returned as a dockerExitError. The command is detached from once ctx is done.
+func (c *dockerClient) exec(ctx context.Context, id string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (err error) {
+	var created struct {
+		ID string `json:"Id"`
+	}
+	marker := newExecMarker()
+	config := map[string]interface{}{
+		"Cmd":          cmd,
+		"Env":          []string{marker},
+		"AttachStdin":  stdin != nil,
+		"AttachStdout": true,
+		"AttachStderr": true,
+	}
+	if err := c.do(ctx, http.MethodPost, "/containers/"+id+"/exec", nil, config, &created); err != nil {
+		return err
+	}
+	// the daemon leaves the command running when the client goes away
+	defer func() {
+		if ctx.Err() != nil {
+			c.killExec(id, marker)
+		}
+	}()
+
+	conn, err := c.hijack(ctx, "/exec/"+created.ID+"/start", map[string]interface{}{"Detach": false, "Tty": false})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// closing the connection ends the streams
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if stdin != nil {
+		go func() {
+			_, _ = io.Copy(conn, stdin)
+			_ = conn.CloseWrite()
+		}()
+	}
+	err = demux(conn, stdout, stderr)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed reading command output: %w", err)
+	}
+
+	// the exit code is recorded right after the streams end
+	for {
+		var inspect struct {
+			Running  bool
+			ExitCode int
+		}
+		if err := c.do(ctx, http.MethodGet, "/exec/"+created.ID+"/json", nil, nil, &inspect); err != nil {
+			return err
+		}
+		if !inspect.Running {
+			if inspect.ExitCode != 0 {
+				return &dockerExitError{code: inspect.ExitCode}
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// killExec kills the processes of container id with marker in their environment. Exec instances can't be stopped
+// through the API, and the pid the daemon reports is not the one in the container.
+func (c *dockerClient) killExec(id, marker string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := c.exec(ctx, id, []string{"/bin/sh", "-c", killMarkedScript(marker)}, nil, io.Discard, io.Discard); err != nil {
+		log.Debugf("Failed killing cancelled command in %s: %s", id, err.Error())
+	}
+}
+
+// hijackedConn is a connection taken over from HTTP, which may have buffered the first bytes of the stream.
+type hijackedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite ends the input of the stream.
+func (c *hijackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// hijack sends a request upgraded to a raw stream, like docker does to attach to commands.
+func (c *dockerClient) hijack(ctx context.Context, path string, in interface{}) (*hijackedConn, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, path, nil, in)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed reaching docker at %s: %w", c.host, err)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// 101 Switching Protocols, or 200 from older daemons
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer conn.Close()
+		return nil, readDockerError(resp)
+	}
+	return &hijackedConn{Conn: conn, r: r}, nil
+}
+
+// demux copies the multiplexed output of a command to stdout and stderr. Frames start with the stream
+// (1 for stdout, 2 for stderr) and the big endian size of the payload.
+func demux(r io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var w io.Writer
+		switch header[0] {
+		case 1:
+			w = stdout
+		case 2:
+			w = stderr
+		}
+		if w == nil {
+			w = io.Discard
+		}
+		if _, err := io.CopyN(w, r, int64(binary.BigEndian.Uint32(header[4:]))); err != nil {
+			return err
+		}
+	}
+}
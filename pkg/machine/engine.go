@@ -0,0 +1,131 @@
+package machine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// Capabilities flags the optional features an engine implements. Machines of engines
+// lacking one return an error, or do nothing, from the corresponding methods.
+type Capabilities uint
+
+const (
+	// CapScreenshot is taking screenshots of the machine display.
+	CapScreenshot Capabilities = 1 << iota
+	// CapSnapshot is saving and restoring snapshots.
+	CapSnapshot
+	// CapDetachCD is ejecting the ISO the machine booted from.
+	CapDetachCD
+	// CapSerialConsole is reading the machine serial console with Console.
+	CapSerialConsole
+)
+
+// Has tells whether all the capabilities of c are in caps.
+func (caps Capabilities) Has(c Capabilities) bool {
+	return caps&c == c
+}
+
+func (caps Capabilities) String() string {
+	names := []string{}
+	for c, n := range map[Capabilities]string{
+		CapScreenshot:    "screenshot",
+		CapSnapshot:      "snapshot",
+		CapDetachCD:      "detach-cd",
+		CapSerialConsole: "serial-console",
+	} {
+		if caps.Has(c) {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// EngineFactory returns a machine of an engine. The config is already prepared: ID, state directory,
+// SSH and forwarded ports are set and the ISOs are downloaded.
+type EngineFactory func(mc types.MachineConfig) (types.Machine, error)
+
+type engine struct {
+	factory      EngineFactory
+	capabilities Capabilities
+}
+
+var (
+	enginesLock sync.RWMutex
+	engines     = map[types.Engine]engine{}
+)
+
+func init() {
+	RegisterEngine(types.QEMU, func(mc types.MachineConfig) (types.Machine, error) {
+		return &QEMU{machineConfig: mc}, nil
+	}, CapScreenshot|CapSnapshot|CapDetachCD|CapSerialConsole)
+	RegisterEngine(types.VBox, func(mc types.MachineConfig) (types.Machine, error) {
+		return &VBox{machineConfig: mc}, nil
+	}, CapScreenshot|CapSnapshot|CapDetachCD|CapSerialConsole)
+	RegisterEngine(types.Docker, newContainer, CapSnapshot)
+	RegisterEngine(types.Podman, newContainer, CapSnapshot)
+	RegisterEngine(types.Nerdctl, newContainer, CapSnapshot)
+	RegisterEngine(types.Kubernetes, newKubernetes, 0)
+}
+
+// RegisterEngine makes an engine available to New, for machine configs with Engine set to name.
+// It is meant to be called from the init function of the package implementing the engine, and
+// panics if the name is taken or factory is nil.
+func RegisterEngine(name types.Engine, factory EngineFactory, caps Capabilities) {
+	enginesLock.Lock()
+	defer enginesLock.Unlock()
+
+	if factory == nil {
+		panic("machine: RegisterEngine factory is nil")
+	}
+	if _, ok := engines[name]; ok {
+		panic(fmt.Sprintf("machine: engine %s is already registered", name))
+	}
+	engines[name] = engine{factory: factory, capabilities: caps}
+}
+
+// Engines returns the names of the registered engines, sorted.
+func Engines() []types.Engine {
+	enginesLock.RLock()
+	defer enginesLock.RUnlock()
+
+	names := []types.Engine{}
+	for n := range engines {
+		names = append(names, n)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// EngineCapabilities returns the capabilities of the named engine.
+func EngineCapabilities(name types.Engine) (Capabilities, error) {
+	e, err := lookupEngine(name)
+	if err != nil {
+		return 0, err
+	}
+	return e.capabilities, nil
+}
+
+// CapabilitiesOf returns the capabilities of the engine of m.
+func CapabilitiesOf(m types.Machine) (Capabilities, error) {
+	return EngineCapabilities(m.Config().Engine)
+}
+
+func lookupEngine(name types.Engine) (engine, error) {
+	enginesLock.RLock()
+	e, ok := engines[name]
+	enginesLock.RUnlock()
+	if ok {
+		return e, nil
+	}
+
+	registered := []string{}
+	for _, n := range Engines() {
+		registered = append(registered, string(n))
+	}
+	return engine{}, fmt.Errorf("unknown engine %q, registered engines: %s", name, strings.Join(registered, ", "))
+}
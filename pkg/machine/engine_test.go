@@ -0,0 +1,63 @@
+package machine_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/pkg/machine"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+var _ = Describe("Engine registry", func() {
+	var created types.MachineConfig
+	errCreated := errors.New("created")
+
+	BeforeEach(func() {
+		for _, e := range machine.Engines() {
+			if e == "registry-test" {
+				return
+			}
+		}
+		machine.RegisterEngine("registry-test", func(mc types.MachineConfig) (types.Machine, error) {
+			created = mc
+			return nil, errCreated
+		}, machine.CapSnapshot|machine.CapSerialConsole)
+	})
+
+	It("routes New to the registered engine", func() {
+		_, err := machine.New(func(mc *types.MachineConfig) error {
+			mc.Engine = "registry-test"
+			return nil
+		}, types.WithID("registered"))
+		Expect(err).To(MatchError(errCreated))
+		Expect(created.ID).To(Equal("registered"))
+		Expect(created.SSH.Port).ToNot(BeEmpty())
+	})
+
+	It("reports the engine capabilities", func() {
+		caps, err := machine.EngineCapabilities("registry-test")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(caps.Has(machine.CapSnapshot)).To(BeTrue())
+		Expect(caps.Has(machine.CapSnapshot | machine.CapScreenshot)).To(BeFalse())
+		Expect(caps.String()).To(Equal("serial-console,snapshot"))
+
+		caps, err = machine.EngineCapabilities(types.QEMU)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(caps.Has(machine.CapScreenshot | machine.CapDetachCD)).To(BeTrue())
+	})
+
+	It("lists the registered engines on unknown ones", func() {
+		_, err := machine.New(func(mc *types.MachineConfig) error {
+			mc.Engine = "firecracker"
+			return nil
+		})
+		Expect(err).To(MatchError(ContainSubstring(`unknown engine "firecracker", registered engines: docker, kubernetes, nerdctl, podman, qemu, registry-test, vbox`)))
+	})
+
+	It("refuses to register an engine twice", func() {
+		Expect(func() {
+			machine.RegisterEngine(types.QEMU, func(mc types.MachineConfig) (types.Machine, error) { return nil, nil }, 0)
+		}).To(Panic())
+	})
+})
@@ -0,0 +1,435 @@
+// Package dhcp serves DHCP leases on the private networks of QEMU machines. The networks are multicast sockets
+// carrying the raw ethernet frames of the guests, which the server joins like one more machine would.
+package dhcp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+
+	logging "github.com/ipfs/go-log"
+	"golang.org/x/net/ipv4"
+)
+
+var log = logging.Logger("dhcp")
+
+// DHCP message types
+const (
+	discover = 1
+	offer    = 2
+	request  = 3
+	ack      = 5
+	nak      = 6
+)
+
+// DHCP options
+const (
+	optPad         = 0
+	optSubnetMask  = 1
+	optRequestedIP = 50
+	optLeaseTime   = 51
+	optMessageType = 53
+	optServerID    = 54
+	optEnd         = 255
+)
+
+const (
+	bootRequest = 1
+	bootReply   = 2
+
+	serverPort = 67
+	clientPort = 68
+
+	etherTypeIPv4 = 0x0800
+	protocolUDP   = 17
+)
+
+var magicCookie = []byte{99, 130, 83, 99}
+
+// Server leases the addresses of a subnet to the guests of a network. Leases never expire, so guests keep their
+// address for as long as the server runs, and get it back when asking again.
+type Server struct {
+	conn   *ipv4.PacketConn
+	group  *net.UDPAddr
+	subnet *net.IPNet
+	id     net.IP
+
+	mu       sync.Mutex
+	leases   map[string]net.IP
+	reserved map[string]bool
+}
+
+// Listen starts serving the leases of subnet on the network at group, a multicast group:port on the loopback.
+// The first address of the subnet identifies the server and is never leased.
+func Listen(group string, subnet *net.IPNet) (*Server, error) {
+	ones, bits := subnet.Mask.Size()
+	if subnet.IP.To4() == nil || bits-ones < 2 {
+		return nil, fmt.Errorf("subnet %s has no address to lease", subnet)
+	}
+	conn, addr, err := join(group)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		conn:     conn,
+		group:    addr,
+		subnet:   &net.IPNet{IP: subnet.IP.To4().Mask(subnet.Mask), Mask: subnet.Mask},
+		leases:   map[string]net.IP{},
+		reserved: map[string]bool{},
+	}
+	s.id = s.nth(1)
+	go s.serve()
+	log.Infof("Serving DHCP leases of %s on %s", s.subnet, group)
+	return s, nil
+}
+
+// join joins the multicast group:port on the loopback, where qemu sends the frames of the guests.
+func join(group string) (*ipv4.PacketConn, *net.UDPAddr, error) {
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid multicast group %s: %w", group, err)
+	}
+	lo, err := loopback()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// qemu binds the group too, the address must be shared
+	lc := net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	c, err := lc.ListenPacket(context.Background(), "udp4", addr.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed listening on %s: %w", group, err)
+	}
+	conn := ipv4.NewPacketConn(c)
+	for _, err := range []error{
+		conn.JoinGroup(lo, &net.UDPAddr{IP: addr.IP}),
+		conn.SetMulticastInterface(lo),
+		conn.SetMulticastLoopback(true),
+	} {
+		if err != nil {
+			c.Close()
+			return nil, nil, fmt.Errorf("failed joining %s: %w", group, err)
+		}
+	}
+	return conn, addr, nil
+}
+
+// loopback returns the loopback interface, which the multicast sockets of qemu are bound to.
+func loopback() (*net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range ifaces {
+		if i.Flags&net.FlagLoopback != 0 {
+			return &i, nil
+		}
+	}
+	return nil, errors.New("no loopback interface")
+}
+
+// Reserve keeps ip from being leased, e.g. as it is the static address of a guest of the network.
+func (s *Server) Reserve(ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reserved[ip.String()] = true
+}
+
+// Close stops serving leases.
+func (s *Server) Close() error {
+	return s.conn.Close()
+}
+
+func (s *Server) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, _, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Warnf("Stopped serving DHCP on %s: %s", s.group, err.Error())
+			}
+			return
+		}
+		m, ok := parseFrame(buf[:n])
+		if !ok || m.op != bootRequest {
+			continue
+		}
+		reply := s.reply(m)
+		if reply == nil {
+			continue
+		}
+		if _, err := s.conn.WriteTo(reply.frame(s.id), nil, s.group); err != nil {
+			log.Warnf("Failed replying to the DHCP request of %s: %s", m.mac, err.Error())
+		}
+	}
+}
+
+// reply returns the reply to the client message m, nil when there is none to send.
+func (s *Server) reply(m *message) *message {
+	r := &message{op: bootReply, xid: m.xid, flags: m.flags, mac: m.mac, serverID: s.id, mask: s.subnet.Mask}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch m.msgType {
+	case discover:
+		ip := s.lease(m.mac, m.requested)
+		if ip == nil {
+			log.Warnf("No address left in %s to lease to %s", s.subnet, m.mac)
+			return nil
+		}
+		r.msgType, r.yiaddr = offer, ip
+	case request:
+		if m.serverID != nil && !m.serverID.Equal(s.id) {
+			// the client took the offer of another server
+			return nil
+		}
+		want := m.requested
+		if want == nil {
+			want = m.ciaddr
+		}
+		ip := s.lease(m.mac, want)
+		if ip == nil || (want != nil && !ip.Equal(want)) {
+			r.msgType = nak
+			r.mask = nil
+			return r
+		}
+		r.msgType, r.yiaddr = ack, ip
+		log.Infof("Leased %s to %s", ip, m.mac)
+	default:
+		return nil
+	}
+	return r
+}
+
+// lease returns the address leased to mac, leasing it the wanted one if free, or the first free one otherwise.
+func (s *Server) lease(mac net.HardwareAddr, want net.IP) net.IP {
+	if ip, ok := s.leases[mac.String()]; ok {
+		return ip
+	}
+	if want != nil && s.free(want) {
+		s.leases[mac.String()] = want.To4()
+		return want.To4()
+	}
+	for i := 2; ; i++ {
+		ip := s.nth(i)
+		if !s.subnet.Contains(ip) || ip.Equal(s.broadcast()) {
+			return nil
+		}
+		if s.free(ip) {
+			s.leases[mac.String()] = ip
+			return ip
+		}
+	}
+}
+
+func (s *Server) free(ip net.IP) bool {
+	if !s.subnet.Contains(ip) || ip.Equal(s.id) || ip.Equal(s.subnet.IP) || ip.Equal(s.broadcast()) || s.reserved[ip.String()] {
+		return false
+	}
+	for _, l := range s.leases {
+		if l.Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// nth returns the nth address of the subnet.
+func (s *Server) nth(n int) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(s.subnet.IP)+uint32(n))
+	return ip
+}
+
+func (s *Server) broadcast() net.IP {
+	ip := make(net.IP, 4)
+	for i := range ip {
+		ip[i] = s.subnet.IP[i] | ^s.subnet.Mask[i]
+	}
+	return ip
+}
+
+// message is the part of a DHCP message the server looks at.
+type message struct {
+	op        byte
+	xid       uint32
+	flags     uint16
+	ciaddr    net.IP
+	yiaddr    net.IP
+	mac       net.HardwareAddr
+	msgType   byte
+	requested net.IP
+	serverID  net.IP
+	mask      net.IPMask
+}
+
+// parseFrame parses the DHCP message carried by an ethernet frame, if any.
+func parseFrame(b []byte) (*message, bool) {
+	// ethernet
+	if len(b) < 14 || binary.BigEndian.Uint16(b[12:14]) != etherTypeIPv4 {
+		return nil, false
+	}
+	b = b[14:]
+	// IPv4
+	if len(b) < 20 || b[0]>>4 != 4 || b[9] != protocolUDP {
+		return nil, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	if len(b) < ihl+8 {
+		return nil, false
+	}
+	b = b[ihl:]
+	// UDP
+	dst := binary.BigEndian.Uint16(b[2:4])
+	if dst != serverPort && dst != clientPort {
+		return nil, false
+	}
+	return parseMessage(b[8:])
+}
+
+func parseMessage(b []byte) (*message, bool) {
+	if len(b) < 240 || string(b[236:240]) != string(magicCookie) || b[1] != 1 || b[2] != 6 {
+		return nil, false
+	}
+	m := &message{
+		op:     b[0],
+		xid:    binary.BigEndian.Uint32(b[4:8]),
+		flags:  binary.BigEndian.Uint16(b[10:12]),
+		ciaddr: nonZero(b[12:16]),
+		yiaddr: nonZero(b[16:20]),
+		mac:    net.HardwareAddr(append([]byte{}, b[28:34]...)),
+	}
+	opts := b[240:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == optEnd {
+			break
+		}
+		if code == optPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, false
+		}
+		v := opts[2 : 2+int(opts[1])]
+		switch {
+		case code == optMessageType && len(v) == 1:
+			m.msgType = v[0]
+		case code == optRequestedIP && len(v) == 4:
+			m.requested = nonZero(v)
+		case code == optServerID && len(v) == 4:
+			m.serverID = nonZero(v)
+		case code == optSubnetMask && len(v) == 4:
+			m.mask = net.IPMask(append([]byte{}, v...))
+		}
+		opts = opts[2+len(v):]
+	}
+	return m, m.msgType != 0
+}
+
+func nonZero(b []byte) net.IP {
+	ip := net.IP(append([]byte{}, b...))
+	if ip.Equal(net.IPv4zero) {
+		return nil
+	}
+	return ip
+}
+
+// frame returns m in a broadcast ethernet frame sent from src, from the server port to the client one or back.
+func (m *message) frame(src net.IP) []byte {
+	payload := m.encode()
+
+	sport, dport := uint16(serverPort), uint16(clientPort)
+	if m.op == bootRequest {
+		sport, dport = clientPort, serverPort
+	}
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:2], sport)
+	binary.BigEndian.PutUint16(udp[2:4], dport)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(payload)))
+	// no UDP checksum, which IPv4 allows
+	udp = append(udp, payload...)
+
+	ip := make([]byte, 20, 20+len(udp))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(udp)))
+	ip[8] = 64
+	ip[9] = protocolUDP
+	if src == nil {
+		src = net.IPv4zero
+	}
+	copy(ip[12:16], src.To4())
+	copy(ip[16:20], net.IPv4bcast.To4())
+	binary.BigEndian.PutUint16(ip[10:12], checksum(ip))
+	ip = append(ip, udp...)
+
+	eth := make([]byte, 14, 14+len(ip))
+	copy(eth[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	if m.op == bootRequest {
+		copy(eth[6:12], m.mac)
+	} else {
+		// locally administered, out of the range of the guests
+		copy(eth[6:12], []byte{0x52, 0x55, 0x00, 0x00, 0x00, 0x01})
+	}
+	binary.BigEndian.PutUint16(eth[12:14], etherTypeIPv4)
+	return append(eth, ip...)
+}
+
+func (m *message) encode() []byte {
+	b := make([]byte, 240, 300)
+	b[0], b[1], b[2] = m.op, 1, 6
+	binary.BigEndian.PutUint32(b[4:8], m.xid)
+	binary.BigEndian.PutUint16(b[10:12], m.flags)
+	copy(b[12:16], m.ciaddr.To4())
+	copy(b[16:20], m.yiaddr.To4())
+	if m.op == bootReply {
+		copy(b[20:24], m.serverID.To4())
+	}
+	copy(b[28:34], m.mac)
+	copy(b[236:240], magicCookie)
+
+	b = append(b, optMessageType, 1, m.msgType)
+	if m.requested != nil {
+		b = append(b, optRequestedIP, 4)
+		b = append(b, m.requested.To4()...)
+	}
+	if m.serverID != nil {
+		b = append(b, optServerID, 4)
+		b = append(b, m.serverID.To4()...)
+	}
+	if m.op == bootReply && m.yiaddr != nil {
+		// the leases never expire
+		b = append(b, optLeaseTime, 4, 0xff, 0xff, 0xff, 0xff)
+	}
+	if m.mask != nil {
+		b = append(b, optSubnetMask, 4)
+		b = append(b, m.mask...)
+	}
+	return append(b, optEnd)
+}
+
+// checksum is the internet checksum of an IPv4 header.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,71 @@
+package dhcp_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/pkg/machine/internal/dhcp"
+)
+
+var _ = Describe("Server", func() {
+	var group string
+
+	BeforeEach(func() {
+		group = fmt.Sprintf("230.0.%d.%d:%d", os.Getpid()%250, GinkgoParallelProcess(), 40000+GinkgoRandomSeed()%10000)
+		_, subnet, err := net.ParseCIDR("10.0.0.0/29")
+		Expect(err).ToNot(HaveOccurred())
+		s, err := dhcp.Listen(group, subnet)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(s.Close)
+		s.Reserve(net.ParseIP("10.0.0.3"))
+	})
+
+	lease := func(mac string) net.IP {
+		c := dhcp.NewClient(group, mac)
+		t, offered, err := c.Send(dhcp.Discover, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t).To(BeEquivalentTo(dhcp.Offer))
+
+		t, acked, err := c.Send(dhcp.Request, offered, net.ParseIP("10.0.0.1"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t).To(BeEquivalentTo(dhcp.Ack))
+		Expect(acked.Equal(offered)).To(BeTrue())
+		return acked
+	}
+
+	It("leases the free addresses of the subnet", func() {
+		Expect(lease("52:54:00:00:00:01").String()).To(Equal("10.0.0.2"))
+		// 10.0.0.3 is reserved
+		Expect(lease("52:54:00:00:00:02").String()).To(Equal("10.0.0.4"))
+		// the lease is kept
+		Expect(lease("52:54:00:00:00:01").String()).To(Equal("10.0.0.2"))
+	})
+
+	It("declines addresses leased to another guest", func() {
+		Expect(lease("52:54:00:00:00:01").String()).To(Equal("10.0.0.2"))
+
+		c := dhcp.NewClient(group, "52:54:00:00:00:02")
+		t, _, err := c.Send(dhcp.Request, net.ParseIP("10.0.0.2"), nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t).To(BeEquivalentTo(dhcp.Nak))
+	})
+
+	It("ignores the requests for other servers", func() {
+		c := dhcp.NewClient(group, "52:54:00:00:00:01")
+		t, _, err := c.Send(dhcp.Request, net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.254"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t).To(BeZero())
+	})
+
+	It("stops offering once the subnet is full", func() {
+		for i := 1; i <= 4; i++ {
+			lease(fmt.Sprintf("52:54:00:00:00:%02x", i))
+		}
+		t, _, err := dhcp.NewClient(group, "52:54:00:00:00:05").Send(dhcp.Discover, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t).To(BeZero())
+	})
+})
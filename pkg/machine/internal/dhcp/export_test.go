@@ -0,0 +1,62 @@
+package dhcp
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	Discover = discover
+	Offer    = offer
+	Request  = request
+	Ack      = ack
+	Nak      = nak
+)
+
+// Client is a guest of the network, sending its DHCP requests in raw frames like qemu does.
+type Client struct {
+	mac   net.HardwareAddr
+	group string
+}
+
+func NewClient(group, mac string) *Client {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		panic(err)
+	}
+	return &Client{mac: hw, group: group}
+}
+
+// Send sends a request of type t and returns the type of the reply of the server, and the address offered.
+// The type is 0 without reply.
+func (c *Client) Send(t byte, requested, serverID net.IP) (byte, net.IP, error) {
+	conn, addr, err := join(c.group)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+
+	xid := uint32(time.Now().UnixNano())
+	m := &message{op: bootRequest, xid: xid, mac: c.mac, msgType: t, requested: requested, serverID: serverID}
+	if _, err := conn.WriteTo(m.frame(nil), nil, addr); err != nil {
+		return 0, nil, err
+	}
+
+	buf := make([]byte, 65536)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			return 0, nil, err
+		}
+		n, _, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return 0, nil, nil
+			}
+			return 0, nil, err
+		}
+		r, ok := parseFrame(buf[:n])
+		if ok && r.op == bootReply && r.xid == xid {
+			return r.msgType, r.yiaddr, nil
+		}
+	}
+}
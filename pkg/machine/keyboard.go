@@ -0,0 +1,85 @@
+package machine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// scancodes maps QEMU key names (as used by the monitor `sendkey` command) to
+// PC set 1 make codes. Extended keys are prefixed by 0xe0.
+var scancodes = map[string][]byte{
+	"esc": {0x01}, "1": {0x02}, "2": {0x03}, "3": {0x04}, "4": {0x05}, "5": {0x06},
+	"6": {0x07}, "7": {0x08}, "8": {0x09}, "9": {0x0a}, "0": {0x0b},
+	"minus": {0x0c}, "equal": {0x0d}, "backspace": {0x0e}, "tab": {0x0f},
+	"q": {0x10}, "w": {0x11}, "e": {0x12}, "r": {0x13}, "t": {0x14}, "y": {0x15},
+	"u": {0x16}, "i": {0x17}, "o": {0x18}, "p": {0x19},
+	"bracket_left": {0x1a}, "bracket_right": {0x1b}, "ret": {0x1c}, "ctrl": {0x1d},
+	"a": {0x1e}, "s": {0x1f}, "d": {0x20}, "f": {0x21}, "g": {0x22}, "h": {0x23},
+	"j": {0x24}, "k": {0x25}, "l": {0x26},
+	"semicolon": {0x27}, "apostrophe": {0x28}, "grave_accent": {0x29}, "shift": {0x2a}, "backslash": {0x2b},
+	"z": {0x2c}, "x": {0x2d}, "c": {0x2e}, "v": {0x2f}, "b": {0x30}, "n": {0x31}, "m": {0x32},
+	"comma": {0x33}, "dot": {0x34}, "slash": {0x35}, "shift_r": {0x36}, "alt": {0x38},
+	"spc": {0x39}, "caps_lock": {0x3a},
+	"f1": {0x3b}, "f2": {0x3c}, "f3": {0x3d}, "f4": {0x3e}, "f5": {0x3f}, "f6": {0x40},
+	"f7": {0x41}, "f8": {0x42}, "f9": {0x43}, "f10": {0x44}, "f11": {0x57}, "f12": {0x58},
+	"ctrl_r": {0xe0, 0x1d}, "alt_r": {0xe0, 0x38},
+	"home": {0xe0, 0x47}, "up": {0xe0, 0x48}, "pgup": {0xe0, 0x49}, "left": {0xe0, 0x4b},
+	"right": {0xe0, 0x4d}, "end": {0xe0, 0x4f}, "down": {0xe0, 0x50}, "pgdn": {0xe0, 0x51},
+	"insert": {0xe0, 0x52}, "delete": {0xe0, 0x53},
+}
+
+// shifted maps the characters typed with shift on a US layout to the unshifted key.
+var shifted = map[rune]string{
+	'!': "1", '@': "2", '#': "3", '$': "4", '%': "5", '^': "6", '&': "7", '*': "8", '(': "9", ')': "0",
+	'_': "minus", '+': "equal", '{': "bracket_left", '}': "bracket_right", ':': "semicolon",
+	'"': "apostrophe", '~': "grave_accent", '|': "backslash", '<': "comma", '>': "dot", '?': "slash",
+}
+
+var unshifted = map[rune]string{
+	'-': "minus", '=': "equal", '[': "bracket_left", ']': "bracket_right", ';': "semicolon",
+	'\'': "apostrophe", '`': "grave_accent", '\\': "backslash", ',': "comma", '.': "dot", '/': "slash",
+	' ': "spc", '\n': "ret", '\t': "tab",
+}
+
+// textToKeys converts text to the key combinations typing it on a US keyboard layout.
+func textToKeys(text string) ([]string, error) {
+	keys := []string{}
+	for _, r := range text {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			keys = append(keys, string(r))
+		case r >= 'A' && r <= 'Z':
+			keys = append(keys, "shift-"+strings.ToLower(string(r)))
+		case unshifted[r] != "":
+			keys = append(keys, unshifted[r])
+		case shifted[r] != "":
+			keys = append(keys, "shift-"+shifted[r])
+		default:
+			return nil, fmt.Errorf("don't know how to type %q", r)
+		}
+	}
+	return keys, nil
+}
+
+// keysToScancodes converts key combinations (e.g. "ctrl-alt-delete") to the scancodes
+// pressing all the keys in order and then releasing them in reverse order.
+func keysToScancodes(combos ...string) ([]byte, error) {
+	codes := []byte{}
+	for _, combo := range combos {
+		keys := strings.Split(combo, "-")
+		for _, k := range keys {
+			c, ok := scancodes[k]
+			if !ok {
+				return nil, fmt.Errorf("unknown key %q in %q", k, combo)
+			}
+			codes = append(codes, c...)
+		}
+		for i := len(keys) - 1; i >= 0; i-- {
+			c := scancodes[keys[i]]
+			// break codes have the high bit set, the extended prefix stays as is
+			codes = append(codes, c[:len(c)-1]...)
+			codes = append(codes, c[len(c)-1]|0x80)
+		}
+	}
+	return codes, nil
+}
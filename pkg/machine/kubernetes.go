@@ -0,0 +1,563 @@
+package machine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/controller"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// kubernetesContainer is the name of the container running the machine image in the pod.
+const kubernetesContainer = "machine"
+
+// Kubernetes runs machines as pods. Like with docker, the image runs a shell instead of its entrypoint.
+type Kubernetes struct {
+	machineConfig types.MachineConfig
+
+	client     kubernetes.Interface
+	restConfig *rest.Config
+	namespace  string
+
+	// lifecycle is held while peg itself replaces the pod, so monitoring doesn't take it for dead
+	lifecycle sync.Mutex
+	// stopped is set by Stop, the pod going away then is not a failure
+	stopped  atomic.Bool
+	creating atomic.Bool
+}
+
+// newKubernetes returns a kubernetes machine, with a client for the cluster of its kubeconfig.
+func newKubernetes(mc types.MachineConfig) (types.Machine, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = mc.Kubernetes.Kubeconfig
+	cc := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: mc.Kubernetes.Context})
+
+	restConfig, err := cc.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed loading kubeconfig: %w", err)
+	}
+	namespace := mc.Kubernetes.Namespace
+	if namespace == "" {
+		if namespace, _, err = cc.Namespace(); err != nil {
+			return nil, fmt.Errorf("failed getting namespace: %w", err)
+		}
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating kubernetes client: %w", err)
+	}
+
+	return &Kubernetes{machineConfig: mc, client: client, restConfig: restConfig, namespace: namespace}, nil
+}
+
+var invalidPodNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// podName is the machine ID as a valid pod name.
+func (k *Kubernetes) podName() string {
+	return strings.Trim(invalidPodNameChars.ReplaceAllString(strings.ToLower(k.machineConfig.ID), "-"), "-")
+}
+
+func (k *Kubernetes) pods() typedcorev1.PodInterface {
+	return k.client.CoreV1().Pods(k.namespace)
+}
+
+func (k *Kubernetes) Create(ctx context.Context) (context.Context, error) {
+	log.Info("Create kubernetes machine")
+	k.creating.Store(true)
+	defer k.creating.Store(false)
+
+	switch {
+	case k.machineConfig.Image == "":
+		return ctx, errors.New("kubernetes machines need an image")
+	case k.machineConfig.BaseImage != "":
+		return ctx, errors.New("base images are supported only by the qemu engine")
+	case len(k.machineConfig.Networks) != 0:
+		return ctx, errors.New("private networks are supported only by the qemu engine")
+	case len(k.machineConfig.Ports) != 0:
+		return ctx, errors.New("port forwarding is not supported by the kubernetes engine")
+	}
+
+	log.Infof("Starting pod %s/%s. Image: %s", k.namespace, k.podName(), k.machineConfig.Image)
+	if err := k.run(ctx); err != nil {
+		return ctx, err
+	}
+
+	k.stopped.Store(false)
+	return watch(ctx, k.alive, k.failed), nil
+}
+
+// run creates the machine pod and waits for it to run.
+func (k *Kubernetes) run(ctx context.Context) error {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: k.podName(),
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": "peg",
+				"peg.spectrocloud.com/machine": k.podName(),
+			},
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers: []corev1.Container{{
+				Name:    kubernetesContainer,
+				Image:   k.machineConfig.Image,
+				Command: []string{"/bin/sh"},
+				Args:    k.machineConfig.Args,
+				// A shell with a terminal waits forever
+				Stdin: true,
+				TTY:   true,
+			}},
+		},
+	}
+	if _, err := k.pods().Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed creating pod: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	for {
+		p, err := k.pods().Get(ctx, k.podName(), metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed getting pod: %w", err)
+		}
+		switch p.Status.Phase {
+		case corev1.PodRunning:
+			return nil
+		case corev1.PodFailed, corev1.PodSucceeded:
+			return fmt.Errorf("pod exited while starting: %s %s", p.Status.Reason, p.Status.Message)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("pod didn't start: %w", ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// remove deletes the pod and waits for it to be gone. The grace period is the default one of the pod when nil.
+func (k *Kubernetes) remove(grace *int64, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := k.pods().Delete(ctx, k.podName(), metav1.DeleteOptions{GracePeriodSeconds: grace})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed deleting pod: %w", err)
+	}
+	for {
+		_, err := k.pods().Get(ctx, k.podName(), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("pod wasn't deleted: %w", ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// alive polls the pod state. A pod that can't be found anymore is gone, which is a failure unless it was stopped.
+// Holding the lifecycle lock, pods replaced by peg itself (e.g. restarting) are not seen.
+func (k *Kubernetes) alive() (bool, bool) {
+	k.lifecycle.Lock()
+	defer k.lifecycle.Unlock()
+
+	s, err := k.State()
+	if err != nil {
+		log.Debugf("Failed getting pod %s: %s", k.podName(), err.Error())
+		return true, false
+	}
+	switch s {
+	case types.StateStopped:
+		return false, false
+	case types.StateCrashed, types.StateGone:
+		log.Infof("Pod %s is not running anymore, state: %s", k.podName(), s)
+		return false, !k.stopped.Load()
+	}
+	return true, false
+}
+
+// failed calls OnFailure with the pod logs.
+func (k *Kubernetes) failed() {
+	if k.machineConfig.OnFailure == nil {
+		return
+	}
+	out, _ := k.logs()
+	k.machineConfig.OnFailure(deadGuest(k.machineConfig.StateDir, out, "1"))
+}
+
+// State returns the pod state. Once stopped, pods are deleted: they are stopped until the machine is cleaned.
+func (k *Kubernetes) State() (types.State, error) {
+	if k.creating.Load() {
+		return types.StateCreating, nil
+	}
+
+	p, err := k.pods().Get(context.Background(), k.podName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if _, err := os.Stat(k.machineConfig.StateDir); err == nil && k.stopped.Load() {
+			return types.StateStopped, nil
+		}
+		return types.StateGone, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed getting pod: %w", err)
+	}
+
+	if p.DeletionTimestamp != nil {
+		return types.StateStopped, nil
+	}
+	switch p.Status.Phase {
+	case corev1.PodPending:
+		return types.StateCreating, nil
+	case corev1.PodRunning:
+		return types.StateRunning, nil
+	case corev1.PodSucceeded:
+		return types.StateStopped, nil
+	case corev1.PodFailed:
+		if k.stopped.Load() {
+			return types.StateStopped, nil
+		}
+		return types.StateCrashed, nil
+	default:
+		// the node is unreachable
+		return types.StateCrashed, nil
+	}
+}
+
+// Stop deletes the pod right away, keeping its logs in the state directory for Console.
+func (k *Kubernetes) Stop() error {
+	k.stopped.Store(true)
+	k.saveLogs()
+	var now int64
+	return k.remove(&now, time.Minute)
+}
+
+// Shutdown deletes the pod. When graceful, the container gets SIGTERM and is killed if it didn't exit within timeout,
+// in which case ErrShutdownTimeout is returned. The shell the container runs without args ignores SIGTERM as pid 1:
+// the processes it started get SIGTERM instead, and the pod is deleted right away.
+func (k *Kubernetes) Shutdown(graceful bool, timeout time.Duration) error {
+	if !graceful {
+		return k.Stop()
+	}
+	if len(k.machineConfig.Args) == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		// every process but pid 1 and kill itself gets the signal, kill is a builtin when it is not installed
+		if res, err := k.Run(ctx, "env kill -TERM -1 2>/dev/null || kill -TERM -1"); err != nil {
+			log.Debugf("Failed terminating the processes of pod %s: %s", k.podName(), err.Error())
+		} else if !res.Success() {
+			log.Debugf("Failed terminating the processes of pod %s: %s", k.podName(), res)
+		}
+		return k.Stop()
+	}
+
+	k.stopped.Store(true)
+	k.saveLogs()
+	grace := int64(timeout.Seconds())
+	start := time.Now()
+	if err := k.remove(&grace, timeout+time.Minute); err != nil {
+		return err
+	}
+	// the kubelet kills the container silently once the grace period expires
+	if grace > 0 && time.Since(start) >= timeout {
+		return types.ErrShutdownTimeout
+	}
+	return nil
+}
+
+// Restart replaces the pod with a new one, deleting the old one right away when hard.
+func (k *Kubernetes) Restart(hard bool) error {
+	k.lifecycle.Lock()
+	defer k.lifecycle.Unlock()
+
+	var grace *int64
+	if hard {
+		grace = new(int64)
+	}
+	if err := k.remove(grace, 5*time.Minute); err != nil {
+		return err
+	}
+	return k.run(context.Background())
+}
+
+func (k *Kubernetes) Pause() error {
+	return errors.New("pausing is not supported by the kubernetes engine")
+}
+
+func (k *Kubernetes) Resume() error {
+	return errors.New("pausing is not supported by the kubernetes engine")
+}
+
+// Clean deletes the pod and the state directory.
+func (k *Kubernetes) Clean() error {
+	if err := k.Stop(); err != nil {
+		return err
+	}
+	return os.RemoveAll(k.machineConfig.StateDir)
+}
+
+func (k *Kubernetes) Alive() bool {
+	s, err := k.State()
+	return err == nil && s == types.StateRunning
+}
+
+func (k *Kubernetes) Config() types.MachineConfig {
+	return k.machineConfig
+}
+
+func (k *Kubernetes) consoleLogFile() string {
+	return filepath.Join(k.machineConfig.StateDir, "console.log")
+}
+
+func (k *Kubernetes) logs() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	b, err := k.pods().GetLogs(k.podName(), &corev1.PodLogOptions{Container: kubernetesContainer}).DoRaw(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed getting pod logs: %w", err)
+	}
+	return string(b), nil
+}
+
+// saveLogs keeps the pod logs before it is deleted.
+func (k *Kubernetes) saveLogs() {
+	out, err := k.logs()
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(k.consoleLogFile(), []byte(out), 0644); err != nil {
+		log.Warnf("Failed saving pod logs: %s", err.Error())
+	}
+}
+
+// Console returns the pod logs, or the ones saved when it was stopped.
+func (k *Kubernetes) Console() (io.ReadCloser, error) {
+	out, err := k.logs()
+	if err != nil {
+		if f, ferr := os.Open(k.consoleLogFile()); ferr == nil {
+			return f, nil
+		}
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(out)), nil
+}
+
+// exec runs cmd in the pod. A non-zero exit is returned as a utilexec.ExitError. The kubelet leaves
+// cmd running when the stream is closed, so it is killed if ctx is done first.
+func (k *Kubernetes) exec(ctx context.Context, cmd []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	// execs have no environment of their own, the marker is exported by a shell
+	marker := newExecMarker()
+	cmd = append([]string{"/bin/sh", "-c", `export "$0"; exec "$@"`, marker}, cmd...)
+	req := k.client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(k.namespace).
+		Name(k.podName()).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: kubernetesContainer,
+			Command:   cmd,
+			Stdin:     stdin != nil,
+			Stdout:    stdout != nil,
+			Stderr:    stderr != nil,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(k.restConfig, "POST", req.URL())
+	if err != nil {
+		return fmt.Errorf("failed creating executor: %w", err)
+	}
+	err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{Stdin: stdin, Stdout: stdout, Stderr: stderr})
+	if ctx.Err() != nil {
+		k.killExec(marker)
+		return ctx.Err()
+	}
+	return err
+}
+
+// killExec kills the processes of the command run with marker.
+func (k *Kubernetes) killExec(marker string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := k.exec(ctx, []string{"/bin/sh", "-c", killMarkedScript(marker)}, nil, io.Discard, io.Discard); err != nil {
+		log.Debugf("Failed killing cancelled command in pod %s: %s", k.podName(), err.Error())
+	}
+}
+
+func (k *Kubernetes) Command(cmd string) (string, error) {
+	return k.CommandContext(context.Background(), cmd)
+}
+
+// CommandContext runs cmd in the pod and returns its combined output. The command is killed if ctx is done first.
+func (k *Kubernetes) CommandContext(ctx context.Context, cmd string) (string, error) {
+	log.Infof("Running command in pod %s: %s", k.podName(), cmd)
+
+	out := &lockedBuffer{}
+	err := k.exec(ctx, []string{"/bin/sh", "-c", cmd}, nil, out, out)
+	return out.String(), err
+}
+
+func (k *Kubernetes) Run(ctx context.Context, cmd string, opts ...types.RunOption) (*types.CommandResult, error) {
+	c := types.NewRunConfig(opts...)
+
+	var stdout, stderr bytes.Buffer
+	outW, errW := c.Tee(&stdout, &stderr)
+
+	start := time.Now()
+	err := k.exec(ctx, []string{"/bin/sh", "-c", c.Command(cmd)}, c.Stdin, outW, errW)
+	res := &types.CommandResult{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Duration: time.Since(start),
+	}
+
+	var exitErr utilexec.ExitError
+	if !errors.As(err, &exitErr) {
+		return res, err
+	}
+	// Like with docker, commands killed by a signal exit with 128+signal
+	res.ExitCode = exitErr.ExitStatus()
+	res.Signal = dockerSignals[res.ExitCode]
+	return res, nil
+}
+
+func (k *Kubernetes) SendFile(src, dst, permissions string) error {
+	return k.SendFileContext(context.Background(), src, dst, permissions)
+}
+
+// SendFileContext copies src to dst in the pod, streaming a tar archive to tar in the container.
+func (k *Kubernetes) SendFileContext(ctx context.Context, src, dst, permissions string) error {
+	r, err := tarFile(src, path.Base(dst), permissions)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	stderr := &lockedBuffer{}
+	if err := k.exec(ctx, []string{"tar", "-xmf", "-", "-C", path.Dir(dst)}, r, nil, stderr); err != nil {
+		return fmt.Errorf("failed sending file to pod: %w - %s", err, stderr.String())
+	}
+	return nil
+}
+
+func (k *Kubernetes) ReceiveFile(src, dst string) error {
+	return k.ReceiveFileContext(context.Background(), src, dst)
+}
+
+// ReceiveFileContext copies src from the pod to dst, reading a tar archive made by tar in the container.
+func (k *Kubernetes) ReceiveFileContext(ctx context.Context, src, dst string) error {
+	r, w := io.Pipe()
+	stderr := &lockedBuffer{}
+	done := make(chan error, 1)
+	go func() {
+		err := k.exec(ctx, []string{"tar", "-cf", "-", "-C", path.Dir(src), path.Base(src)}, nil, w, stderr)
+		w.CloseWithError(err)
+		done <- err
+	}()
+
+	err := receiveTar(r, dst)
+	// drain what is left, so tar in the pod can exit
+	_, _ = io.Copy(io.Discard, r)
+	if execErr := <-done; execErr != nil {
+		return fmt.Errorf("failed receiving file from pod: %w - %s", execErr, stderr.String())
+	}
+	return err
+}
+
+func (k *Kubernetes) Snapshot(_ string) error {
+	return errors.New("snapshots are not supported by the kubernetes engine")
+}
+
+func (k *Kubernetes) Restore(_ string) error {
+	return errors.New("snapshots are not supported by the kubernetes engine")
+}
+
+func (k *Kubernetes) ListSnapshots() ([]string, error) {
+	return []string{}, nil
+}
+
+func (k *Kubernetes) Screenshot() (string, error) {
+	return k.ScreenshotContext(context.Background())
+}
+
+func (k *Kubernetes) ScreenshotContext(_ context.Context) (string, error) {
+	return "", errors.New("Screenshot is not implemented in kubernetes machine")
+}
+
+func (k *Kubernetes) SendKeys(_ ...string) error {
+	return errors.New("SendKeys is not implemented in kubernetes machine")
+}
+
+func (k *Kubernetes) TypeText(_ string) error {
+	return errors.New("TypeText is not implemented in kubernetes machine")
+}
+
+func (k *Kubernetes) CreateDisk(_, _ string) error {
+	return nil
+}
+
+func (k *Kubernetes) DetachCD() error {
+	return nil // Does not apply
+}
+
+func (k *Kubernetes) SetLinkUp(_ bool, _ ...string) error {
+	return errors.New("unplugging the network is not supported by the kubernetes engine")
+}
+
+// SetNetworkConditions adds packet loss and latency to the pod network with netem.
+// The container needs the NET_ADMIN capability and tc.
+func (k *Kubernetes) SetNetworkConditions(c types.NetworkConditions) error {
+	return controller.SetNetworkConditionsWith(context.Background(), k, "/bin/sh", c)
+}
+
+// HostPort returns the host port a guest port is forwarded to.
+func (k *Kubernetes) HostPort(guestPort int) (int, error) {
+	return hostPort(k.machineConfig, guestPort)
+}
+
+// Addresses returns no address, kubernetes machines can't be attached to private networks.
+func (k *Kubernetes) Addresses(_ context.Context) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+// lockedBuffer is a buffer safe for the concurrent writes of stdout and stderr.
+type lockedBuffer struct {
+	sync.Mutex
+	b bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.Lock()
+	defer l.Unlock()
+	return l.b.String()
+}
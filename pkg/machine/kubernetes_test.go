@@ -0,0 +1,52 @@
+package machine_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/pkg/machine"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// the pods are created in the namespace of the fake kubeconfig
+var _ = Describe("Kubernetes pods", func() {
+	newPod := func(id string, opts ...types.MachineOption) types.Machine {
+		opts = append([]types.MachineOption{
+			types.KubernetesEngine,
+			types.WithKubeconfig(kubeconfig),
+			types.WithImage("alpine"),
+			types.WithID(id),
+		}, opts...)
+		m, err := machine.New(opts...)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = m.Create(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(m.Clean)
+		return m
+	}
+
+	It("terminates the processes of the shell and deletes the pod right away on graceful shutdown", func() {
+		killLog := filepath.Join(fake.GuestPath(), "kill.log")
+		Expect(os.RemoveAll(killLog)).To(Succeed())
+		m := newPod("peg-shell")
+
+		Expect(m.Shutdown(true, 30*time.Second)).To(Succeed())
+		Expect(os.ReadFile(killLog)).To(Equal([]byte("kill -TERM -1\n")))
+		Expect(kubeAPI.GracePeriod("peg", "peg-shell")).To(HaveValue(BeZero()))
+		Expect(m.State()).To(Equal(types.StateStopped))
+	})
+
+	It("deletes pods running an entrypoint with the shutdown timeout as grace period", func() {
+		m := newPod("peg-entrypoint", func(mc *types.MachineConfig) error {
+			mc.Args = []string{"-c", "exec /sbin/init"}
+			return nil
+		})
+
+		Expect(m.Shutdown(true, 30*time.Second)).To(Succeed())
+		Expect(kubeAPI.GracePeriod("peg", "peg-entrypoint")).To(HaveValue(BeNumerically("==", 30)))
+	})
+})
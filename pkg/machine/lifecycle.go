@@ -0,0 +1,44 @@
+package machine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/controller"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// guestReboot reboots m from within the guest, feeding the reboot command to shell.
+func guestReboot(m types.Machine, shell string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// The connection may drop before the command returns, only a failing command is an error
+	res, err := m.Run(ctx, shell+" -c reboot")
+	if err == nil && !res.Success() {
+		return fmt.Errorf("failed rebooting: %s", res)
+	}
+	// The shared connection won't survive the reboot
+	controller.CloseConnection(m) //nolint:errcheck
+	return nil
+}
+
+// waitState polls m until it is in one of states, and tells whether it got there before timeout.
+func waitState(m types.Machine, timeout time.Duration, states ...types.State) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		s, err := m.State()
+		if err == nil {
+			for _, ss := range states {
+				if s == ss {
+					return true
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Second)
+	}
+}
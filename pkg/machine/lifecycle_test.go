@@ -0,0 +1,14 @@
+package machine_test
+
+import (
+	"github.com/spectrocloud/peg/pkg/machine"
+	"github.com/spectrocloud/peg/pkg/machine/conformance"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+var _ = conformance.Lifecycle(conformance.Engine{
+	Name: "docker",
+	New: func() (types.Machine, error) {
+		return machine.New(types.DockerEngine, types.WithContainerHost(dockerHost), types.WithImage("alpine"))
+	},
+})
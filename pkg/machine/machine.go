@@ -52,6 +52,14 @@ func prepare(mc *types.MachineConfig) error {
 		log.Infof("Automatically generated local SSH port: %s", mc.SSH.Port)
 	}
 
+	if err := preparePorts(mc); err != nil {
+		return err
+	}
+
+	if err := prepareNetworks(mc); err != nil {
+		return err
+	}
+
 	if utils.IsValidURL(mc.ISO) {
 		if mc.ISOChecksum == "" {
 			log.Warn("!! Missing ISO checksum. It is strongly suggested to use a checksum")
@@ -118,22 +126,39 @@ func prepare(mc *types.MachineConfig) error {
 	return nil
 }
 
+// monitor returns a context that is done when the process exits. f is called first if it exited with an error.
 func monitor(ctx context.Context, p *process.Process, f func(p *process.Process)) context.Context {
-	// A new context that will be "Done" when the process exits
-	// The caller can use it to monitor the process.
+	return watch(ctx, func() (bool, bool) {
+		if p.IsAlive() {
+			return true, false
+		}
+		code, err := p.ExitCode()
+		return false, err != nil || code != "0"
+	}, func() {
+		if f != nil {
+			f(p)
+		}
+	})
+}
+
+// watch polls alive until the guest is gone, and returns a context that is "Done" then.
+// alive also tells whether the guest died abnormally, in which case onFailure is called before cancelling the context.
+func watch(ctx context.Context, alive func() (bool, bool), onFailure func()) context.Context {
+	// A new context that will be "Done" when the guest dies
+	// The caller can use it to monitor the guest.
 	newCtx, cancelFunc := context.WithCancel(ctx)
 	go func() {
 		ticker := time.NewTicker(3 * time.Second)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ctx.Done():
 				cancelFunc()
 				return
 			case <-ticker.C:
-				if !p.IsAlive() {
-					code, err := p.ExitCode()
-					if err != nil || code != "0" {
-						f(p)
+				if ok, failed := alive(); !ok {
+					if failed {
+						onFailure()
 					}
 					cancelFunc()
 					return
@@ -145,7 +170,22 @@ func monitor(ctx context.Context, p *process.Process, f func(p *process.Process)
 	return newCtx
 }
 
-// New returns a new machine.
+// deadGuest records the output and exit code of a guest that isn't a local process in the state directory,
+// where the process manager keeps them for qemu, so OnFailure handlers can read them in the same way.
+func deadGuest(stateDir, output, exitCode string) *process.Process {
+	if err := os.MkdirAll(stateDir, os.ModePerm); err != nil {
+		log.Warnf("Failed recording guest output: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(stateDir, "stdout"), []byte(output), 0644); err != nil {
+		log.Warnf("Failed recording guest output: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(stateDir, "exitcode"), []byte(exitCode), 0644); err != nil {
+		log.Warnf("Failed recording guest exit code: %s", err.Error())
+	}
+	return process.New(process.WithStateDir(stateDir))
+}
+
+// New returns a new machine of the registered engine named by the config.
 func New(opts ...types.MachineOption) (types.Machine, error) {
 	mc := types.DefaultMachineConfig()
 
@@ -154,20 +194,16 @@ func New(opts ...types.MachineOption) (types.Machine, error) {
 		return nil, err
 	}
 
-	if err := prepare(mc); err != nil {
-		return nil, fmt.Errorf("failure while preparing: %w", err)
+	e, err := lookupEngine(mc.Engine)
+	if err != nil {
+		return nil, err
 	}
 
-	switch mc.Engine {
-	case types.QEMU:
-		return &QEMU{machineConfig: *mc}, nil
-	case types.Docker:
-		return &Docker{machineConfig: *mc}, nil
-	case types.VBox:
-		return &VBox{machineConfig: *mc}, nil
+	if err := prepare(mc); err != nil {
+		return nil, fmt.Errorf("failure while preparing: %w", err)
 	}
 
-	return nil, fmt.Errorf("invalid engine: %s, obj: %+v", mc.Engine, mc)
+	return e.factory(*mc)
 }
 
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
@@ -182,3 +218,18 @@ func RandStringRunes(n int) string {
 	}
 	return string(b)
 }
+
+// hasSnapshot fails unless m has a snapshot named name. Engines tearing the machine down to restore
+// a snapshot check it first, so restoring a missing one leaves the machine as it was.
+func hasSnapshot(m types.Machine, name string) error {
+	snapshots, err := m.ListSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, s := range snapshots {
+		if s == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("snapshot %s not found", name)
+}
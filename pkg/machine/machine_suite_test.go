@@ -1,11 +1,57 @@
 package machine_test
 
 import (
+	"os"
+	"testing"
+
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
-	"testing"
+	"github.com/spectrocloud/peg/pkg/machine/conformance/fakes"
 )
 
+// fake are the fake hypervisors, docker and guests the conformance suites run against.
+var fake *fakes.Fakes
+
+// kubeAPI is the fake kubernetes API server, kubeconfig points to it.
+var kubeAPI *fakes.KubeAPIServer
+var kubeconfig string
+
+// dockerAPI is the fake docker API server, dockerHost and podmanHost the endpoints of the fake docker and podman ones.
+var dockerAPI *fakes.DockerAPIServer
+var dockerHost, podmanHost string
+
+var _ = BeforeSuite(func() {
+	var err error
+	fake, err = fakes.Install(GinkgoT().TempDir())
+	Expect(err).ToNot(HaveOccurred())
+
+	// VBoxManage and qemu-img are run from PATH
+	path := os.Getenv("PATH")
+	Expect(os.Setenv("PATH", fake.Dir+":"+path)).To(Succeed())
+	DeferCleanup(os.Setenv, "PATH", path)
+
+	kubeAPI, err = fake.ServeKubernetes()
+	Expect(err).ToNot(HaveOccurred())
+	DeferCleanup(kubeAPI.Close)
+	kubeconfig, err = kubeAPI.Kubeconfig()
+	Expect(err).ToNot(HaveOccurred())
+
+	dockerAPI, err = fake.ServeDocker("docker")
+	Expect(err).ToNot(HaveOccurred())
+	DeferCleanup(dockerAPI.Close)
+	dockerHost = dockerAPI.Host()
+	podmanAPI, err := fake.ServeDocker("podman")
+	Expect(err).ToNot(HaveOccurred())
+	DeferCleanup(podmanAPI.Close)
+	podmanHost = podmanAPI.Host()
+})
+
+func TestMain(m *testing.M) {
+	// The test binary is the fake executables as well
+	fakes.Run()
+	os.Exit(m.Run())
+}
+
 func TestMachine(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Machine Suite")
@@ -0,0 +1,505 @@
+package machine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spectrocloud/peg/internal/utils"
+	"github.com/spectrocloud/peg/pkg/controller"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// Nerdctl runs machines as containerd containers, with the nerdctl CLI. nerdctl has no API like docker and podman.
+type Nerdctl struct {
+	machineConfig types.MachineConfig
+	bin           string
+
+	// lifecycle is held while peg itself replaces the container, so monitoring doesn't take it for dead
+	lifecycle sync.Mutex
+	// stopped is set by Stop, the container exiting then is not a failure
+	stopped  atomic.Bool
+	creating atomic.Bool
+}
+
+func newNerdctl(mc types.MachineConfig) *Nerdctl {
+	bin := mc.Process
+	if bin == "" {
+		bin = "nerdctl"
+		if b, err := exec.LookPath(bin); err == nil {
+			bin = b
+		}
+	}
+	return &Nerdctl{machineConfig: mc, bin: bin}
+}
+
+func (q *Nerdctl) nerdctl() string {
+	return q.bin
+}
+
+func (q *Nerdctl) Create(ctx context.Context) (context.Context, error) {
+	log.Info("Create nerdctl machine")
+	q.creating.Store(true)
+	defer q.creating.Store(false)
+
+	if q.machineConfig.BaseImage != "" {
+		return ctx, errors.New("base images are supported only by the qemu engine")
+	}
+	if len(q.machineConfig.Networks) != 0 {
+		return ctx, errors.New("private networks are supported only by the qemu engine")
+	}
+
+	log.Infof("Starting nerdctl container with %s. Image: %s", q.nerdctl(), q.machineConfig.Image)
+
+	if err := q.run(q.machineConfig.Image); err != nil {
+		return ctx, err
+	}
+
+	q.stopped.Store(false)
+	return watch(ctx, q.alive, q.failed), nil
+}
+
+// state returns the status and exit code of the container.
+func (q *Nerdctl) state() (string, string, error) {
+	out, err := utils.SH(fmt.Sprintf("%s container inspect -f '{{.State.Status}} {{.State.ExitCode}}' %s", q.nerdctl(), q.machineConfig.ID))
+	if err != nil {
+		return "", "", fmt.Errorf("failed inspecting container: %w - %s", err, out)
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("unexpected container state: %s", out)
+	}
+	status := strings.ToLower(fields[0])
+	// containerd tasks stop rather than exit
+	if status == "stopped" {
+		status = "exited"
+	}
+	return status, fields[1], nil
+}
+
+// alive polls the container state. A container that can't be found anymore is gone, which is a failure unless it was stopped.
+// Holding the lifecycle lock, containers replaced by peg itself (e.g. restoring snapshots) are not seen.
+func (q *Nerdctl) alive() (bool, bool) {
+	q.lifecycle.Lock()
+	defer q.lifecycle.Unlock()
+
+	status, code, err := q.state()
+	if err != nil {
+		log.Debugf("Container %s is gone: %s", q.machineConfig.ID, err.Error())
+		return false, !q.stopped.Load()
+	}
+	if status != "exited" && status != "dead" {
+		return true, false
+	}
+	log.Infof("Container %s is not running anymore, status: %s, exit code: %s", q.machineConfig.ID, status, code)
+	return false, (status == "dead" || code != "0") && !q.stopped.Load()
+}
+
+// failed calls OnFailure with the container logs.
+func (q *Nerdctl) failed() {
+	if q.machineConfig.OnFailure == nil {
+		return
+	}
+
+	_, code, err := q.state()
+	if err != nil {
+		code = "1"
+	}
+	out, _ := utils.SH(fmt.Sprintf("%s logs %s 2>&1", q.nerdctl(), q.machineConfig.ID))
+	q.machineConfig.OnFailure(deadGuest(q.machineConfig.StateDir, out, code))
+}
+
+// run starts the machine container from image, and waits for its init to boot if it has one.
+func (q *Nerdctl) run(image string) error {
+	args := append([]string{}, q.machineConfig.Args...)
+	for _, p := range q.machineConfig.Ports {
+		args = append(args, "-p", fmt.Sprintf("127.0.0.1:%d:%d/%s", p.Host, p.Guest, p.Protocol))
+	}
+	entrypoint := "/bin/sh"
+	init := findInit(q.machineConfig.Container.Init)
+	if init != nil {
+		args = append(args, init.runFlags("nerdctl"))
+		entrypoint = init.path
+	}
+	cmd := fmt.Sprintf("%s run %s --entrypoint %s -d -t --name %s %s", q.nerdctl(), strings.Join(args, " "), entrypoint, q.machineConfig.ID, image)
+	out, err := utils.SH(cmd)
+	if err != nil {
+		return fmt.Errorf("failed creating container: %w - cmd: %s, out: %s", err, cmd, out)
+	}
+	if init != nil {
+		return q.waitBoot(init)
+	}
+	return nil
+}
+
+// waitBoot waits for the init of the container to be done booting.
+func (q *Nerdctl) waitBoot(init *containerInit) error {
+	ctx, cancel := context.WithTimeout(context.Background(), containerBootTimeout)
+	defer cancel()
+
+	for {
+		out, err := q.CommandContext(ctx, init.ready)
+		if init.booted(out, err) {
+			return nil
+		}
+		if status, code, err := q.state(); err == nil && (status == "exited" || status == "dead") {
+			logs, _ := utils.SH(fmt.Sprintf("%s logs %s 2>&1", q.nerdctl(), q.machineConfig.ID))
+			return fmt.Errorf("%s exited with code %s while booting - %s", init.name, code, logs)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %s to boot: %w - %s", init.name, ctx.Err(), out)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Snapshot commits the container filesystem to an image. Running processes are not part of it.
+func (q *Nerdctl) Snapshot(name string) error {
+	out, err := utils.SH(fmt.Sprintf("%s commit %s %s:%s", q.nerdctl(), q.machineConfig.ID, snapshotRepository(q.machineConfig.ID), name))
+	if err != nil {
+		return fmt.Errorf("failed committing container: %w - %s", err, out)
+	}
+	return nil
+}
+
+// Restore replaces the container with a new one started from the named snapshot.
+func (q *Nerdctl) Restore(name string) error {
+	if err := hasSnapshot(q, name); err != nil {
+		return err
+	}
+
+	q.lifecycle.Lock()
+	defer q.lifecycle.Unlock()
+
+	out, err := utils.SH(fmt.Sprintf("%s rm -f %s", q.nerdctl(), q.machineConfig.ID))
+	if err != nil {
+		return fmt.Errorf("failed deleting container: %w - %s", err, out)
+	}
+	return q.run(fmt.Sprintf("%s:%s", snapshotRepository(q.machineConfig.ID), name))
+}
+
+func (q *Nerdctl) ListSnapshots() ([]string, error) {
+	out, err := utils.SH(fmt.Sprintf("%s images %s --format '{{.Tag}}'", q.nerdctl(), snapshotRepository(q.machineConfig.ID)))
+	if err != nil {
+		return nil, fmt.Errorf("failed listing snapshots: %w - %s", err, out)
+	}
+	return strings.Fields(out), nil
+}
+
+func (q *Nerdctl) Screenshot() (string, error) {
+	return q.ScreenshotContext(context.Background())
+}
+
+func (q *Nerdctl) ScreenshotContext(_ context.Context) (string, error) {
+	return "", errors.New("Screenshot is not implemented in nerdctl machine")
+}
+
+// SetLinkUp fails, nerdctl can't connect and disconnect networks.
+func (q *Nerdctl) SetLinkUp(_ bool, _ ...string) error {
+	return errors.New("nerdctl can't disconnect containers from networks")
+}
+
+// SetNetworkConditions adds packet loss and latency to the container network with netem.
+// The container needs the NET_ADMIN capability and tc.
+func (q *Nerdctl) SetNetworkConditions(c types.NetworkConditions) error {
+	return controller.SetNetworkConditionsWith(context.Background(), q, "/bin/sh", c)
+}
+
+// HostPort returns the host port a guest port is forwarded to.
+func (q *Nerdctl) HostPort(guestPort int) (int, error) {
+	return hostPort(q.machineConfig, guestPort)
+}
+
+// Addresses returns no address, nerdctl machines can't be attached to private networks.
+func (q *Nerdctl) Addresses(_ context.Context) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+// Console returns the container logs, which is the closest thing to a console a container has.
+func (q *Nerdctl) Console() (io.ReadCloser, error) {
+	out, err := utils.SH(fmt.Sprintf("%s logs %s", q.nerdctl(), q.machineConfig.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed getting container logs: %w - %s", err, out)
+	}
+	return io.NopCloser(strings.NewReader(out)), nil
+}
+
+func (q *Nerdctl) SendKeys(_ ...string) error {
+	return errors.New("SendKeys is not implemented in nerdctl machine")
+}
+
+func (q *Nerdctl) TypeText(_ string) error {
+	return errors.New("TypeText is not implemented in nerdctl machine")
+}
+
+func (q *Nerdctl) Config() types.MachineConfig {
+	return q.machineConfig
+}
+
+func (q *Nerdctl) Stop() error {
+	q.stopped.Store(true)
+	out, err := utils.SH(fmt.Sprintf("%s stop -t 0 %s", q.nerdctl(), q.machineConfig.ID))
+	if err != nil {
+		return fmt.Errorf("failed stopping container: %w - %s", err, out)
+	}
+	return nil
+}
+
+// State returns the container state reported by nerdctl.
+func (q *Nerdctl) State() (types.State, error) {
+	if q.creating.Load() {
+		return types.StateCreating, nil
+	}
+
+	status, code, err := q.state()
+	if err != nil {
+		if strings.Contains(err.Error(), "no such container") {
+			return types.StateGone, nil
+		}
+		return "", err
+	}
+
+	switch status {
+	case "running":
+		return types.StateRunning, nil
+	case "paused":
+		return types.StatePaused, nil
+	case "created", "restarting":
+		return types.StateCreating, nil
+	case "exited":
+		if code == "0" || q.stopped.Load() {
+			return types.StateStopped, nil
+		}
+		return types.StateCrashed, nil
+	case "dead":
+		return types.StateCrashed, nil
+	default:
+		// removing
+		return types.StateGone, nil
+	}
+}
+
+func (q *Nerdctl) Pause() error {
+	return q.container("pause")
+}
+
+func (q *Nerdctl) Resume() error {
+	return q.container("unpause")
+}
+
+// Restart restarts the container, killing it right away when hard. Containers booting an init are
+// restarted once it booted again.
+func (q *Nerdctl) Restart(hard bool) error {
+	q.lifecycle.Lock()
+	defer q.lifecycle.Unlock()
+
+	action := "restart"
+	if hard {
+		action = "restart -t 0"
+	}
+	if err := q.container(action); err != nil {
+		return err
+	}
+	if init := findInit(q.machineConfig.Container.Init); init != nil {
+		return q.waitBoot(init)
+	}
+	return nil
+}
+
+// Shutdown stops the container. When graceful, the init of the container is sent its stop signal and
+// killed if it didn't exit within timeout. Containers without an init are killed right away.
+func (q *Nerdctl) Shutdown(graceful bool, timeout time.Duration) error {
+	// The shell run instead of an init ignores the stop signal as pid 1, and has nothing to shut down
+	if !graceful || findInit(q.machineConfig.Container.Init) == nil {
+		return q.Stop()
+	}
+
+	q.stopped.Store(true)
+	if err := q.container(fmt.Sprintf("stop -t %d", int(timeout.Seconds()))); err != nil {
+		return err
+	}
+	// nerdctl stop kills the container silently on timeout
+	if _, code, err := q.state(); err == nil && code == "137" {
+		return types.ErrShutdownTimeout
+	}
+	return nil
+}
+
+// container runs a nerdctl command on the container.
+func (q *Nerdctl) container(action string) error {
+	out, err := utils.SH(fmt.Sprintf("%s %s %s", q.nerdctl(), action, q.machineConfig.ID))
+	if err != nil {
+		return fmt.Errorf("failed running %s: %w - %s", action, err, out)
+	}
+	return nil
+}
+
+func (q *Nerdctl) Clean() error {
+	q.stopped.Store(true)
+	out, err := utils.SH(fmt.Sprintf("%s rm -f %s", q.nerdctl(), q.machineConfig.ID))
+	if err != nil {
+		return fmt.Errorf("failed deleting container: %w - %s", err, out)
+	}
+	out, err = utils.SH(fmt.Sprintf("%s rmi %s", q.nerdctl(), q.machineConfig.Image))
+	if err != nil {
+		log.Warnf("failed deleting image: %s %s", err.Error(), out)
+	}
+	snapshots, err := q.ListSnapshots()
+	if err != nil {
+		log.Warnf("failed listing snapshots: %s", err.Error())
+	}
+	for _, s := range snapshots {
+		out, err = utils.SH(fmt.Sprintf("%s rmi %s:%s", q.nerdctl(), snapshotRepository(q.machineConfig.ID), s))
+		if err != nil {
+			log.Warnf("failed deleting snapshot %s: %s %s", s, err.Error(), out)
+		}
+	}
+	return nil
+}
+
+func (q *Nerdctl) Alive() bool {
+	s, err := q.State()
+	return err == nil && (s == types.StateRunning || s == types.StatePaused)
+}
+
+func (q *Nerdctl) CreateDisk(_, _ string) error {
+	return nil
+}
+
+func (q *Nerdctl) Command(cmd string) (string, error) {
+	return q.CommandContext(context.Background(), cmd)
+}
+
+// CommandContext runs cmd in the container, the command is killed if ctx is done before it exits.
+// nerdctl is run without a shell in between, which would keep the output open once nerdctl is killed.
+func (q *Nerdctl) CommandContext(ctx context.Context, cmd string) (string, error) {
+	log.Infof("Running command in %s: %s", q.machineConfig.ID, cmd)
+
+	marker := newExecMarker()
+	out, err := exec.CommandContext(ctx, q.nerdctl(), "exec", "--env="+marker, q.machineConfig.ID, "/bin/sh", "-c", cmd).CombinedOutput()
+	if ctx.Err() != nil {
+		q.killExec(marker)
+		return string(out), ctx.Err()
+	}
+	return string(out), err
+}
+
+// killExec kills the processes of the command run with marker, which outlive the `nerdctl exec` running it.
+func (q *Nerdctl) killExec(marker string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if out, err := exec.CommandContext(ctx, q.nerdctl(), "exec", q.machineConfig.ID, "/bin/sh", "-c", killMarkedScript(marker)).CombinedOutput(); err != nil {
+		log.Debugf("Failed killing cancelled command in %s: %s - %s", q.machineConfig.ID, err.Error(), out)
+	}
+}
+
+func (q *Nerdctl) Run(ctx context.Context, cmd string, opts ...types.RunOption) (*types.CommandResult, error) {
+	c := types.NewRunConfig(opts...)
+
+	marker := newExecMarker()
+	args := []string{"exec", "--env=" + marker}
+	if c.Stdin != nil {
+		args = append(args, "-i")
+	}
+	args = append(args, q.machineConfig.ID, "/bin/sh", "-c", c.Command(cmd))
+
+	var stdout, stderr bytes.Buffer
+	nerdctlCmd := exec.CommandContext(ctx, q.nerdctl(), args...)
+	nerdctlCmd.Stdin = c.Stdin
+	nerdctlCmd.Stdout, nerdctlCmd.Stderr = c.Tee(&stdout, &stderr)
+
+	start := time.Now()
+	err := nerdctlCmd.Run()
+	res := &types.CommandResult{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Duration: time.Since(start),
+	}
+
+	if ctx.Err() != nil {
+		q.killExec(marker)
+		return res, ctx.Err()
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return res, err
+	}
+
+	// nerdctl itself failed (e.g. the container is gone), the command never ran
+	if strings.Contains(res.Stderr, "level=fatal") {
+		return res, fmt.Errorf("failed running command in container: %w - %s", err, res.Stderr)
+	}
+
+	res.ExitCode = exitErr.ExitCode()
+	res.Signal = dockerSignals[res.ExitCode]
+	return res, nil
+}
+
+func (q *Nerdctl) DetachCD() error {
+	return nil // Does not apply
+}
+
+func (q *Nerdctl) ReceiveFile(src, dst string) error {
+	return q.ReceiveFileContext(context.Background(), src, dst)
+}
+
+func (q *Nerdctl) ReceiveFileContext(ctx context.Context, src, dst string) error {
+	return q.receiveTar(ctx, src, dst)
+}
+
+func (q *Nerdctl) SendFile(src, dst, permissions string) error {
+	return q.SendFileContext(context.Background(), src, dst, permissions)
+}
+
+func (q *Nerdctl) SendFileContext(ctx context.Context, src, dst, permissions string) error {
+	return q.sendTar(ctx, src, dst, permissions)
+}
+
+// sendTar copies src to dst in the container, streaming a tar archive to tar in it.
+func (q *Nerdctl) sendTar(ctx context.Context, src, dst, permissions string) error {
+	r, err := tarFile(src, path.Base(dst), permissions)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.CommandContext(ctx, q.nerdctl(), "exec", "-i", q.machineConfig.ID, "tar", "-xmf", "-", "-C", path.Dir(dst))
+	cmd.Stdin = r
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed sending file to container: %w - %s", err, out)
+	}
+	return nil
+}
+
+// receiveTar copies src from the container to dst, reading a tar archive made by tar in it.
+func (q *Nerdctl) receiveTar(ctx context.Context, src, dst string) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, q.nerdctl(), "exec", q.machineConfig.ID, "tar", "-cf", "-", "-C", path.Dir(src), path.Base(src))
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	err = receiveTar(stdout, dst)
+	// drain what is left, so tar in the container can exit
+	_, _ = io.Copy(io.Discard, stdout)
+	if waitErr := cmd.Wait(); waitErr != nil {
+		return fmt.Errorf("failed receiving file from container: %w - %s", waitErr, stderr.String())
+	}
+	return err
+}
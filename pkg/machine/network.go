@@ -0,0 +1,194 @@
+package machine
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/phayes/freeport"
+	"github.com/spectrocloud/peg/pkg/machine/internal/dhcp"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// preparePorts validates the forwarded ports and allocates the host ports not given.
+func preparePorts(mc *types.MachineConfig) error {
+	for i := range mc.Ports {
+		p := &mc.Ports[i]
+		if p.Guest <= 0 || p.Guest > 65535 {
+			return fmt.Errorf("invalid guest port %d", p.Guest)
+		}
+		p.Protocol = strings.ToLower(p.Protocol)
+		if p.Protocol == "" {
+			p.Protocol = "tcp"
+		}
+		if p.Protocol != "tcp" && p.Protocol != "udp" {
+			return fmt.Errorf("invalid protocol %s for guest port %d", p.Protocol, p.Guest)
+		}
+		if p.Host == 0 {
+			port, err := freeport.GetFreePort()
+			if err != nil {
+				return err
+			}
+			p.Host = port
+		}
+		log.Infof("Forwarding guest port %d/%s to host port %d", p.Guest, p.Protocol, p.Host)
+	}
+	return nil
+}
+
+// hostPort returns the host port forwarded to guestPort. SSH is always forwarded for VMs.
+func hostPort(mc types.MachineConfig, guestPort int) (int, error) {
+	for _, p := range mc.Ports {
+		if p.Guest == guestPort {
+			return p.Host, nil
+		}
+	}
+	if guestPort == 22 && !isContainerEngine(mc.Engine) && mc.SSH != nil && mc.SSH.Port != "" {
+		return strconv.Atoi(mc.SSH.Port)
+	}
+	return 0, fmt.Errorf("guest port %d is not forwarded", guestPort)
+}
+
+// prepareNetworks validates the private networks of the machine and fills the generated MAC addresses and multicast groups.
+func prepareNetworks(mc *types.MachineConfig) error {
+	seen := map[string]bool{}
+	for i := range mc.Networks {
+		n := &mc.Networks[i]
+		if n.Name == "" {
+			return fmt.Errorf("network without a name")
+		}
+		if seen[n.Name] {
+			return fmt.Errorf("machine attached twice to network %s", n.Name)
+		}
+		seen[n.Name] = true
+
+		if n.Address != "" {
+			if _, _, err := net.ParseCIDR(n.Address); err != nil {
+				return fmt.Errorf("invalid address for network %s: %w", n.Name, err)
+			}
+		}
+		if n.DHCP != "" {
+			if n.Address != "" {
+				return fmt.Errorf("network %s has both a static address and dhcp", n.Name)
+			}
+			if _, _, err := net.ParseCIDR(n.DHCP); err != nil {
+				return fmt.Errorf("invalid dhcp subnet for network %s: %w", n.Name, err)
+			}
+		}
+		if n.MAC == "" {
+			n.MAC = networkMAC(mc.ID, n.Name)
+		}
+		if n.Group == "" {
+			n.Group = networkGroup(os.Getpid(), n.Name)
+		}
+		log.Infof("Machine %s attached to network %s (mac: %s, group: %s)", mc.ID, n.Name, n.MAC, n.Group)
+	}
+	return nil
+}
+
+// networkMAC returns a locally administered MAC address in the QEMU range, stable for the machine and network.
+func networkMAC(id, network string) string {
+	h := sha256.Sum256([]byte(id + "/" + network))
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", h[0], h[1], h[2])
+}
+
+// networkGroup returns the multicast group:port of a network, so machines naming the same network in the
+// same run end up on the same segment. The run is the process creating the machines, keeping concurrent runs apart.
+func networkGroup(run int, network string) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%d/%s", run, network)))
+	port := 1024 + int(binary.BigEndian.Uint16(h[2:4]))%(65536-1024)
+	return fmt.Sprintf("230.0.%d.%d:%d", h[0], h[1], port)
+}
+
+// segment is a private network the machines of the process are attached to.
+type segment struct {
+	machines int
+	// static are the static addresses of the machines, never leased
+	static []net.IP
+	dhcp   *dhcp.Server
+	subnet string
+}
+
+// segments are the private networks of the machines of the process, by multicast group.
+var segments = struct {
+	sync.Mutex
+	m map[string]*segment
+}{m: map[string]*segment{}}
+
+// attachNetworks registers the machine on the segments of its private networks, starting the DHCP servers it asks for.
+func attachNetworks(mc types.MachineConfig) error {
+	segments.Lock()
+	defer segments.Unlock()
+
+	for i, n := range mc.Networks {
+		s := segments.m[n.Group]
+		if s == nil {
+			s = &segment{}
+			segments.m[n.Group] = s
+		}
+		s.machines++
+		if err := s.attach(n); err != nil {
+			detachLocked(mc.Networks[:i+1])
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *segment) attach(n types.Network) error {
+	if n.Address != "" {
+		ip, _, _ := net.ParseCIDR(n.Address)
+		s.static = append(s.static, ip)
+		if s.dhcp != nil {
+			s.dhcp.Reserve(ip)
+		}
+	}
+	if n.DHCP == "" {
+		return nil
+	}
+	_, subnet, _ := net.ParseCIDR(n.DHCP)
+	if s.dhcp != nil {
+		if s.subnet != subnet.String() {
+			return fmt.Errorf("network %s already leases addresses of %s, not %s", n.Name, s.subnet, subnet)
+		}
+		return nil
+	}
+	server, err := dhcp.Listen(n.Group, subnet)
+	if err != nil {
+		return fmt.Errorf("failed starting the dhcp server of network %s: %w", n.Name, err)
+	}
+	for _, ip := range s.static {
+		server.Reserve(ip)
+	}
+	s.dhcp, s.subnet = server, subnet.String()
+	return nil
+}
+
+// detachNetworks unregisters the machine from the segments of its private networks, stopping the DHCP servers
+// once their last machine is gone.
+func detachNetworks(mc types.MachineConfig) {
+	segments.Lock()
+	defer segments.Unlock()
+	detachLocked(mc.Networks)
+}
+
+func detachLocked(networks []types.Network) {
+	for _, n := range networks {
+		s := segments.m[n.Group]
+		if s == nil {
+			continue
+		}
+		if s.machines--; s.machines > 0 {
+			continue
+		}
+		if s.dhcp != nil {
+			_ = s.dhcp.Close()
+		}
+		delete(segments.m, n.Group)
+	}
+}
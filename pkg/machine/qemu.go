@@ -1,13 +1,20 @@
 package machine
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
+	"image"
+	"image/png"
+	"io"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"context"
@@ -21,6 +28,15 @@ import (
 type QEMU struct {
 	machineConfig types.MachineConfig
 	process       *process.Process
+
+	qmpLock   sync.Mutex
+	qmpClient *QMPClient
+
+	// stopped is set by Stop, the process exiting then is not a failure
+	stopped  atomic.Bool
+	creating atomic.Bool
+	// attached is set while the machine is registered on the segments of its private networks
+	attached atomic.Bool
 }
 
 // findQEMUBinary searches for qemu-system-x86_64 in common installation paths
@@ -52,11 +68,17 @@ func findQEMUBinary() (string, error) {
 
 func (q *QEMU) Create(ctx context.Context) (context.Context, error) {
 	log.Info("Create qemu machine")
+	q.creating.Store(true)
+	defer q.creating.Store(false)
 
 	driveSizes := q.driveSizes()
 	userDrives := q.machineConfig.Drives
 	if q.machineConfig.AutoDriveSetup && len(userDrives) == 0 {
 		for i, s := range driveSizes {
+			if i == 0 && q.machineConfig.BaseImage != "" {
+				// The first disk is the overlay over the base image
+				continue
+			}
 			filename := fmt.Sprintf("%s-%d.img", q.machineConfig.ID, i)
 			err := q.CreateDisk(filename, s)
 			if err != nil {
@@ -66,6 +88,13 @@ func (q *QEMU) Create(ctx context.Context) (context.Context, error) {
 		}
 	}
 
+	if q.machineConfig.BaseImage != "" {
+		if err := q.createOverlay(); err != nil {
+			return ctx, err
+		}
+		userDrives = append([]string{q.overlayFile()}, userDrives...)
+	}
+
 	genDrives := func(m types.MachineConfig) []string {
 		allDrives := []string{}
 		if m.ISO != "" {
@@ -111,18 +140,35 @@ func (q *QEMU) Create(ctx context.Context) (context.Context, error) {
 		display = q.machineConfig.Display
 	}
 
-	// Enable qemu monitor to enable screendump (used in `Screenshot()`):
+	// Enable QMP to drive the machine (screendump, eject, send-key, events), the human
+	// monitor for debugging (e.g. with socat), and log the serial console to the state dir (used in `Console()`):
 	opts := []string{
 		"-m", q.machineConfig.Memory,
 		"-smp", fmt.Sprintf("cores=%s", q.machineConfig.CPU),
 		"-rtc", "base=utc,clock=rt",
+		"-qmp", fmt.Sprintf("unix:%s,server,nowait", q.qmpSockFile()),
 		"-monitor", fmt.Sprintf("unix:%s,server,nowait", q.monitorSockFile()),
+		"-chardev", fmt.Sprintf("socket,id=console0,path=%s,server,nowait,logfile=%s", q.consoleSockFile(), q.consoleLogFile()),
+		"-serial", "chardev:console0",
 		"-device", "virtio-serial",
 	}
 
 	// Add default networking unless disabled
 	if !q.machineConfig.DisableDefaultNetworking {
-		opts = append(opts, "-nic", fmt.Sprintf("user,hostfwd=tcp::%s-:22", q.machineConfig.SSH.Port))
+		nic := fmt.Sprintf("user,id=%s,hostfwd=tcp::%s-:22", qemuUserNetdev, q.machineConfig.SSH.Port)
+		for _, p := range q.machineConfig.Ports {
+			nic += fmt.Sprintf(",hostfwd=%s:127.0.0.1:%d-:%d", p.Protocol, p.Host, p.Guest)
+		}
+		opts = append(opts, "-nic", nic)
+	}
+
+	// Private networks are multicast sockets on the loopback, every machine on the group sees the same L2 segment
+	for i, n := range q.machineConfig.Networks {
+		id := fmt.Sprintf("net%d", i)
+		opts = append(opts,
+			"-netdev", fmt.Sprintf("socket,id=%s,mcast=%s,localaddr=127.0.0.1", id, n.Group),
+			"-device", fmt.Sprintf("virtio-net-pci,netdev=%s,mac=%s", id, n.MAC),
+		)
 	}
 
 	opts = append(opts, strings.Split(display, " ")...)
@@ -142,24 +188,75 @@ func (q *QEMU) Create(ctx context.Context) (context.Context, error) {
 
 	q.process = qemu
 
-	newCtx := monitor(ctx, qemu, q.machineConfig.OnFailure)
+	if err := attachNetworks(q.machineConfig); err != nil {
+		return ctx, err
+	}
+	q.attached.Store(true)
+
+	q.stopped.Store(false)
+	newCtx := monitor(ctx, qemu, func(p *process.Process) {
+		if !q.stopped.Load() && q.machineConfig.OnFailure != nil {
+			q.machineConfig.OnFailure(p)
+		}
+	})
+
+	if err := qemu.Run(); err != nil {
+		q.detach()
+		return newCtx, err
+	}
+	go q.logEvents(newCtx)
+
+	return newCtx, nil
+}
+
+// logEvents logs the QMP events relevant to tests until ctx is done.
+func (q *QEMU) logEvents(ctx context.Context) {
+	var qmp *QMPClient
+	// The socket shows up once qemu is started
+	for {
+		var err error
+		if qmp, err = q.QMP(ctx); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
 
-	return newCtx, qemu.Run()
+	events, unsubscribe := qmp.Subscribe(QMPEventShutdown, QMPEventReset, QMPEventBlockIOError)
+	defer unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if e.Event == QMPEventBlockIOError {
+				log.Warnf("Block I/O error on machine %s: %v", q.machineConfig.ID, e.Data)
+			} else {
+				log.Infof("Machine %s event %s: %v", q.machineConfig.ID, e.Event, e.Data)
+			}
+		}
+	}
 }
 
 func (q *QEMU) Config() types.MachineConfig {
 	return q.machineConfig
 }
 
-// qemu monitor: https://qemu-project.gitlab.io/qemu/system/monitor.html
-// nice explanation of how it works: https://unix.stackexchange.com/a/476617
-// unix sockets with golang: https://dev.to/douglasmakey/understanding-unix-domain-sockets-in-golang-32n8
 func (q *QEMU) Screenshot() (string, error) {
-	conn, err := net.Dial("unix", q.monitorSockFile())
+	return q.ScreenshotContext(context.Background())
+}
+
+func (q *QEMU) ScreenshotContext(ctx context.Context) (string, error) {
+	qmp, err := q.QMP(ctx)
 	if err != nil {
 		return "", err
 	}
-	defer conn.Close()
 
 	// Create a temp file name
 	f, err := os.CreateTemp("", "qemu-screenshot-*.png")
@@ -169,39 +266,254 @@ func (q *QEMU) Screenshot() (string, error) {
 	f.Close()
 	os.Remove(f.Name())
 
-	cmd := fmt.Sprintf("screendump %s\r\n", f.Name())
-	n, err := fmt.Fprint(conn, cmd)
+	err = qmp.Execute(ctx, "screendump", map[string]interface{}{"filename": f.Name(), "format": "png"}, nil)
+	var qmpErr *QMPError
+	if errors.As(err, &qmpErr) && qmpErr.Class == "GenericError" && strings.Contains(qmpErr.Desc, "format") {
+		// QEMU before 7.1 only dumps PPM
+		err = screendumpPPM(ctx, qmp, f.Name())
+	}
 	if err != nil {
 		return "", err
 	}
 
-	if n != len(cmd) {
-		return "", fmt.Errorf("didn't send the full command (%d out of %d bytes)", n, len(cmd))
+	return f.Name(), nil
+}
+
+// screendumpPPM dumps the screen as PPM, and converts it to the PNG dst.
+func screendumpPPM(ctx context.Context, qmp *QMPClient, dst string) error {
+	ppm := strings.TrimSuffix(dst, ".png") + ".ppm"
+	defer os.Remove(ppm)
+	if err := qmp.Execute(ctx, "screendump", map[string]interface{}{"filename": ppm}, nil); err != nil {
+		return err
 	}
 
-	// If there is nothing for more than a second, stop
-	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
-		return "", err
+	img, err := readPPM(ppm)
+	if err != nil {
+		return fmt.Errorf("failed reading screendump: %w", err)
 	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
 
-	// It seems that the screendump image.png command doesn't have any effect
-	// until we read the data from the socket. I would expect reading the data to
-	// be irrelevant but after trial and errors, this seems to be necessary for some reason.
-	for {
-		b := make([]byte, 1024)
-		if _, err := conn.Read(b); err != nil {
-			break
+// readPPM decodes a binary (P6) PPM image, as dumped by QEMU.
+func readPPM(file string) (image.Image, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var magic string
+	var width, height, max int
+	if _, err := fmt.Fscan(r, &magic, &width, &height, &max); err != nil {
+		return nil, err
+	}
+	if magic != "P6" || max <= 0 || max > 255 {
+		return nil, fmt.Errorf("unsupported ppm %s with max value %d", magic, max)
+	}
+	// a single whitespace separates the header from the pixels
+	if _, err := r.ReadByte(); err != nil {
+		return nil, err
+	}
+
+	pixels := make([]byte, width*height*3)
+	if _, err := io.ReadFull(r, pixels); err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < width*height; i++ {
+		img.Pix[i*4] = uint8(int(pixels[i*3]) * 255 / max)
+		img.Pix[i*4+1] = uint8(int(pixels[i*3+1]) * 255 / max)
+		img.Pix[i*4+2] = uint8(int(pixels[i*3+2]) * 255 / max)
+		img.Pix[i*4+3] = 0xff
+	}
+	return img, nil
+}
+
+// QMP returns the QMP client of the machine, connecting to it if needed.
+// QEMU serves a single QMP client at a time, so the client is shared and must not be closed.
+func (q *QEMU) QMP(ctx context.Context) (*QMPClient, error) {
+	q.qmpLock.Lock()
+	defer q.qmpLock.Unlock()
+
+	if q.qmpClient != nil {
+		select {
+		case <-q.qmpClient.Done():
+		default:
+			return q.qmpClient, nil
 		}
 	}
 
-	return f.Name(), nil
+	c, err := DialQMP(ctx, q.qmpSockFile())
+	if err != nil {
+		return nil, fmt.Errorf("failed connecting to qmp: %w", err)
+	}
+	q.qmpClient = c
+	return c, nil
 }
 
 func (q *QEMU) Stop() error {
-	return process.New(process.WithStateDir(q.machineConfig.StateDir)).Stop()
+	q.stopped.Store(true)
+	q.disconnect()
+	q.detach()
+
+	p := process.New(process.WithStateDir(q.machineConfig.StateDir))
+	if !p.IsAlive() {
+		return nil
+	}
+	if err := p.Stop(); err != nil {
+		return err
+	}
+	return q.exited()
+}
+
+// detach unregisters the machine from the segments of its private networks, if it still is.
+func (q *QEMU) detach() {
+	if q.attached.Swap(false) {
+		detachNetworks(q.machineConfig)
+	}
+}
+
+// exited commits the overlay over the base image if asked to, once qemu released it.
+func (q *QEMU) exited() error {
+	if q.machineConfig.BaseImage == "" || !q.machineConfig.CommitOverlay {
+		return nil
+	}
+	if !waitState(q, 30*time.Second, types.StateStopped, types.StateCrashed, types.StateGone) {
+		return fmt.Errorf("qemu didn't exit, not committing the overlay")
+	}
+	return q.CommitOverlay()
+}
+
+// disconnect closes the ssh and qmp connections to the machine.
+func (q *QEMU) disconnect() {
+	if err := controller.CloseConnection(q); err != nil {
+		log.Debugf("Failed closing ssh connection: %s", err.Error())
+	}
+	q.qmpLock.Lock()
+	if q.qmpClient != nil {
+		q.qmpClient.Close()
+		q.qmpClient = nil
+	}
+	q.qmpLock.Unlock()
+}
+
+// State tells the machine state from the qemu process, and from the run state reported by QMP while it runs.
+func (q *QEMU) State() (types.State, error) {
+	if q.creating.Load() {
+		return types.StateCreating, nil
+	}
+
+	p := process.New(process.WithStateDir(q.machineConfig.StateDir))
+	if !p.IsAlive() {
+		code, err := p.ExitCode()
+		switch {
+		case err != nil:
+			// Never started, or cleaned
+			return types.StateGone, nil
+		case code == "0" || q.stopped.Load():
+			return types.StateStopped, nil
+		default:
+			return types.StateCrashed, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	qmp, err := q.QMP(ctx)
+	if err != nil {
+		// QMP is not up yet
+		return types.StateCreating, nil
+	}
+	status := struct {
+		Status string `json:"status"`
+	}{}
+	if err := qmp.Execute(ctx, "query-status", nil, &status); err != nil {
+		return "", err
+	}
+
+	switch status.Status {
+	case "running":
+		return types.StateRunning, nil
+	case "paused", "suspended":
+		return types.StatePaused, nil
+	case "shutdown":
+		return types.StateStopped, nil
+	case "internal-error", "io-error", "guest-panicked", "watchdog":
+		return types.StateCrashed, nil
+	default:
+		// prelaunch, migrations and restoring snapshots
+		return types.StateCreating, nil
+	}
+}
+
+// Pause stops the virtual CPUs.
+func (q *QEMU) Pause() error {
+	return q.qmpExecute("stop")
+}
+
+// Resume starts the virtual CPUs again.
+func (q *QEMU) Resume() error {
+	return q.qmpExecute("cont")
+}
+
+// Restart resets the machine when hard, or reboots it from the guest otherwise.
+func (q *QEMU) Restart(hard bool) error {
+	if !hard {
+		return guestReboot(q, "sudo /bin/sh")
+	}
+	defer controller.CloseConnection(q) //nolint:errcheck
+	return q.qmpExecute("system_reset")
+}
+
+// Shutdown powers the machine off. When graceful, the guest gets an ACPI power button event and
+// is powered off hard if qemu didn't exit within timeout.
+func (q *QEMU) Shutdown(graceful bool, timeout time.Duration) error {
+	if !graceful {
+		return q.Stop()
+	}
+
+	q.stopped.Store(true)
+	if err := q.qmpExecute("system_powerdown"); err != nil {
+		return err
+	}
+	if !waitState(q, timeout, types.StateStopped, types.StateCrashed, types.StateGone) {
+		if err := q.Stop(); err != nil {
+			return fmt.Errorf("%w, and powering off failed: %s", types.ErrShutdownTimeout, err.Error())
+		}
+		return types.ErrShutdownTimeout
+	}
+	q.disconnect()
+	return q.exited()
+}
+
+// qmpExecute runs a QMP command without arguments nor return value.
+func (q *QEMU) qmpExecute(cmd string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	qmp, err := q.QMP(ctx)
+	if err != nil {
+		return err
+	}
+	if err := qmp.Execute(ctx, cmd, nil, nil); err != nil {
+		return fmt.Errorf("failed running %s: %w", cmd, err)
+	}
+	return nil
 }
 
 func (q *QEMU) Clean() error {
+	if err := q.Stop(); err != nil {
+		return err
+	}
 	if q.machineConfig.StateDir != "" {
 		return os.RemoveAll(q.machineConfig.StateDir)
 	}
@@ -209,7 +521,8 @@ func (q *QEMU) Clean() error {
 }
 
 func (q *QEMU) Alive() bool {
-	return process.New(process.WithStateDir(q.machineConfig.StateDir)).IsAlive()
+	s, err := q.State()
+	return err == nil && (s == types.StateRunning || s == types.StatePaused)
 }
 
 func (q *QEMU) CreateDisk(diskname, size string) error {
@@ -224,82 +537,291 @@ func (q *QEMU) CreateDisk(diskname, size string) error {
 	return nil
 }
 
+// createOverlay creates a qcow2 overlay backed by the base image, so the base image is never written to.
+func (q *QEMU) createOverlay() error {
+	base, err := filepath.Abs(q.machineConfig.BaseImage)
+	if err != nil {
+		return err
+	}
+
+	out, err := utils.SH(fmt.Sprintf("qemu-img info --output=json %s", base))
+	if err != nil {
+		return fmt.Errorf("failed inspecting base image: %w - %s", err, out)
+	}
+	info := struct {
+		Format string `json:"format"`
+	}{}
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		return fmt.Errorf("failed inspecting base image: %w", err)
+	}
+
+	if err := os.MkdirAll(q.machineConfig.StateDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	// The overlay inherits the base image size, unless the first drive size asks for more
+	size := ""
+	if len(q.machineConfig.DriveSizes) > 0 {
+		size = q.driveSizes()[0]
+	}
+	out, err = utils.SH(fmt.Sprintf("qemu-img create -f qcow2 -b %s -F %s %s %s", base, info.Format, q.overlayFile(), size))
+	if err != nil {
+		return fmt.Errorf("failed creating overlay: %w - %s", err, out)
+	}
+
+	log.Infof("Overlay at %s, backed by %s", q.overlayFile(), base)
+	return nil
+}
+
+// CommitOverlay writes the changes made on the overlay back to the base image.
+// The machine must not be running.
+func (q *QEMU) CommitOverlay() error {
+	if q.machineConfig.BaseImage == "" {
+		return fmt.Errorf("machine has no base image")
+	}
+	out, err := utils.SH(fmt.Sprintf("qemu-img commit %s", q.overlayFile()))
+	if err != nil {
+		return fmt.Errorf("failed committing overlay: %w - %s", err, out)
+	}
+	return nil
+}
+
+func (q *QEMU) overlayFile() string {
+	return filepath.Join(q.machineConfig.StateDir, fmt.Sprintf("%s-overlay.qcow2", q.machineConfig.ID))
+}
+
 func (q *QEMU) Command(cmd string) (string, error) {
 	return controller.SSHCommand(q, cmd)
 }
 
+func (q *QEMU) CommandContext(ctx context.Context, cmd string) (string, error) {
+	return controller.SSHCommandContext(ctx, q, cmd)
+}
+
+// DetachCD ejects the ISO the machine booted from. If the ISO can't be identified,
+// the first CD drive with a media inserted is ejected.
 func (q *QEMU) DetachCD() error {
-	conn, err := net.Dial("unix", q.monitorSockFile())
+	ctx := context.Background()
+	qmp, err := q.QMP(ctx)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-
-	// TODO: Move this to do a info block and then grep for the CDs? May get a little messier
-	/* info block output:
-	$ echo "info block" | socat - unix-connect:/tmp/3611028457/qemu-monitor.sock
-	QEMU 7.2.5 monitor - type 'help' for more information
-	(qemu) info block
-	pflash0 (#block112): /usr/share/OVMF/OVMF_CODE.secboot.fd (raw, read-only)
-	    Attached to:      /machine/system.flash0
-	    Cache mode:       writeback
-
-	pflash1 (#block307): /home/itxaka/projects/kairos/tests/assets/efivars.fd (raw)
-	    Attached to:      /machine/system.flash1
-	    Cache mode:       writeback
-
-	ide0-cd0 (#block570): /home/itxaka/projects/kairos/build/kairos-core-fedora-amd64-generic-v2.4.0-24-g3a54c8f-dirty.iso (raw, read-only)
-	    Attached to:      /machine/unattached/device[20]
-	    Removable device: locked, tray closed
-	    Cache mode:       writeback
-
-	virtio0 (#block772): /tmp/3611028457/67223b53-449a-4ad2-8b29-3226758190d5.img (qcow2)
-	    Attached to:      /machine/peripheral-anon/device[1]/virtio-backend
-	    Cache mode:       writeback
-
-	ide2-cd0: [not inserted]
-	    Attached to:      /machine/unattached/device[21]
-	    Removable device: not locked, tray closed
-
-	sd0: [not inserted]
-	    Removable device: not locked, tray closed
-	*/
-	cmd := "eject -f ide0-cd0\r\n"
-	n, err := fmt.Fprint(conn, cmd)
+
+	devices, err := qmp.QueryBlock(ctx)
 	if err != nil {
 		return err
 	}
 
-	if n != len(cmd) {
-		return fmt.Errorf("didn't send the full command (%d out of %d bytes)", n, len(cmd))
+	var cd *BlockDevice
+	for i, d := range devices {
+		if !d.Removable || d.Inserted == nil {
+			continue
+		}
+		if cd == nil || (q.machineConfig.ISO != "" && d.Inserted.File == q.machineConfig.ISO) {
+			cd = &devices[i]
+		}
 	}
-
-	// If there is nothing for more than a second, stop
-	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
-		return err
+	if cd == nil {
+		return fmt.Errorf("no CD inserted")
 	}
 
-	// It seems that the screendump image.png command doesn't have any effect
-	// until we read the data from the socket. I would expect reading the data to
-	// be irrelevant but after trial and errors, this seems to be necessary for some reason.
-	for {
-		b := make([]byte, 1024)
-		if _, err := conn.Read(b); err != nil {
-			break
-		}
+	args := map[string]interface{}{"force": true}
+	if cd.Device != "" {
+		args["device"] = cd.Device
+	} else {
+		args["id"] = cd.QDev
 	}
+	return qmp.Execute(ctx, "eject", args, nil)
+}
 
-	return nil
+func (q *QEMU) Run(ctx context.Context, cmd string, opts ...types.RunOption) (*types.CommandResult, error) {
+	return controller.SSHRun(ctx, q, cmd, opts...)
 }
 
 func (q *QEMU) ReceiveFile(src, dst string) error {
 	return controller.ReceiveFile(q, src, dst)
 }
 
+func (q *QEMU) ReceiveFileContext(ctx context.Context, src, dst string) error {
+	return controller.ReceiveFileContext(ctx, q, src, dst)
+}
+
 func (q *QEMU) SendFile(src, dst, permissions string) error {
 	return controller.SendFile(q, src, dst, permissions)
 }
 
+func (q *QEMU) SendFileContext(ctx context.Context, src, dst, permissions string) error {
+	return controller.SendFileContext(ctx, q, src, dst, permissions)
+}
+
+// Snapshot saves the whole machine state (disks, memory and devices) as an internal
+// qcow2 snapshot, replacing any snapshot with the same name.
+func (q *QEMU) Snapshot(name string) error {
+	return q.snapshotCommand("savevm", name)
+}
+
+// Restore brings the machine back to the state saved in the named snapshot.
+func (q *QEMU) Restore(name string) error {
+	// The guest network stack is rolled back, established connections won't survive
+	defer controller.CloseConnection(q) //nolint:errcheck
+	return q.snapshotCommand("loadvm", name)
+}
+
+func (q *QEMU) ListSnapshots() ([]string, error) {
+	ctx := context.Background()
+	qmp, err := q.QMP(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := qmp.QueryBlock(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshots span every disk, the first one with an image is enough
+	names := []string{}
+	for _, d := range devices {
+		if d.Removable || d.Inserted == nil {
+			continue
+		}
+		for _, s := range d.Inserted.Image.Snapshots {
+			names = append(names, s.Name)
+		}
+		break
+	}
+	return names, nil
+}
+
+func (q *QEMU) snapshotCommand(cmd, name string) error {
+	ctx := context.Background()
+	qmp, err := q.QMP(ctx)
+	if err != nil {
+		return err
+	}
+
+	// savevm and loadvm print only on failure
+	out, err := qmp.HumanMonitorCommand(ctx, fmt.Sprintf("%s %s", cmd, name))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(out) != "" {
+		return fmt.Errorf("%s %s failed: %s", cmd, name, out)
+	}
+	return nil
+}
+
+// qemuUserNetdev is the netdev id of the default network.
+const qemuUserNetdev = "user0"
+
+// netdevs returns the netdev ids of the given networks, all of them if none is given.
+func (q *QEMU) netdevs(networks ...string) ([]string, error) {
+	all := map[string]string{}
+	if !q.machineConfig.DisableDefaultNetworking {
+		all[types.DefaultNetwork] = qemuUserNetdev
+	}
+	for i, n := range q.machineConfig.Networks {
+		all[n.Name] = fmt.Sprintf("net%d", i)
+	}
+
+	ids := []string{}
+	if len(networks) == 0 {
+		for _, id := range all {
+			ids = append(ids, id)
+		}
+		return ids, nil
+	}
+	for _, n := range networks {
+		id, ok := all[n]
+		if !ok {
+			return nil, fmt.Errorf("machine is not attached to network %s", n)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// SetLinkUp plugs or unplugs the virtual cable of the given networks, all of them if none is given.
+func (q *QEMU) SetLinkUp(up bool, networks ...string) error {
+	ids, err := q.netdevs(networks...)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	qmp, err := q.QMP(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := qmp.Execute(ctx, "set_link", map[string]interface{}{"name": id, "up": up}, nil); err != nil {
+			return fmt.Errorf("failed setting link of %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// SetNetworkConditions adds packet loss and latency to the guest network, with netem in the guest.
+func (q *QEMU) SetNetworkConditions(c types.NetworkConditions) error {
+	return controller.SetNetworkConditions(context.Background(), q, c)
+}
+
+// SendKeys presses key combinations on the machine keyboard, in QEMU sendkey syntax (e.g. "ctrl-alt-delete").
+func (q *QEMU) SendKeys(keys ...string) error {
+	ctx := context.Background()
+	qmp, err := q.QMP(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, combo := range keys {
+		qcodes := []map[string]string{}
+		for _, k := range strings.Split(combo, "-") {
+			qcodes = append(qcodes, map[string]string{"type": "qcode", "data": k})
+		}
+		if err := qmp.Execute(ctx, "send-key", map[string]interface{}{"keys": qcodes}, nil); err != nil {
+			return fmt.Errorf("failed sending %s: %w", combo, err)
+		}
+	}
+	return nil
+}
+
+// TypeText types text on the machine keyboard, as on a US layout.
+func (q *QEMU) TypeText(text string) error {
+	keys, err := textToKeys(text)
+	if err != nil {
+		return err
+	}
+	return q.SendKeys(keys...)
+}
+
+// HostPort returns the host port a guest port is forwarded to.
+func (q *QEMU) HostPort(guestPort int) (int, error) {
+	return hostPort(q.machineConfig, guestPort)
+}
+
+// Addresses returns the IPv4 address of the guest on each of its private networks, by network name.
+func (q *QEMU) Addresses(ctx context.Context) (map[string]string, error) {
+	return controller.GuestAddresses(ctx, q)
+}
+
+// Console returns the serial console output captured since the machine started.
+func (q *QEMU) Console() (io.ReadCloser, error) {
+	return os.Open(q.consoleLogFile())
+}
+
+func (q *QEMU) consoleSockFile() string {
+	return path.Join(q.machineConfig.StateDir, "console.sock")
+}
+
+func (q *QEMU) consoleLogFile() string {
+	return path.Join(q.machineConfig.StateDir, "console.log")
+}
+
+func (q *QEMU) qmpSockFile() string {
+	return path.Join(q.machineConfig.StateDir, "qmp.sock")
+}
+
 func (q *QEMU) monitorSockFile() string {
 	return path.Join(q.machineConfig.StateDir, "qemu-monitor.sock")
 }
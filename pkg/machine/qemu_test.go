@@ -0,0 +1,66 @@
+package machine_test
+
+import (
+	"context"
+	"image/color"
+	"image/png"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/pkg/machine"
+	"github.com/spectrocloud/peg/pkg/machine/conformance/fakes"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+var _ = Describe("QEMU", func() {
+	It("converts the screendumps of QEMU before 7.1 to PNG", func() {
+		version := os.Getenv(fakes.EnvQEMUVersion)
+		Expect(os.Setenv(fakes.EnvQEMUVersion, "6.2")).To(Succeed())
+		DeferCleanup(os.Setenv, fakes.EnvQEMUVersion, version)
+
+		m, err := machine.New(types.QEMUEngine, types.WithProcessName(fake.Bin("qemu-system-x86_64")), fakeISO())
+		Expect(err).ToNot(HaveOccurred())
+		_, err = m.Create(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(m.Clean)
+		Eventually(m.State, 30*time.Second, 100*time.Millisecond).Should(Equal(types.StateRunning))
+
+		screenshot, err := m.Screenshot()
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.Remove, screenshot)
+		f, err := os.Open(screenshot)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		img, err := png.Decode(f)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(color.RGBAModel.Convert(img.At(0, 0))).To(Equal(color.RGBA{R: 0, G: 0x80, B: 0xff, A: 0xff}))
+	})
+
+	It("serves DHCP on the private networks asking for it", func() {
+		newMachine := func(subnet string) types.Machine {
+			m, err := machine.New(types.QEMUEngine, types.WithProcessName(fake.Bin("qemu-system-x86_64")), fakeISO(),
+				types.WithNetwork(types.Network{Name: "lan", DHCP: subnet}))
+			Expect(err).ToNot(HaveOccurred())
+			return m
+		}
+
+		m := newMachine("10.1.0.0/24")
+		_, err := m.Create(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(m.Clean)
+		_, err = newMachine("10.1.0.0/24").Create(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+
+		other := newMachine("10.2.0.0/24")
+		_, err = other.Create(context.Background())
+		Expect(err).To(MatchError("network lan already leases addresses of 10.1.0.0/24, not 10.2.0.0/24"))
+	})
+
+	It("rejects networks with both a static address and DHCP", func() {
+		_, err := machine.New(types.QEMUEngine, types.WithProcessName(fake.Bin("qemu-system-x86_64")),
+			types.WithNetwork(types.Network{Name: "lan", Address: "10.1.0.2/24", DHCP: "10.1.0.0/24"}))
+		Expect(err).To(MatchError(ContainSubstring("network lan has both a static address and dhcp")))
+	})
+})
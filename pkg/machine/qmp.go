@@ -0,0 +1,281 @@
+package machine
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// QMP events peg cares about. See https://qemu-project.gitlab.io/qemu/interop/qemu-qmp-ref.html
+const (
+	QMPEventShutdown     = "SHUTDOWN"
+	QMPEventReset        = "RESET"
+	QMPEventBlockIOError = "BLOCK_IO_ERROR"
+)
+
+// QMPEvent is an asynchronous event emitted by QEMU.
+type QMPEvent struct {
+	Event     string                 `json:"event"`
+	Data      map[string]interface{} `json:"data"`
+	Timestamp struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp"`
+}
+
+// QMPError is an error returned by QEMU in reply to a command.
+type QMPError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *QMPError) Error() string {
+	return fmt.Sprintf("qmp: %s: %s", e.Class, e.Desc)
+}
+
+// BlockDevice is a block device as reported by `query-block`.
+type BlockDevice struct {
+	Device    string `json:"device"`
+	QDev      string `json:"qdev"`
+	Removable bool   `json:"removable"`
+	Locked    bool   `json:"locked"`
+	TrayOpen  bool   `json:"tray_open"`
+	Inserted  *struct {
+		File     string `json:"file"`
+		ReadOnly bool   `json:"ro"`
+		Driver   string `json:"drv"`
+		Image    struct {
+			Filename  string `json:"filename"`
+			Format    string `json:"format"`
+			Snapshots []struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"snapshots"`
+		} `json:"image"`
+	} `json:"inserted"`
+}
+
+type qmpMessage struct {
+	ID     uint64          `json:"id"`
+	Return json.RawMessage `json:"return"`
+	Error  *QMPError       `json:"error"`
+	QMPEvent
+}
+
+// QMPClient talks the QEMU Machine Protocol over a unix socket.
+// Commands are executed one at a time, events are dispatched to subscribers.
+type QMPClient struct {
+	conn net.Conn
+
+	cmdLock   sync.Mutex
+	nextID    uint64
+	responses chan qmpMessage
+
+	subLock     sync.Mutex
+	subscribers map[chan QMPEvent][]string
+
+	done chan struct{}
+	err  error
+}
+
+// DialQMP connects to the QMP socket and negotiates capabilities.
+func DialQMP(ctx context.Context, socket string) (*QMPClient, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &QMPClient{
+		conn:        conn,
+		responses:   make(chan qmpMessage, 16),
+		subscribers: map[chan QMPEvent][]string{},
+		done:        make(chan struct{}),
+	}
+
+	// The greeting comes before anything else: {"QMP": {"version": ..., "capabilities": ...}}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if err := conn.SetReadDeadline(readDeadline(ctx, 10*time.Second)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !scanner.Scan() {
+		conn.Close()
+		return nil, fmt.Errorf("failed reading qmp greeting: %v", scanner.Err())
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go c.read(scanner)
+
+	if err := c.Execute(ctx, "qmp_capabilities", nil, nil); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed negotiating qmp capabilities: %w", err)
+	}
+
+	return c, nil
+}
+
+func (c *QMPClient) read(scanner *bufio.Scanner) {
+	for scanner.Scan() {
+		var msg qmpMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			log.Debugf("Invalid qmp message %s: %s", scanner.Text(), err.Error())
+			continue
+		}
+
+		if msg.Event != "" {
+			c.dispatch(msg.QMPEvent)
+			continue
+		}
+		select {
+		case c.responses <- msg:
+		default:
+			log.Warnf("Dropping stale qmp reply %d", msg.ID)
+		}
+	}
+
+	c.err = scanner.Err()
+	if c.err == nil {
+		c.err = errors.New("qmp connection closed")
+	}
+
+	c.subLock.Lock()
+	defer c.subLock.Unlock()
+	for ch := range c.subscribers {
+		close(ch)
+		delete(c.subscribers, ch)
+	}
+	close(c.done)
+}
+
+func (c *QMPClient) dispatch(e QMPEvent) {
+	c.subLock.Lock()
+	defer c.subLock.Unlock()
+
+	for ch, events := range c.subscribers {
+		if len(events) != 0 && !contains(events, e.Event) {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+			log.Warnf("Dropping qmp event %s, subscriber is not keeping up", e.Event)
+		}
+	}
+}
+
+// Execute runs command with the given arguments and decodes its return value in result, if not nil.
+func (c *QMPClient) Execute(ctx context.Context, command string, args interface{}, result interface{}) error {
+	c.cmdLock.Lock()
+	defer c.cmdLock.Unlock()
+
+	c.nextID++
+	req := map[string]interface{}{"execute": command, "id": c.nextID}
+	if args != nil {
+		req["arguments"] = args
+	}
+
+	if err := c.conn.SetWriteDeadline(readDeadline(ctx, 10*time.Second)); err != nil {
+		return err
+	}
+	if err := json.NewEncoder(c.conn).Encode(req); err != nil {
+		return fmt.Errorf("failed sending %s: %w", command, err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// The reply is buffered and skipped by the next command
+			return ctx.Err()
+		case <-c.done:
+			return c.err
+		case msg := <-c.responses:
+			if msg.ID != c.nextID {
+				// A late reply to a command we stopped waiting for
+				continue
+			}
+			if msg.Error != nil {
+				return msg.Error
+			}
+			if result != nil {
+				return json.Unmarshal(msg.Return, result)
+			}
+			return nil
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the given events, or all of them if none is given.
+// The channel is closed when the connection drops or the returned function is called.
+func (c *QMPClient) Subscribe(events ...string) (<-chan QMPEvent, func()) {
+	c.subLock.Lock()
+	defer c.subLock.Unlock()
+
+	ch := make(chan QMPEvent, 32)
+	select {
+	case <-c.done:
+		close(ch)
+		return ch, func() {}
+	default:
+	}
+	c.subscribers[ch] = events
+
+	return ch, func() {
+		c.subLock.Lock()
+		defer c.subLock.Unlock()
+		if _, ok := c.subscribers[ch]; ok {
+			close(ch)
+			delete(c.subscribers, ch)
+		}
+	}
+}
+
+// QueryBlock lists the block devices of the machine.
+func (c *QMPClient) QueryBlock(ctx context.Context) ([]BlockDevice, error) {
+	devices := []BlockDevice{}
+	err := c.Execute(ctx, "query-block", nil, &devices)
+	return devices, err
+}
+
+// HumanMonitorCommand runs a human monitor command for what QMP has no synchronous equivalent of (e.g. savevm).
+func (c *QMPClient) HumanMonitorCommand(ctx context.Context, cmd string) (string, error) {
+	var out string
+	err := c.Execute(ctx, "human-monitor-command", map[string]interface{}{"command-line": cmd}, &out)
+	return out, err
+}
+
+// Done is closed when the connection drops.
+func (c *QMPClient) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *QMPClient) Close() error {
+	return c.conn.Close()
+}
+
+// readDeadline returns a deadline d from now, or the context deadline if it comes earlier.
+func readDeadline(ctx context.Context, d time.Duration) time.Time {
+	deadline := time.Now().Add(d)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		return ctxDeadline
+	}
+	return deadline
+}
+
+func contains(s []string, e string) bool {
+	for _, ss := range s {
+		if ss == e {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package types
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CommandResult is the outcome of a command that ran on a machine.
+// A command that ran and exited non-zero is not an error: errors returned
+// alongside a CommandResult are reserved for transport failures.
+type CommandResult struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	Duration time.Duration
+	// Signal is the name of the signal which terminated the command (e.g. "KILL"), if any.
+	Signal string
+}
+
+// Success returns true if the command exited with 0.
+func (r *CommandResult) Success() bool {
+	return r.ExitCode == 0 && r.Signal == ""
+}
+
+func (r *CommandResult) String() string {
+	s := fmt.Sprintf("exit code: %d", r.ExitCode)
+	if r.Signal != "" {
+		s += fmt.Sprintf(", signal: %s", r.Signal)
+	}
+	return fmt.Sprintf("%s\nstdout:\n%s\nstderr:\n%s", s, r.Stdout, r.Stderr)
+}
+
+// ExitError is the error of helpers which fail on commands exiting non-zero or killed by a signal,
+// e.g. matcher.Sudo. It holds the result of the command.
+type ExitError struct {
+	*CommandResult
+}
+
+func (e *ExitError) Error() string {
+	if e.Signal != "" {
+		return fmt.Sprintf("command killed by signal %s", e.Signal)
+	}
+	return fmt.Sprintf("command exited with status %d", e.ExitCode)
+}
+
+// ExitStatus returns the exit code of the command, like ssh.ExitError does.
+func (e *ExitError) ExitStatus() int {
+	return e.ExitCode
+}
+
+type RunConfig struct {
+	Stdin io.Reader
+	Env   map[string]string
+
+	// Stdout and Stderr receive the command output as it is produced,
+	// in addition to being collected in the CommandResult.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+type RunOption func(*RunConfig)
+
+// NewRunConfig returns a RunConfig with the given options applied.
+func NewRunConfig(opts ...RunOption) *RunConfig {
+	c := &RunConfig{Env: map[string]string{}}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// Command returns the command with the environment prepended, as understood by a POSIX shell.
+func (c *RunConfig) Command(cmd string) string {
+	if len(c.Env) == 0 {
+		return cmd
+	}
+
+	keys := []string{}
+	for k := range c.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	env := []string{}
+	for _, k := range keys {
+		env = append(env, fmt.Sprintf("export %s=%s;", k, ShellQuote(c.Env[k])))
+	}
+	return fmt.Sprintf("%s %s", strings.Join(env, " "), cmd)
+}
+
+// Tee returns writers duplicating to stdout and stderr the output streamed to the configured writers.
+func (c *RunConfig) Tee(stdout, stderr io.Writer) (io.Writer, io.Writer) {
+	if c.Stdout != nil {
+		stdout = io.MultiWriter(stdout, c.Stdout)
+	}
+	if c.Stderr != nil {
+		stderr = io.MultiWriter(stderr, c.Stderr)
+	}
+	return stdout, stderr
+}
+
+// WithStdout streams the command standard output to w.
+func WithStdout(w io.Writer) RunOption {
+	return func(c *RunConfig) {
+		c.Stdout = w
+	}
+}
+
+// WithStderr streams the command standard error to w.
+func WithStderr(w io.Writer) RunOption {
+	return func(c *RunConfig) {
+		c.Stderr = w
+	}
+}
+
+// WithStdin feeds r to the command standard input.
+func WithStdin(r io.Reader) RunOption {
+	return func(c *RunConfig) {
+		c.Stdin = r
+	}
+}
+
+// WithEnv sets an environment variable for the command.
+func WithEnv(key, value string) RunOption {
+	return func(c *RunConfig) {
+		c.Env[key] = value
+	}
+}
+
+// ShellQuote quotes s so it is passed as a single word to a POSIX shell.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
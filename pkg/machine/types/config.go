@@ -16,14 +16,58 @@ type SSH struct {
 	User string `yaml:"user,omitempty"`
 	Port string `yaml:"port,omitempty"`
 	Pass string `yaml:"pass,omitempty"`
+
+	// Public key authentication. PrivateKey is an inline PEM key and takes
+	// precedence over PrivateKeyFile.
+	PrivateKey     string `yaml:"privateKey,omitempty"`
+	PrivateKeyFile string `yaml:"privateKeyFile,omitempty"`
+	Passphrase     string `yaml:"passphrase,omitempty"`
+
+	// AgentSocket is the path of an ssh-agent socket. When empty and the
+	// agent method is requested explicitly, SSH_AUTH_SOCK is used.
+	AgentSocket string `yaml:"agentSocket,omitempty"`
+
+	// AuthOrder is the order in which authentication methods are tried.
+	// When empty, every configured method is tried in the order: key, agent, password.
+	// The key and the agent are tried together, where the first of them is in the order.
+	AuthOrder []SSHAuthMethod `yaml:"authOrder,omitempty"`
+
+	// HostKeyPolicy controls how the guest host key is verified. Defaults to ignore.
+	HostKeyPolicy HostKeyPolicy `yaml:"hostKeyPolicy,omitempty"`
+	// HostKeyFingerprint is the SHA256 fingerprint (as printed by `ssh-keygen -l`) expected by the pin policy.
+	HostKeyFingerprint string `yaml:"hostKeyFingerprint,omitempty"`
 }
 
+type SSHAuthMethod string
+
+const (
+	SSHAuthPassword SSHAuthMethod = "password"
+	SSHAuthKey      SSHAuthMethod = "key"
+	SSHAuthAgent    SSHAuthMethod = "agent"
+)
+
+type HostKeyPolicy string
+
+const (
+	// HostKeyIgnore accepts any host key.
+	HostKeyIgnore HostKeyPolicy = "ignore"
+	// HostKeyTOFU trusts the first key seen and records it in a known_hosts file in the state directory.
+	HostKeyTOFU HostKeyPolicy = "tofu"
+	// HostKeyPin accepts only the key matching HostKeyFingerprint.
+	HostKeyPin HostKeyPolicy = "pin"
+)
+
 type MachineConfig struct {
 	StateDir    string `yaml:"state,omitempty"`
 	Image       string `yaml:"image,omitempty"`
 	ISO         string `yaml:"iso,omitempty"`
 	ISOChecksum string `yaml:"isoChecksum,omitempty"`
 
+	// BaseImage is a disk image attached through a qcow2 overlay in the state directory,
+	// so it is never modified unless CommitOverlay is set. Only for qemu.
+	BaseImage     string `yaml:"baseImage,omitempty"`
+	CommitOverlay bool   `yaml:"commitOverlay,omitempty"`
+
 	DataSource     string   `yaml:"datasource,omitempty"`
 	Drives         []string `yaml:"drives,omitempty"`
 	DriveSizes     []string `yaml:"driveSizes,omitempty"`
@@ -31,28 +75,115 @@ type MachineConfig struct {
 	ID             string   `yaml:"id,omitempty"`
 	Memory         string   `yaml:"memory,omitempty"`
 	CPU            string   `yaml:"cpu,omitempty"`
-	Process        string   `yaml:"bin,omitempty"`
-	Args           []string `yaml:"args,omitempty"`
+	// Process is the executable of the qemu and nerdctl engines. With the docker and podman engines, a docker or
+	// podman executable is deprecated and picks the API socket of that engine.
+	Process string `yaml:"bin,omitempty"`
+	// Args are passed to qemu, `nerdctl run` and the pod as given. The docker and podman engines split them like a
+	// shell and take the `docker run` flags peg knows of, ignoring the others with a warning.
+	Args []string `yaml:"args,omitempty"`
 	// only for qemu
 	Display string `yaml:"display,omitempty"`
 
-	CPUType string `yaml:"cpu,omitempty"`
+	// CPUType is the CPU model emulated by qemu (e.g. host). It is read from cpuType, cpu being the number of CPUs.
+	CPUType string `yaml:"cpuType,omitempty"`
 
 	// Network configuration
 	DisableDefaultNetworking bool `yaml:"disable_default_networking,omitempty"`
+	// Ports are guest ports forwarded to the host, on top of SSH.
+	Ports []Port `yaml:"ports,omitempty"`
+	// Networks are private networks shared with the other machines attached to them. Only for qemu.
+	Networks []Network `yaml:"networks,omitempty"`
 
 	SSH    *SSH   `yaml:"ssh,omitempty"`
 	Engine Engine `yaml:"engine,omitempty"`
+	// Kubernetes is where machines of the kubernetes engine run.
+	Kubernetes KubernetesConfig `yaml:"kubernetes,omitempty"`
+	// Container tunes the containers of the docker, podman and nerdctl engines.
+	Container ContainerConfig `yaml:"container,omitempty"`
 
 	OnFailure func(*process.Process)
 }
 
+// KubernetesConfig locates the cluster and namespace of kubernetes machines.
+type KubernetesConfig struct {
+	// Kubeconfig is the path of the kubeconfig file. Defaults to $KUBECONFIG, then ~/.kube/config.
+	Kubeconfig string `yaml:"kubeconfig,omitempty"`
+	// Context is the kubeconfig context to use. Defaults to the current one.
+	Context string `yaml:"context,omitempty"`
+	// Namespace defaults to the namespace of the context, then to "default".
+	Namespace string `yaml:"namespace,omitempty"`
+}
+
+// ContainerConfig tunes the containers machines run as.
+type ContainerConfig struct {
+	// Init boots the init of the image instead of a shell, so the container runs services like a machine:
+	// "systemd", "openrc", or the path of any other init. The container is then privileged.
+	Init string `yaml:"init,omitempty"`
+	// Host is the Docker Engine API endpoint of the docker and podman engines, unix:///path/to/socket or tcp://host:port.
+	// Defaults to $DOCKER_HOST with the docker engine, then to the first docker or podman socket found.
+	Host string `yaml:"host,omitempty"`
+}
+
+// Network is a private L2 segment between machines on the same host, backed by a
+// multicast socket. Machines attached to a network with the same name share the segment.
+type Network struct {
+	Name string `yaml:"name"`
+	// Address is the static address of the machine in CIDR notation (e.g. 10.0.0.2/24).
+	// When empty, the guest is expected to get one itself, e.g. from the DHCP server of DHCP.
+	Address string `yaml:"address,omitempty"`
+	// DHCP is the subnet the machine gets its address from (e.g. 10.0.0.0/24), leased by the DHCP server peg runs
+	// on the segment. The first address of the subnet is the server's, the static ones of the network are never leased.
+	DHCP string `yaml:"dhcp,omitempty"`
+	// MAC is the hardware address of the guest interface. Generated from the machine ID when empty.
+	MAC string `yaml:"mac,omitempty"`
+	// Group is the multicast group:port backing the segment. Derived from the name and the process creating the machines when empty.
+	Group string `yaml:"group,omitempty"`
+}
+
+// Port forwards a guest port to a host port on the loopback.
+// In yaml it can also be given as the bare guest port number.
+type Port struct {
+	Guest int `yaml:"guest"`
+	// Host is allocated automatically when 0.
+	Host int `yaml:"host,omitempty"`
+	// Protocol is tcp or udp. Defaults to tcp.
+	Protocol string `yaml:"protocol,omitempty"`
+}
+
+func (p *Port) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return n.Decode(&p.Guest)
+	}
+	type plain Port
+	return n.Decode((*plain)(p))
+}
+
+// DefaultNetwork is the name of the default (user/NAT) network of the machine, as opposed to its private networks.
+const DefaultNetwork = "default"
+
+// NetworkConditions degrade the guest network with netem. The zero value restores it.
+type NetworkConditions struct {
+	// Loss is the percentage of packets dropped.
+	Loss float64 `yaml:"loss,omitempty"`
+	// Latency is added to every packet sent (e.g. "200ms"), Jitter varies it.
+	Latency string `yaml:"latency,omitempty"`
+	Jitter  string `yaml:"jitter,omitempty"`
+	// Interface is the guest interface to degrade. Defaults to the one of the default route.
+	Interface string `yaml:"interface,omitempty"`
+	// Duration makes the guest restore the network by itself after it (e.g. "30s"), for when the
+	// conditions keep the commands restoring it from reaching the guest.
+	Duration string `yaml:"duration,omitempty"`
+}
+
 type Engine string
 
 const (
-	VBox   Engine = "vbox"
-	QEMU   Engine = "qemu"
-	Docker Engine = "docker"
+	VBox       Engine = "vbox"
+	QEMU       Engine = "qemu"
+	Docker     Engine = "docker"
+	Podman     Engine = "podman"
+	Nerdctl    Engine = "nerdctl"
+	Kubernetes Engine = "kubernetes"
 )
 
 type MachineOption func(*MachineConfig) error
@@ -166,6 +297,16 @@ func WithISO(iso string) MachineOption {
 	}
 }
 
+func WithBaseImage(img string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if img != "" {
+			mc.BaseImage = img
+		}
+
+		return nil
+	}
+}
+
 func WithDrive(drive string) MachineOption {
 	return func(mc *MachineConfig) error {
 		if drive != "" {
@@ -186,6 +327,24 @@ func WithDriveSize(drivesize string) MachineOption {
 	}
 }
 
+// WithPorts forwards the given guest tcp ports to automatically allocated host ports.
+func WithPorts(guestPorts ...int) MachineOption {
+	return func(mc *MachineConfig) error {
+		for _, g := range guestPorts {
+			mc.Ports = append(mc.Ports, Port{Guest: g})
+		}
+		return nil
+	}
+}
+
+// WithNetwork attaches the machine to a private network.
+func WithNetwork(n Network) MachineOption {
+	return func(mc *MachineConfig) error {
+		mc.Networks = append(mc.Networks, n)
+		return nil
+	}
+}
+
 func FromFile(path string) MachineOption {
 	return func(mc *MachineConfig) error {
 		dat, err := ioutil.ReadFile(path)
@@ -235,6 +394,83 @@ func WithSSHUser(sshuser string) MachineOption {
 	}
 }
 
+func WithSSHPrivateKey(pem string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if pem != "" {
+			mc.SSH.PrivateKey = pem
+		}
+		return nil
+	}
+}
+
+func WithSSHPrivateKeyFile(path string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if path != "" {
+			mc.SSH.PrivateKeyFile = path
+		}
+		return nil
+	}
+}
+
+func WithSSHKeyPassphrase(passphrase string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if passphrase != "" {
+			mc.SSH.Passphrase = passphrase
+		}
+		return nil
+	}
+}
+
+func WithSSHAgent(socket string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if socket != "" {
+			mc.SSH.AgentSocket = socket
+		}
+		return nil
+	}
+}
+
+// WithSSHAuthOrder sets the order in which SSH authentication methods are tried.
+func WithSSHAuthOrder(methods ...SSHAuthMethod) MachineOption {
+	return func(mc *MachineConfig) error {
+		for _, m := range methods {
+			switch m {
+			case SSHAuthPassword, SSHAuthKey, SSHAuthAgent:
+			default:
+				return fmt.Errorf("invalid ssh auth method: %s", m)
+			}
+		}
+		if len(methods) != 0 {
+			mc.SSH.AuthOrder = methods
+		}
+		return nil
+	}
+}
+
+func WithSSHHostKeyPolicy(p HostKeyPolicy) MachineOption {
+	return func(mc *MachineConfig) error {
+		switch p {
+		case "":
+			return nil
+		case HostKeyIgnore, HostKeyTOFU, HostKeyPin:
+			mc.SSH.HostKeyPolicy = p
+			return nil
+		}
+		return fmt.Errorf("invalid host key policy: %s", p)
+	}
+}
+
+// WithSSHHostKeyFingerprint pins the guest host key to the given SHA256 fingerprint.
+func WithSSHHostKeyFingerprint(fp string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if fp != "" {
+			mc.SSH.HostKeyFingerprint = fp
+			mc.SSH.HostKeyPolicy = HostKeyPin
+		}
+		return nil
+	}
+}
+
 func WithStateDir(dir string) MachineOption {
 	return func(mc *MachineConfig) error {
 		if dir != "" {
@@ -244,6 +480,46 @@ func WithStateDir(dir string) MachineOption {
 	}
 }
 
+// WithKubeconfig sets the kubeconfig file of the cluster kubernetes machines run in.
+func WithKubeconfig(path string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if path != "" {
+			mc.Kubernetes.Kubeconfig = path
+		}
+		return nil
+	}
+}
+
+// WithNamespace sets the namespace kubernetes machines run in.
+func WithNamespace(ns string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if ns != "" {
+			mc.Kubernetes.Namespace = ns
+		}
+		return nil
+	}
+}
+
+// WithInit boots containers with the init of their image, like machines. See ContainerConfig.Init.
+func WithInit(init string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if init != "" {
+			mc.Container.Init = init
+		}
+		return nil
+	}
+}
+
+// WithContainerHost sets the Docker Engine API endpoint of the docker and podman engines. See ContainerConfig.Host.
+func WithContainerHost(host string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if host != "" {
+			mc.Container.Host = host
+		}
+		return nil
+	}
+}
+
 // VBoxEngine sets the machine engine to VBox.
 var VBoxEngine MachineOption = func(mc *MachineConfig) error {
 	mc.Engine = VBox
@@ -256,6 +532,36 @@ var QEMUEngine MachineOption = func(mc *MachineConfig) error {
 	return nil
 }
 
+// DockerEngine sets the machine engine to Docker.
+var DockerEngine MachineOption = func(mc *MachineConfig) error {
+	mc.Engine = Docker
+	return nil
+}
+
+// PodmanEngine sets the machine engine to Podman.
+var PodmanEngine MachineOption = func(mc *MachineConfig) error {
+	mc.Engine = Podman
+	return nil
+}
+
+// NerdctlEngine sets the machine engine to nerdctl.
+var NerdctlEngine MachineOption = func(mc *MachineConfig) error {
+	mc.Engine = Nerdctl
+	return nil
+}
+
+// KubernetesEngine sets the machine engine to Kubernetes.
+var KubernetesEngine MachineOption = func(mc *MachineConfig) error {
+	mc.Engine = Kubernetes
+	return nil
+}
+
+// EnableOverlayCommit writes the changes made on the overlay back to the base image when the machine stops.
+var EnableOverlayCommit MachineOption = func(mc *MachineConfig) error {
+	mc.CommitOverlay = true
+	return nil
+}
+
 // EnableAutoDriveSetup automatically setup a VM disk if nothing is specified.
 var EnableAutoDriveSetup MachineOption = func(mc *MachineConfig) error {
 	mc.AutoDriveSetup = true
@@ -1,16 +1,81 @@
 package types
 
-import "context"
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrShutdownTimeout is returned by Shutdown when the guest didn't shut down gracefully in time.
+var ErrShutdownTimeout = errors.New("timed out waiting for the guest to shut down")
 
 type Machine interface {
 	Config() MachineConfig
+	// Create creates and boots the machine. The returned context is done when the machine dies.
 	Create(ctx context.Context) (context.Context, error)
+	// Stop powers the machine off hard. It can't be started again, but its state is kept until Clean.
 	Stop() error
+	// Clean removes everything the machine left around, stopping it first if needed.
 	Clean() error
+	// State returns the lifecycle state of the machine. Errors are returned only when it can't be told.
+	State() (State, error)
+	// Pause freezes the machine, Resume unfreezes it.
+	Pause() error
+	Resume() error
+	// Restart reboots the machine, by resetting it when hard or from within the guest otherwise.
+	Restart(hard bool) error
+	// Shutdown powers the machine off. When graceful, the guest is asked to shut down and is powered off
+	// hard if it didn't within timeout, in which case ErrShutdownTimeout is returned.
+	Shutdown(graceful bool, timeout time.Duration) error
 	Screenshot() (string, error)
+	ScreenshotContext(ctx context.Context) (string, error)
 	CreateDisk(diskname, size string) error
 	Command(cmd string) (string, error)
+	// CommandContext is like Command, the command is killed and ctx.Err() returned if ctx is done before it exits.
+	CommandContext(ctx context.Context, cmd string) (string, error)
+	// Run runs cmd on the machine. A non-zero exit is not an error, errors are
+	// returned only when the command couldn't run or its outcome is unknown.
+	Run(ctx context.Context, cmd string, opts ...RunOption) (*CommandResult, error)
 	DetachCD() error
+	// Snapshot saves the machine state under name, replacing an existing snapshot with the same name.
+	Snapshot(name string) error
+	// Restore brings the machine back to the named snapshot.
+	Restore(name string) error
+	ListSnapshots() ([]string, error)
+	// SendKeys presses key combinations on the machine keyboard, in QEMU sendkey syntax (e.g. "ctrl-alt-delete").
+	SendKeys(keys ...string) error
+	// TypeText types text on the machine keyboard, as on a US layout.
+	TypeText(text string) error
+	// SetLinkUp plugs or unplugs the virtual cable of the given networks, all of them if none is given.
+	// The default network is named DefaultNetwork.
+	SetLinkUp(up bool, networks ...string) error
+	// SetNetworkConditions adds packet loss and latency to the guest network.
+	SetNetworkConditions(c NetworkConditions) error
+	// HostPort returns the host port a guest port is forwarded to.
+	HostPort(guestPort int) (int, error)
+	// Addresses returns the IPv4 address of the guest on each of its private networks, by network name.
+	Addresses(ctx context.Context) (map[string]string, error)
+	// Console returns the output of the machine console captured so far.
+	Console() (io.ReadCloser, error)
 	ReceiveFile(src, dst string) error
+	ReceiveFileContext(ctx context.Context, src, dst string) error
 	SendFile(src, dst, permissions string) error
+	SendFileContext(ctx context.Context, src, dst, permissions string) error
 }
+
+// State is the lifecycle state of a machine, common to all engines.
+type State string
+
+const (
+	// StateCreating is a machine being created or booted by the engine.
+	StateCreating State = "creating"
+	StateRunning  State = "running"
+	StatePaused   State = "paused"
+	// StateStopped is a machine that was shut down or stopped, and can still be cleaned.
+	StateStopped State = "stopped"
+	// StateCrashed is a machine that died on its own, or whose guest is stuck.
+	StateCrashed State = "crashed"
+	// StateGone is a machine that doesn't exist, never created or already cleaned.
+	StateGone State = "gone"
+)
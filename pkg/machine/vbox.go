@@ -3,9 +3,14 @@ package machine
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spectrocloud/peg/internal/utils"
@@ -15,9 +20,34 @@ import (
 
 type VBox struct {
 	machineConfig types.MachineConfig
+
+	// lifecycle is held while peg itself powers the VM off and on, so monitoring doesn't take it for dead
+	lifecycle sync.Mutex
+	// stopped is set by Stop, the VM going away then is not a failure
+	stopped  atomic.Bool
+	creating atomic.Bool
 }
 
 func (v *VBox) Stop() error {
+	v.stopped.Store(true)
+	if err := controller.CloseConnection(v); err != nil {
+		log.Debugf("Failed closing ssh connection: %s", err.Error())
+	}
+	return v.powerOff()
+}
+
+// powerOff powers the VM off, if it is still on.
+func (v *VBox) powerOff() error {
+	s, err := v.State()
+	if err != nil {
+		return err
+	}
+	if s != types.StateRunning && s != types.StatePaused && s != types.StateCreating && s != types.StateCrashed {
+		return nil
+	}
+	if out, err := utils.SH(fmt.Sprintf(`VBoxManage controlvm "%s" poweroff`, v.machineConfig.ID)); err != nil {
+		return errors.Wrap(err, out)
+	}
 	return nil
 }
 
@@ -26,11 +56,14 @@ func (v *VBox) Config() types.MachineConfig {
 }
 
 func (v *VBox) Clean() error {
-	if out, err := utils.SH(fmt.Sprintf(`VBoxManage controlvm "%s" poweroff`, v.machineConfig.ID)); err != nil {
-		return errors.Wrap(err, out)
+	v.stopped.Store(true)
+	if err := v.powerOff(); err != nil {
+		return err
 	}
-	if out, err := utils.SH(fmt.Sprintf(`VBoxManage unregistervm --delete "%s"`, v.machineConfig.ID)); err != nil {
-		return errors.Wrap(err, out)
+	if s, err := v.State(); err == nil && s != types.StateGone {
+		if out, err := utils.SH(fmt.Sprintf(`VBoxManage unregistervm --delete "%s"`, v.machineConfig.ID)); err != nil {
+			return errors.Wrap(err, out)
+		}
 	}
 	if err := os.RemoveAll(v.machineConfig.StateDir); err != nil {
 		return err
@@ -39,12 +72,99 @@ func (v *VBox) Clean() error {
 	return nil
 }
 
+// vboxStates maps the VirtualBox VM states to the common ones. States not listed are transient.
+var vboxStates = map[string]types.State{
+	"running":       types.StateRunning,
+	"paused":        types.StatePaused,
+	"poweroff":      types.StateStopped,
+	"saved":         types.StateStopped,
+	"teleported":    types.StateStopped,
+	"aborted":       types.StateCrashed,
+	"aborted-saved": types.StateCrashed,
+	"stuck":         types.StateCrashed, // guru meditation
+}
+
+// State returns the VM state reported by VirtualBox.
+func (v *VBox) State() (types.State, error) {
+	if v.creating.Load() {
+		return types.StateCreating, nil
+	}
+
+	info, err := v.vmInfo()
+	if err != nil {
+		if strings.Contains(err.Error(), "Could not find a registered machine") {
+			return types.StateGone, nil
+		}
+		return "", err
+	}
+	if s, ok := vboxStates[info["VMState"]]; ok {
+		return s, nil
+	}
+	// starting, restoring, saving, snapshotting...
+	return types.StateCreating, nil
+}
+
+func (v *VBox) Pause() error {
+	return v.controlVM("pause")
+}
+
+func (v *VBox) Resume() error {
+	return v.controlVM("resume")
+}
+
+// Restart resets the VM when hard, or reboots it from the guest otherwise.
+func (v *VBox) Restart(hard bool) error {
+	if !hard {
+		return guestReboot(v, "sudo /bin/sh")
+	}
+	defer controller.CloseConnection(v) //nolint:errcheck
+	return v.controlVM("reset")
+}
+
+// Shutdown powers the VM off. When graceful, the guest gets an ACPI power button event and
+// is powered off hard if it isn't off within timeout.
+func (v *VBox) Shutdown(graceful bool, timeout time.Duration) error {
+	if !graceful {
+		return v.Stop()
+	}
+
+	v.stopped.Store(true)
+	if err := v.controlVM("acpipowerbutton"); err != nil {
+		return err
+	}
+	if !waitState(v, timeout, types.StateStopped, types.StateCrashed, types.StateGone) {
+		if err := v.Stop(); err != nil {
+			return fmt.Errorf("%w, and powering off failed: %s", types.ErrShutdownTimeout, err.Error())
+		}
+		return types.ErrShutdownTimeout
+	}
+	return controller.CloseConnection(v)
+}
+
+func (v *VBox) controlVM(action string) error {
+	out, err := utils.SH(fmt.Sprintf(`VBoxManage controlvm "%s" %s`, v.machineConfig.ID, action))
+	if err != nil {
+		return fmt.Errorf("failed running %s: %w - %s", action, err, out)
+	}
+	return nil
+}
+
 func (v *VBox) CreateDisk(diskname, size string) error {
 	_, err := utils.SH(fmt.Sprintf("VBoxManage createmedium disk --filename %s --size %s", filepath.Join(v.machineConfig.StateDir, diskname), size))
 	return err
 }
 
 func (v *VBox) Create(ctx context.Context) (context.Context, error) {
+	v.creating.Store(true)
+	defer v.creating.Store(false)
+
+	if v.machineConfig.BaseImage != "" {
+		return ctx, errors.New("base images are supported only by the qemu engine")
+	}
+	if len(v.machineConfig.Networks) != 0 {
+		return ctx, errors.New("private networks are supported only by the qemu engine")
+	}
+
 	out, err := utils.SH(fmt.Sprintf("VBoxManage createvm --name %[1]s --uuid %[1]s --register", v.machineConfig.ID))
 	if err != nil {
 		return ctx, fmt.Errorf("while creating VM: %w - %s", err, out)
@@ -60,6 +180,19 @@ func (v *VBox) Create(ctx context.Context) (context.Context, error) {
 		return ctx, fmt.Errorf("while set VM: %w - %s", err, out)
 	}
 
+	for _, p := range v.machineConfig.Ports {
+		out, err = utils.SH(fmt.Sprintf(`VBoxManage modifyvm %[1]s --natpf1 "guest%[2]s%[3]d,%[2]s,127.0.0.1,%[4]d,,%[3]d"`, v.machineConfig.ID, p.Protocol, p.Guest, p.Host))
+		if err != nil {
+			return ctx, fmt.Errorf("failed forwarding port %d: %w - %s", p.Guest, err, out)
+		}
+	}
+
+	// Log the serial console to the state dir (used in `Console()`)
+	out, err = utils.SH(fmt.Sprintf(`VBoxManage modifyvm %s --uart1 0x3F8 4 --uartmode1 file "%s"`, v.machineConfig.ID, v.consoleLogFile()))
+	if err != nil {
+		return ctx, fmt.Errorf("while set VM: %w - %s", err, out)
+	}
+
 	out, err = utils.SH(fmt.Sprintf(`VBoxManage storagectl "%s" --name "sata controller" --add sata --portcount 2 --hostiocache off`, v.machineConfig.ID))
 	if err != nil {
 		return ctx, fmt.Errorf("while set VM: %w - %s", err, out)
@@ -80,7 +213,7 @@ func (v *VBox) Create(ctx context.Context) (context.Context, error) {
 	totalDrives := 0
 	for _, d := range userDrives {
 		totalDrives++
-		out, err = utils.SH(fmt.Sprintf(`VBoxManage storageattach "%s-%d" --storagectl "sata controller" --port %d --device 0 --type hdd --medium %s`, v.machineConfig.ID, totalDrives-1, totalDrives, d))
+		out, err = utils.SH(fmt.Sprintf(`VBoxManage storageattach "%s" --storagectl "sata controller" --port %d --device 0 --type hdd --medium %s`, v.machineConfig.ID, totalDrives-1, d))
 		if err != nil {
 			return ctx, fmt.Errorf("while set VM: %w - %s", err, out)
 		}
@@ -107,15 +240,76 @@ func (v *VBox) Create(ctx context.Context) (context.Context, error) {
 		return ctx, fmt.Errorf("while set VM: %w - %s", err, out)
 	}
 
-	return ctx, nil // TODO: Nothing monitors the vm process. The context won't be "Done" if it exits
+	v.stopped.Store(false)
+	return watch(ctx, v.alive, v.failed), nil
+}
+
+// vmInfo returns the machine readable VM information.
+func (v *VBox) vmInfo() (map[string]string, error) {
+	out, err := utils.SH(fmt.Sprintf(`VBoxManage showvminfo "%s" --machinereadable`, v.machineConfig.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed getting VM info: %w - %s", err, out)
+	}
+
+	info := map[string]string{}
+	for _, l := range strings.Split(out, "\n") {
+		k, val, ok := strings.Cut(l, "=")
+		if !ok {
+			continue
+		}
+		info[strings.Trim(k, `"`)] = strings.Trim(strings.TrimSpace(val), `"`)
+	}
+	return info, nil
+}
+
+// alive polls the VM state. A VM that can't be found anymore is gone, which is a failure unless it was stopped.
+// Holding the lifecycle lock, state changes made by peg itself (e.g. restoring snapshots) are not seen.
+func (v *VBox) alive() (bool, bool) {
+	v.lifecycle.Lock()
+	defer v.lifecycle.Unlock()
+
+	info, err := v.vmInfo()
+	if err != nil {
+		log.Debugf("VM %s is gone: %s", v.machineConfig.ID, err.Error())
+		return false, !v.stopped.Load()
+	}
+	switch vboxStates[info["VMState"]] {
+	case types.StateStopped:
+		log.Infof("VM %s is not running anymore, state: %s", v.machineConfig.ID, info["VMState"])
+		return false, false
+	case types.StateCrashed:
+		log.Infof("VM %s is not running anymore, state: %s", v.machineConfig.ID, info["VMState"])
+		return false, !v.stopped.Load()
+	}
+	return true, false
+}
+
+// failed calls OnFailure with the VM log.
+func (v *VBox) failed() {
+	if v.machineConfig.OnFailure == nil {
+		return
+	}
+
+	output := ""
+	if info, err := v.vmInfo(); err == nil {
+		output = fmt.Sprintf("VMState=%s\n", info["VMState"])
+		if b, err := os.ReadFile(filepath.Join(info["LogFldr"], "VBox.log")); err == nil {
+			output += string(b)
+		}
+	}
+	v.machineConfig.OnFailure(deadGuest(v.machineConfig.StateDir, output, "1"))
 }
 
 func (v *VBox) Screenshot() (string, error) {
+	return v.ScreenshotContext(context.Background())
+}
+
+func (v *VBox) ScreenshotContext(ctx context.Context) (string, error) {
 	f, err := ioutil.TempFile("", "fff")
 	if err != nil {
 		return "", err
 	}
-	_, err = utils.SH(fmt.Sprintf(`VBoxManage controlvm "%s" screenshotpng "%s"`, v.machineConfig.ID, f.Name()))
+	_, err = utils.SHContext(ctx, fmt.Sprintf(`VBoxManage controlvm "%s" screenshotpng "%s"`, v.machineConfig.ID, f.Name()))
 	if err != nil {
 		return "", err
 	}
@@ -127,23 +321,174 @@ func (v *VBox) DetachCD() error {
 	return err
 }
 
-func (v *VBox) Restart() error {
-	_, err := utils.SH(fmt.Sprintf(`VBoxManage controlvm "%s" reset`, v.machineConfig.ID))
-	return err
+// SendKeys presses key combinations on the machine keyboard, in QEMU sendkey syntax (e.g. "ctrl-alt-delete").
+func (v *VBox) SendKeys(keys ...string) error {
+	codes, err := keysToScancodes(keys...)
+	if err != nil {
+		return err
+	}
+
+	hex := []string{}
+	for _, c := range codes {
+		hex = append(hex, fmt.Sprintf("%02x", c))
+	}
+	out, err := utils.SH(fmt.Sprintf(`VBoxManage controlvm "%s" keyboardputscancode %s`, v.machineConfig.ID, strings.Join(hex, " ")))
+	if err != nil {
+		return fmt.Errorf("failed sending keys: %w - %s", err, out)
+	}
+	return nil
+}
+
+// TypeText types text on the machine keyboard, as on a US layout.
+func (v *VBox) TypeText(text string) error {
+	keys, err := textToKeys(text)
+	if err != nil {
+		return err
+	}
+	return v.SendKeys(keys...)
+}
+
+// Snapshot takes a live snapshot of the machine.
+func (v *VBox) Snapshot(name string) error {
+	// VirtualBox allows duplicated names, drop the old one so restoring is unambiguous
+	snapshots, err := v.ListSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, s := range snapshots {
+		if s != name {
+			continue
+		}
+		if out, err := utils.SH(fmt.Sprintf(`VBoxManage snapshot "%s" delete "%s"`, v.machineConfig.ID, name)); err != nil {
+			return fmt.Errorf("failed replacing snapshot: %w - %s", err, out)
+		}
+	}
+
+	out, err := utils.SH(fmt.Sprintf(`VBoxManage snapshot "%s" take "%s" --live`, v.machineConfig.ID, name))
+	if err != nil {
+		return fmt.Errorf("failed taking snapshot: %w - %s", err, out)
+	}
+	return nil
+}
+
+// Restore powers off the machine, restores the named snapshot and starts it again.
+func (v *VBox) Restore(name string) error {
+	if err := hasSnapshot(v, name); err != nil {
+		return err
+	}
+
+	v.lifecycle.Lock()
+	defer v.lifecycle.Unlock()
+	defer controller.CloseConnection(v) //nolint:errcheck
+
+	if out, err := utils.SH(fmt.Sprintf(`VBoxManage controlvm "%s" poweroff`, v.machineConfig.ID)); err != nil {
+		return fmt.Errorf("failed powering off: %w - %s", err, out)
+	}
+	if out, err := utils.SH(fmt.Sprintf(`VBoxManage snapshot "%s" restore "%s"`, v.machineConfig.ID, name)); err != nil {
+		return fmt.Errorf("failed restoring snapshot: %w - %s", err, out)
+	}
+	if out, err := utils.SH(fmt.Sprintf(`VBoxManage startvm "%s" --type headless`, v.machineConfig.ID)); err != nil {
+		return fmt.Errorf("failed starting VM: %w - %s", err, out)
+	}
+	return nil
+}
+
+func (v *VBox) ListSnapshots() ([]string, error) {
+	out, err := utils.SH(fmt.Sprintf(`VBoxManage snapshot "%s" list --machinereadable`, v.machineConfig.ID))
+	if err != nil {
+		// VBoxManage fails when there are no snapshots at all
+		if strings.Contains(out, "does not have any snapshots") {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("failed listing snapshots: %w - %s", err, out)
+	}
+
+	// SnapshotName="base"
+	// SnapshotName-1="child"
+	names := []string{}
+	for _, l := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(l, "SnapshotName") {
+			continue
+		}
+		pieces := strings.SplitN(l, "=", 2)
+		if len(pieces) == 2 {
+			names = append(names, strings.Trim(pieces[1], `"`))
+		}
+	}
+	return names, nil
 }
 
 func (v *VBox) Command(cmd string) (string, error) {
 	return controller.SSHCommand(v, cmd)
 }
 
+func (v *VBox) CommandContext(ctx context.Context, cmd string) (string, error) {
+	return controller.SSHCommandContext(ctx, v, cmd)
+}
+
+func (v *VBox) Run(ctx context.Context, cmd string, opts ...types.RunOption) (*types.CommandResult, error) {
+	return controller.SSHRun(ctx, v, cmd, opts...)
+}
+
 func (v *VBox) ReceiveFile(src, dst string) error {
 	return controller.ReceiveFile(v, src, dst)
 }
 
+func (v *VBox) ReceiveFileContext(ctx context.Context, src, dst string) error {
+	return controller.ReceiveFileContext(ctx, v, src, dst)
+}
+
 func (v *VBox) SendFile(src, dst, permissions string) error {
 	return controller.SendFile(v, src, dst, permissions)
 }
 
+func (v *VBox) SendFileContext(ctx context.Context, src, dst, permissions string) error {
+	return controller.SendFileContext(ctx, v, src, dst, permissions)
+}
+
+// SetLinkUp plugs or unplugs the virtual cable of the NAT network, the only one of VirtualBox machines.
+func (v *VBox) SetLinkUp(up bool, networks ...string) error {
+	for _, n := range networks {
+		if n != types.DefaultNetwork {
+			return fmt.Errorf("machine is not attached to network %s", n)
+		}
+	}
+
+	state := "off"
+	if up {
+		state = "on"
+	}
+	out, err := utils.SH(fmt.Sprintf(`VBoxManage controlvm "%s" setlinkstate1 %s`, v.machineConfig.ID, state))
+	if err != nil {
+		return fmt.Errorf("failed setting link state: %w - %s", err, out)
+	}
+	return nil
+}
+
+// SetNetworkConditions adds packet loss and latency to the guest network, with netem in the guest.
+func (v *VBox) SetNetworkConditions(c types.NetworkConditions) error {
+	return controller.SetNetworkConditions(context.Background(), v, c)
+}
+
+// HostPort returns the host port a guest port is forwarded to.
+func (v *VBox) HostPort(guestPort int) (int, error) {
+	return hostPort(v.machineConfig, guestPort)
+}
+
+// Addresses returns the IPv4 address of the guest on each of its private networks, by network name.
+func (v *VBox) Addresses(ctx context.Context) (map[string]string, error) {
+	return controller.GuestAddresses(ctx, v)
+}
+
+// Console returns the serial console output captured since the machine started.
+func (v *VBox) Console() (io.ReadCloser, error) {
+	return os.Open(v.consoleLogFile())
+}
+
+func (v *VBox) consoleLogFile() string {
+	return filepath.Join(v.machineConfig.StateDir, "console.log")
+}
+
 func (v *VBox) driveSizes() []string {
 	if len(v.machineConfig.DriveSizes) != 0 {
 		return v.machineConfig.DriveSizes
@@ -0,0 +1,40 @@
+package machine_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spectrocloud/peg/pkg/machine"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+var _ = Describe("VirtualBox", func() {
+	It("attaches the drives and the ISO to the VM from the first SATA port", func() {
+		// VBoxManage logs its commands, and the VM never starts
+		bin := GinkgoT().TempDir()
+		log := filepath.Join(bin, "VBoxManage.log")
+		script := fmt.Sprintf("#!/bin/sh\necho \"$*\" >> %s\n[ \"$1\" != startvm ]\n", log)
+		Expect(os.WriteFile(filepath.Join(bin, "VBoxManage"), []byte(script), 0755)).To(Succeed())
+		GinkgoT().Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+		state := GinkgoT().TempDir()
+		iso := filepath.Join(state, "boot.iso")
+		m, err := machine.New(types.VBoxEngine, types.WithStateDir(state), types.WithISO(iso))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = m.Create(context.Background())
+		Expect(err).To(HaveOccurred())
+
+		out, err := os.ReadFile(log)
+		Expect(err).ToNot(HaveOccurred())
+		id := m.Config().ID
+		Expect(strings.Split(string(out), "\n")).To(ContainElements(
+			fmt.Sprintf("storageattach %s --storagectl sata controller --port 0 --device 0 --type hdd --medium %s", id, filepath.Join(state, id+"-0.vdi")),
+			fmt.Sprintf("storageattach %s --storagectl sata controller --port 1 --device 0 --type dvddrive --medium %s", id, iso),
+		))
+	})
+})